@@ -3,6 +3,8 @@ module github.com/cyber-nic/rm-watermarks-cli
 go 1.21.5
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/mattn/go-isatty v0.0.19
 	github.com/rs/zerolog v1.31.0
 	gocv.io/x/gocv v0.35.0
 	gopkg.in/yaml.v3 v3.0.1
@@ -10,6 +12,5 @@ require (
 
 require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
-	github.com/mattn/go-isatty v0.0.19 // indirect
 	golang.org/x/sys v0.12.0 // indirect
 )
@@ -10,175 +10,648 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/cyber-nic/rm-watermarks-cli/watermark"
+	"github.com/mattn/go-isatty"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"gocv.io/x/gocv"
-	"gopkg.in/yaml.v3"
 )
 
-const (
-	CarbonCopyThreshold float32 = 96
+// Command line flags
+var (
+	srcPath         = flag.String("src", "", "sets input image path or glob pattern (eg. 'scans/2023-*.jpg'), - reads stdin. A pattern matching several files requires -dst-dir")
+	dstPath         = flag.String("dst", "", "sets destination image path, or comma separated paths to write the result in several formats. - writes to stdout")
+	format          = flag.String("format", "", "output format written to stdout with -dst -, eg. png or jpg")
+	srcDir          = flag.String("src-dir", "", "sets input directory, images are searched recursively up to -max-depth")
+	dstDir          = flag.String("dst-dir", "", "sets destination directory, mirroring the -src-dir tree")
+	watch           = flag.String("watch", "", "watch this directory and process the images created in it into dst-dir as they appear, until interrupted")
+	watchSettle     = flag.Duration("watch-settle", time.Second, "interval the size of watched files is polled at, a file being processed once its size stayed the same over it")
+	maxDepth        = flag.Int("max-depth", 10, "maximum directory depth walked in -src-dir, 0 is the directory itself only")
+	dstPattern      = flag.String("dst-pattern", "", "sets destination path pattern, "+watermark.HashPlaceholder+" is replaced by the output content hash and "+watermark.NamePlaceholder+" by the source name (eg. out/{name}-{hash}.png)")
+	debugFlag       = flag.Bool("debug", false, "Debug logging level")
+	threshold       = flag.Float64("threshold", 0, "fixed mean threshold (0-255), 0 included, overriding the one derived from every image, the config and its rules")
+	inpaintRadius   = flag.Float64("inpaint-radius", 0, "inpaint neighborhood radius in pixels overriding the config")
+	carbonThreshold = flag.Float64("carbon-threshold", 0, "brightness below which images are carbon copies, overriding the config, 0 treating none as one")
+	gamma           = flag.Float64("gamma", 1, "gamma curve applied to the images when read, before any processing: values < 1 brighten, values > 1 darken, 1 disables it")
+	stretch16Bit    = flag.Bool("stretch-16bit", false, "convert 16-bit scans to 8-bit by stretching the value range each image uses over 0-255, keeping more tonal detail but giving every image its own tone curve, rather than dividing by 256")
+	preserveColor   = flag.Bool("preserve-color", false, "only replace the watermark pixels with the inpainted grayscale ones, keeping the source colors everywhere else, eg. colored stamps and signatures")
+	grayscaleOutput = flag.Bool("grayscale-output", false, "write the result as a single channel grayscale image, eg. for OCR and smaller files. Color images whose colors the result kept are written as is, with a warning")
+	equalize        = flag.Bool("equalize", false, "equalize the histogram of the image masks are computed on, eg. for low-contrast carbon copies. Exclusive with the config clahe, which equalizes locally")
+	denoise         = flag.Float64("denoise", 0, "denoise the inpainted image with this strength as the last processing step, eg. 3, 0 disables it")
+	inpaintMethod   = flag.String("inpaint-method", "", "inpaint method overriding the config: telea, ns, a raw OpenCV flag value or an xphoto method")
+	logLevel        = flag.String("log-level", "", "log level: error, info or debug. Takes precedence over -debug and the config debug/info settings")
+	configFilename  = flag.String("config", "local.env.yaml", "Config File")
+	maxPixels       = flag.Int("max-pixels", 0, "maximum image size in pixels (rows*cols) processed, checked once decoded: a pixel count guard rather than a memory limit. 0 disables it")
+	maxDimension    = flag.Int("max-dimension", 0, "process images whose largest side exceeds this many pixels downscaled, upscaling the result back, 0 disables it")
+	maxPixelsAction = flag.String("max-pixels-action", "downscale", "what to do with images above -max-pixels: downscale or skip")
+	printConfig     = flag.Bool("print-config", false, "print the effective config as YAML and exit")
+	exportConfig    = flag.Bool("export-config", false, "write the effective config as "+watermark.EffectiveConfigFilename+" into the output directory")
+	writeOpts       watermark.WriteOptions
+	jpegQuality     = flag.Int("jpeg-quality", -1, "JPEG output quality from 0 to 100, -1 keeps the OpenCV default of 95")
+	pngCompression  = flag.Int("png-compression", -1, "PNG output compression level from 0 to 9, -1 keeps the OpenCV default")
+	annotate        = flag.String("annotate", "", "stamp the output with this text, {date} and {version} are replaced (eg. \"watermark removed {date} {version}\")")
+	manifestOut     = flag.String("manifest-out", "", "write a JSON provenance manifest of the source and output checksums to this path")
+	reportPath      = flag.String("report", "", "write a JSON report of the processed images to this path")
+	metricsOut      = flag.String("metrics-out", "", "append the image metrics of every processed image to this JSON lines file")
+	reportFormat    = flag.String("report-format", watermark.ReportFormatJSON, "report format: json (object, or array in directory mode) or ndjson")
+	interactive     = flag.String("interactive", "", "interactively correct the mask of -src over the source image and save it to this path")
+	dumpMask        = flag.String("dump-mask", "", "write the computed mask of -src to this png path and exit without inpainting")
+	planFlag        = flag.Bool("plan", false, "print the resolved processing plan as JSON and exit without inpainting")
+	autoThreshold   = flag.Bool("auto-threshold", false, "pick the threshold whose result best matches, by SSIM, the template area inpainted from its surroundings with the fewest mask pixels, among candidates swept on a downscaled copy, slower")
+	tileSize        = flag.Int("tile-size", 0, "process images larger than this many pixels per side in overlapping tiles of this size, 0 processes them whole")
+	tileOverlap     = flag.Int("tile-overlap", watermark.DefaultTileOverlap, "overlap in pixels between tiles, blended to avoid seams, at least twice the inpaint radius")
+	gpu             = flag.Bool("gpu", false, "run the mask and post blurs on a CUDA device when OpenCV is built with CUDA (-tags cuda), otherwise on the CPU with a warning")
+	thumbnail       = flag.String("thumbnail", "", "also write a thumbnail fitting WIDTHxHEIGHT (eg. 320x240) alongside every output, suffixed -thumb (eg. out-thumb.jpg)")
+	letterbox       = flag.Bool("thumbnail-letterbox", false, "pad thumbnails with white to exactly the -thumbnail size")
+	profile         = flag.Bool("profile", false, "log the time spent in each processing stage of every image (read, metrics, place, prepare, masks, fill, write) and of every mask")
+	cpuProfile      = flag.String("cpu-profile", "", "write a runtime/pprof CPU profile of the run to this path, eg. for go tool pprof")
+	compare         = flag.String("compare", "", "also write the source and result side by side to this path for review, "+watermark.NamePlaceholder+" being replaced by the source name, which batches require (eg. review/{name}.jpg)")
+	debugDir        = flag.String("debug-dir", "", "write the intermediate images (crop, bin, fg and mask per mask, aggregated mask and result) as PNG files into this directory, a headless alternative to visual mode")
+	maskFile        = flag.String("mask-file", "", "inpaint the non-zero pixels of this precomputed mask (eg. written by -dump-mask) in every image, in place of the masks computed from the config")
+	maskResize      = flag.Bool("mask-file-resize", false, "resize a -mask-file of another size than the image rather than failing")
+	pdfDPI          = flag.Int("pdf-dpi", watermark.DefaultPDFResolution, "resolution in DPI PDF pages are rasterized at with pdftoppm, every page being processed and written numbered (eg. out-1.png)")
+	cropProcess     = flag.Bool("crop-process", false, "only process the regions around the masks and composite them back into the original image")
+	workers         = flag.Int("workers", 1, "number of images processed in parallel in directory mode")
+	reportQuality   = flag.Bool("report-quality", false, "log the PSNR and SSIM between the image before inpainting and the output outside the mask")
+	preserveExif    = flag.Bool("preserve-exif", false, "copy the EXIF block of JPEG sources into JPEG outputs, with the orientation reset as pixels are rotated upright")
+	ignoreOrient    = flag.Bool("ignore-orientation", false, "process JPEG sources as stored, ignoring their EXIF orientation, eg. when already normalized")
+	skipExisting    = flag.Bool("skip-existing", false, "in directory or pattern mode, skip the images whose destination file already exists, eg. to resume a run")
+	skipBadMasks    = flag.Bool("skip-bad-masks", false, "skip the invalid mask entries of the config with a warning rather than exiting")
+	mode            = flag.String("mode", watermark.ModeInpaint, "processing mode: inpaint removes the watermark, cutout makes it transparent (png, webp and tiff only), fft filters a watermark tiled across the whole page out of the spectrum, clone covers it with a clean sample of the image, unblend reverses the blending of a semi-transparent watermark")
+	exifFilter      = watermark.ExifFilter{}
 )
 
-type Mask struct {
-	File    string `yaml:"file"`
-	Gravity string `yaml:"gravity"`
-	Foreground bool `yaml:"foreground"`
-}
-
-type AppConfig struct {
-	Debug  bool
-	Info   bool
-	Visual bool
-	Human  bool
-	Masks  []Mask
+func init() {
+	flag.IntVar(&writeOpts.Retries, "write-retries", 2, "number of times a failed write is retried")
+	flag.DurationVar(&writeOpts.Backoff, "write-backoff", 500*time.Millisecond, "delay before the first write retry, doubled on each retry")
+	flag.StringVar(&writeOpts.FallbackDir, "fallback-dir", "", "directory the output is written to when all write retries failed, mirroring the -dst-dir tree")
+	flag.Var(exifFilter, "exif-filter", "only process images whose EXIF tag matches key=value (repeatable, e.g. Model=fi-7160)")
 }
 
 func main() {
 	// Read flags
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	srcPath := flag.String("src", "", "sets input image path")
-	dstPath := flag.String("dst", "", "sets destination image path")
-	debugFlag := flag.Bool("debug", false, "Debug logging level")
-	configFilename := flag.String("config", "local.env.yaml", "Config File")
 	flag.Parse()
 
-	// Read config file
-	configFile, err := os.ReadFile(*configFilename)
+	cfg, err := watermark.ReadConfig(*configFilename)
+	if err == nil {
+		err = run(cfg)
+	}
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filepath.Base(os.Args[0]), err)
+		os.Exit(1)
 	}
+}
 
-	// Unmarshal the JSON data into a Config struct
-	var cfg AppConfig
-	err = yaml.Unmarshal(configFile, &cfg)
+// run processes the images selected by the flags using the config.
+func run(cfg watermark.Config) error {
+	// Apply flag overrides
+	if *debugFlag {
+		cfg.Debug = *debugFlag
+	}
+	if *inpaintMethod != "" {
+		cfg.InpaintMethod = *inpaintMethod
+	}
+	// Flags whose zero value is meaningful override the config only when set
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if *inpaintRadius != 0 {
+		cfg.InpaintRadius = float32(*inpaintRadius)
+	}
+	if set["carbon-threshold"] {
+		cfg.CarbonCopyThreshold = float32(*carbonThreshold)
+	}
+
+	// Set log level, before anything is logged
+	level, err := watermark.ResolveLogLevel(*logLevel, *debugFlag, cfg)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	zerolog.SetGlobalLevel(level)
+	if cfg.Human {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	}
 
-	debug := cfg.Debug
-	if *debugFlag {
-		debug = *debugFlag
+	if *printConfig {
+		data, err := watermark.MarshalEffectiveConfig(cfg, time.Now())
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(data)
+		return nil
 	}
 
-	// Perform input validation
-	if *srcPath == "" || *dstPath == "" {
-		panic("src, dst, and mask are all required")
+	// Expand a src glob pattern, several matched files being processed like a directory
+	var srcFiles []string
+	if *srcDir == "" && watermark.IsGlobPattern(*srcPath) {
+		matches, err := filepath.Glob(*srcPath)
+		if err != nil {
+			return fmt.Errorf("src %q: %w", *srcPath, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("src %q: no matching file", *srcPath)
+		}
+		srcFiles = matches
 	}
+	batch := *srcDir != "" || len(srcFiles) > 1
 
-	// Set log level
-	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
-	if cfg.Info {
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	// Perform input validation. A plan does not write any output
+	hasDst := *planFlag || *interactive != "" || *dumpMask != "" || *dstPattern != ""
+	if *watch != "" {
+		if *srcPath != "" || *srcDir != "" || *planFlag {
+			return errors.New("watch cannot be combined with src, src-dir or plan")
+		}
+		if *dstDir == "" {
+			return errors.New("watch requires dst-dir")
+		}
+		// Outputs written into the watched directory would be processed again, endlessly
+		if sameDir(*dstDir, *watch) {
+			return errors.New("watch requires a dst-dir other than the watched directory")
+		}
+		if *dstPattern != "" && sameDir(filepath.Dir(*dstPattern), *watch) {
+			return errors.New("watch requires a dst-pattern writing outside the watched directory")
+		}
+		if *reportPath != "" || *manifestOut != "" {
+			return errors.New("watch runs until interrupted, it cannot be combined with report or manifest-out, use metrics-out")
+		}
+		if *watchSettle <= 0 {
+			return fmt.Errorf("invalid watch-settle %s, must be a positive duration", *watchSettle)
+		}
+	} else if *srcDir != "" {
+		if *dstDir == "" && !hasDst {
+			return errors.New("src-dir requires dst-dir")
+		}
+	} else if len(srcFiles) > 1 {
+		if *dstDir == "" && !hasDst {
+			return fmt.Errorf("src %q matches %d files and requires dst-dir", *srcPath, len(srcFiles))
+		}
+		if *interactive != "" || *dumpMask != "" {
+			return fmt.Errorf("src %q matches %d files, interactive and dump-mask require a single file", *srcPath, len(srcFiles))
+		}
+	} else if *srcPath == "" || (*dstPath == "" && !hasDst) {
+		return errors.New("src, dst, and mask are all required")
 	}
-	if debug {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	dstPaths := watermark.SplitDst(*dstPath)
+	if err := watermark.ValidateDstPaths(dstPaths); err != nil {
+		return err
 	}
-	if cfg.Human {
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	for _, dst := range dstPaths {
+		if dst != watermark.StdioPath {
+			continue
+		}
+		if *format == "" {
+			return errors.New("dst - requires format")
+		}
+		if *thumbnail != "" {
+			return errors.New("thumbnail requires a dst file, not stdout")
+		}
+		if !watermark.IsImageFile("." + *format) {
+			return errors.New("invalid format: " + *format)
+		}
+		if *manifestOut != "" {
+			return errors.New("manifest-out requires a dst file, not stdout")
+		}
+	}
+	if *srcPath == watermark.StdioPath {
+		if *manifestOut != "" {
+			return errors.New("manifest-out requires a src file, not stdin")
+		}
+		if len(exifFilter) > 0 {
+			return errors.New("exif-filter requires a src file, not stdin")
+		}
+		if *preserveExif {
+			return errors.New("preserve-exif requires a src file, not stdin")
+		}
+	}
+	if *compare != "" {
+		if !watermark.IsImageFile(*compare) {
+			return fmt.Errorf("compare %q: unsupported output extension %q", *compare, filepath.Ext(*compare))
+		}
+		if batch && !strings.Contains(*compare, watermark.NamePlaceholder) {
+			return fmt.Errorf("compare %q: must contain %s to compare several images", *compare, watermark.NamePlaceholder)
+		}
+	}
+	if *interactive != "" && *srcPath == "" {
+		return errors.New("interactive requires src")
+	}
+	if *dumpMask != "" {
+		if *srcPath == "" {
+			return errors.New("dump-mask requires src")
+		}
+		if strings.ToLower(filepath.Ext(*dumpMask)) != ".png" {
+			return fmt.Errorf("dump-mask %q: must be a png path", *dumpMask)
+		}
+	}
+	if *dstPattern != "" {
+		if err := watermark.ValidateDstPattern(*dstPattern); err != nil {
+			return err
+		}
+	}
+	if *mode == watermark.ModeCutout {
+		for _, dst := range append(dstPaths, *dstPattern) {
+			if dst == watermark.StdioPath {
+				dst = "." + *format
+			}
+			if dst != "" && !watermark.SupportsAlpha(dst) {
+				return errors.New("cutout mode requires an output format supporting alpha: " + dst)
+			}
+		}
+	}
+	if err := watermark.ValidateReportFormat(*reportFormat); err != nil {
+		return err
+	}
+	if *maxPixelsAction != "downscale" && *maxPixelsAction != "skip" {
+		return errors.New("invalid max-pixels-action: " + *maxPixelsAction)
+	}
+	if *skipBadMasks {
+		masks := make([]watermark.Mask, 0, len(cfg.Masks))
+		for i, m := range cfg.Masks {
+			if err := watermark.ValidateMask(m); err != nil {
+				log.Warn().Err(err).Str("mask", m.File).Msgf("mask[%d] skipped", i)
+				continue
+			}
+			masks = append(masks, m)
+		}
+		cfg.Masks = masks
 	}
 
-	// Start
-	start := time.Now()
-	base := filepath.Base(*srcPath)
-	log.Debug().Str("image", *srcPath).Msg(base)
+	// Report every config problem at once rather than the first one. The config is validated, and its
+	// templates read, once by the pipeline
+	var errs []error
+	p, err := watermark.NewPipeline(cfg)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	ruleMasks := false
+	for _, r := range cfg.Rules {
+		ruleMasks = ruleMasks || len(r.Masks) > 0
+	}
+	if len(cfg.Masks) == 0 && !ruleMasks && *mode != watermark.ModeFFT && *maskFile == "" {
+		errs = append(errs, errors.New("no masks configured"))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s: invalid config:\n%w", *configFilename, errors.Join(errs...))
+	}
+	if *maskFile != "" {
+		m, err := watermark.ReadTemplate(*maskFile)
+		if err != nil {
+			return fmt.Errorf("mask-file: %w", err)
+		}
+		m.Close()
+	}
+	if *gamma <= 0 {
+		return fmt.Errorf("invalid gamma %g, must be positive", *gamma)
+	}
+	if *pdfDPI <= 0 {
+		return fmt.Errorf("invalid pdf-dpi %d, must be a positive resolution", *pdfDPI)
+	}
+	if *denoise < 0 {
+		return fmt.Errorf("invalid denoise %g, must be a positive strength", *denoise)
+	}
+	encodeOpts := watermark.EncodeOptions{
+		JpegQuality:       *jpegQuality,
+		PngCompression:    *pngCompression,
+		ChromaSubsampling: cfg.ChromaSubsampling,
+	}
+	if err := encodeOpts.Validate(); err != nil {
+		return err
+	}
 
-	// Read image
-	src := gocv.IMRead(*srcPath, gocv.IMReadColor)
-	defer src.Close()
+	if len(srcFiles) > 0 {
+		log.Info().Int("matches", len(srcFiles)).Str("src", *srcPath).Msg("src pattern")
+		if len(srcFiles) == 1 {
+			*srcPath = srcFiles[0]
+		}
+	}
+	if len(cfg.PreProcess) > 0 || len(cfg.PostProcess) > 0 {
+		log.Info().
+			Str("preProcess", watermark.FiltersString(cfg.PreProcess)).
+			Str("postProcess", watermark.FiltersString(cfg.PostProcess)).
+			Msg("filter pipeline")
+	}
 
-	// Compute image metrics
-	// b captures the overall average brightness of the image
-	// m represents the average of the channel-wise means, indicating the image's overall color balance
-	// s measures the average spread of pixel values across channels, reflecting the image's overall contrast or detail level
-	b, m, s := ComputeImageChannelMetrics(src)
+	p.MaxPixels = *maxPixels
+	p.MaxPixelsAction = *maxPixelsAction
+	p.ExifFilter = exifFilter
+	p.DstPattern = *dstPattern
+	writeOpts.Root = *dstDir
+	p.Write = writeOpts
+	p.Encode = encodeOpts
+	p.Annotate = *annotate
+	p.Mode = *mode
+	p.CropProcess = *cropProcess
+	p.ReportQuality = *reportQuality
+	p.PreserveExif = *preserveExif
+	p.Denoise = *denoise
+	p.Gamma = *gamma
+	p.Stretch16Bit = *stretch16Bit
+	if *compare != "" {
+		if err := os.MkdirAll(filepath.Dir(*compare), 0o755); err != nil {
+			return fmt.Errorf("compare: %w", err)
+		}
+		p.Compare = *compare
+	}
+	p.Equalize = *equalize
+	p.PreserveColor = *preserveColor
+	p.GrayscaleOutput = *grayscaleOutput
+	p.MaskFile = *maskFile
+	p.PDFResolution = *pdfDPI
+	p.MaskResize = *maskResize
+	p.IgnoreOrientation = *ignoreOrient
+	p.Format = *format
+	p.AutoThreshold = *autoThreshold
+	if set["threshold"] {
+		// The flag also prevails over the values of the rules
+		t := float32(*threshold)
+		p.Threshold = &t
+	}
+	p.MaxDimension = *maxDimension
+	p.TileSize = *tileSize
+	if *gpu {
+		if watermark.CudaAvailable() {
+			p.GPU = true
+			log.Info().Msg("blurring on the GPU, inpainting on the CPU")
+		} else {
+			log.Warn().Bool("compiled", watermark.CudaCompiled).Msg("no CUDA device available, processing on the CPU")
+		}
+	}
+	p.TileOverlap = *tileOverlap
+	if *thumbnail != "" {
+		p.Thumbnail, err = watermark.ParseSize(*thumbnail)
+		if err != nil {
+			return fmt.Errorf("thumbnail: %w", err)
+		}
+		p.Letterbox = *letterbox
+	}
+	if *debugDir != "" {
+		if err := os.MkdirAll(*debugDir, 0o755); err != nil {
+			return fmt.Errorf("debug dir: %w", err)
+		}
+		p.DebugDir = *debugDir
+	}
+	p.Profile = *profile
+	if err := p.Validate(); err != nil {
+		return err
+	}
 
-	// Invert colors if carbon copy
-	img := src.Clone()
-	defer img.Close()
-	if b < CarbonCopyThreshold {
-		img = InvertColors(src)
+	// Profile the whole run, written when it ends
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			return fmt.Errorf("cpu profile: %w", err)
+		}
+		defer f.Close()
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return fmt.Errorf("cpu profile: %w", err)
+		}
+		defer pprof.StopCPUProfile()
 	}
 
-	// Detect if color image
-	color := IsColor(img)
+	// Author a mask template by correcting the computed mask, GUI only
+	if *interactive != "" {
+		if !watermark.HasDisplay() {
+			log.Warn().Msg("interactive mode skipped, no display available")
+			return nil
+		}
+		if err := p.Interactive(*srcPath, *interactive); err != nil {
+			return err
+		}
+		return nil
+	}
 
-	// Remove colors. Inpainting works best on grayscale images
-	img = RemoveColors(img.Clone())
+	// Write the mask that would be inpainted, without processing
+	if *dumpMask != "" {
+		return p.DumpMask(*srcPath, *dumpMask)
+	}
 
-	// Compute binary image using mean threshold
-	thresh := s
-	if color {
-		dt := (m - s) / 2
-		// t = 1.2 *s
-		// t += dt
-		thresh = m - dt
+	// Describe what would be done, without processing
+	if *planFlag {
+		var plans []watermark.Plan
+		srcs := []string{*srcPath}
+		if *srcDir != "" {
+			srcs, err = watermark.CollectImages(*srcDir, *maxDepth)
+			if err != nil {
+				return err
+			}
+		} else if batch {
+			srcs = srcFiles
+		}
+		for _, src := range srcs {
+			plan, err := p.Plan(src)
+			if err != nil {
+				plan.Error = err.Error()
+			}
+			plans = append(plans, plan)
+		}
+		if err := watermark.WritePlans(os.Stdout, plans, batch); err != nil {
+			return err
+		}
+		return nil
 	}
 
-	// Create init empty mask
-	mask := gocv.NewMatWithSize(src.Rows(), src.Cols(), gocv.MatTypeCV8UC1)
-	mask.SetTo(gocv.Scalar{Val1: 0, Val2: 0, Val3: 0, Val4: 255})
-	defer mask.Close()
+	// Start
+	start := time.Now()
 
-	// Aggregate masks
-	for _, m := range cfg.Masks {
-		perf := time.Now()
+	// Record how this run was configured
+	if *exportConfig {
+		dir := "."
+		if len(dstPaths) > 0 {
+			dir = filepath.Dir(dstPaths[0])
+		}
+		if *dstPattern != "" {
+			dir = filepath.Dir(*dstPattern)
+		} else if *dstDir != "" {
+			dir = *dstDir
+		}
+		path, err := watermark.WriteEffectiveConfig(cfg, dir, start)
+		if err != nil {
+			return err
+		}
+		log.Debug().Str("config", path).Msg("effective config exported")
+	}
 
-		// Read watermark mask template
-		maskTpl := gocv.IMRead(m.File, gocv.IMReadGrayScale)
-		defer maskTpl.Close()
+	// Watch mode, processing the images as they appear until interrupted
+	if *watch != "" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return watchDir(ctx, p, *watch, *dstDir, *watchSettle, *metricsOut)
+	}
 
-		// Compute image specific watermark mask
-		_, bin, fg, msk := ComputeWatermarkMask(img, maskTpl, m.Gravity, thresh, m.Foreground)
-		defer msk.Close()
+	// Single image mode
+	if !batch {
+		res, err := p.Process(*srcPath, *dstPath)
+		if err != nil {
+			res.Error = err.Error()
+		}
+		if *reportPath != "" {
+			if err := watermark.WriteReport(*reportPath, *reportFormat, []watermark.Result{res}, false); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if *metricsOut != "" {
+			if err := watermark.AppendMetrics(*metricsOut, []watermark.Result{res}); err != nil {
+				return err
+			}
+		}
+		if *manifestOut != "" {
+			if err := watermark.WriteManifest(*manifestOut, cfg, start, []watermark.Result{res}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Directory mode, mirroring the source tree into the destination directory.
+	// Files matched by a src pattern are mirrored from the pattern root
+	root, files := *srcDir, srcFiles
+	if *srcDir != "" {
+		files, err = watermark.CollectImages(*srcDir, *maxDepth)
+		if err != nil {
+			return err
+		}
+		log.Info().Int("images", len(files)).Int("maxDepth", *maxDepth).Str("src", *srcDir).Msg("directory mode")
+	} else {
+		root = watermark.GlobRoot(*srcPath)
+	}
+
+	// Each worker owns the Mats of the images it processes, templates are read per image
+	n := *workers
+	if n < 1 {
+		n = 1
+	}
+	if cfg.Visual && n > 1 {
+		log.Warn().Int("workers", n).Msg("visual mode displays windows, processing with a single worker")
+		n = 1
+	}
 
-		// Aggregate masks
-		gocv.BitwiseOr(mask.Clone(), msk, &mask)
+	// Show the progress on interactive terminals, keeping logs clean elsewhere
+	var bar *progressBar
+	if cfg.Human && isatty.IsTerminal(os.Stderr.Fd()) {
+		bar = newProgressBar(os.Stderr, len(files))
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: bar})
+	}
+	results := processDir(p, files, root, *dstDir, n, *skipExisting, bar)
+	bar.Finish()
 
-		if cfg.Visual {
-			// gocv.NewWindow("crop").IMShow(crop)
-			gocv.NewWindow("bin").IMShow(bin)
-			gocv.NewWindow("fg").IMShow(fg)
-			// gocv.NewWindow("mask").IMShow(maskTpl)
-			gocv.WaitKey(0)
+	failed, skipped := 0, 0
+	for _, res := range results {
+		if res.Error != "" {
+			failed++
+		} else if res.Skipped != "" {
+			skipped++
 		}
-		
-		log.Debug().
-			Int64("duration(ms)", (time.Since(perf)).Milliseconds()).
-			Str("mask", m.File).Msg(base)
 	}
 
-	// Apply inpainting to remove the watermark
-	out := RemoveWatermark(img, mask)
-	defer out.Close()
+	// Failed images are recorded in the report with their error
+	if *reportPath != "" {
+		if err := watermark.WriteReport(*reportPath, *reportFormat, results, true); err != nil {
+			return err
+		}
+	}
 
-	if cfg.Visual {
-		gocv.NewWindow("src").IMShow(src)
-		// gocv.NewWindow("gray").IMShow(img)
-		gocv.NewWindow("mask").IMShow(mask)
-		gocv.NewWindow("Result").IMShow(out)
-		gocv.WaitKey(0)
-		return
+	// Only processed images have metrics
+	if *metricsOut != "" {
+		if err := watermark.AppendMetrics(*metricsOut, results); err != nil {
+			return err
+		}
 	}
 
-	// Write file
-	if ok := gocv.IMWrite(*dstPath, out); !ok {
-		panic("error writing image to disk")
+	// Only written outputs are listed in the manifest
+	if *manifestOut != "" {
+		if err := watermark.WriteManifest(*manifestOut, cfg, start, results); err != nil {
+			return err
+		}
 	}
 
-	// Done
 	log.Info().
 		Int64("duration(ms)", (time.Since(start)).Milliseconds()).
-		Float32("brightness", b).
-		Float32("mean", m).
-		Float32("stdDev", s).
-		Float32("threshold", thresh).
-		Bool("color", color).
-		Str("dst", *dstPath).
-		Msg(base)
+		Int("images", len(files)).
+		Int("processed", len(files)-failed-skipped).
+		Int("skipped", skipped).
+		Int("failed", failed).
+		Int("workers", n).
+		Msg("directory mode done")
+	if failed > 0 {
+		return fmt.Errorf("%d of %d images failed", failed, len(files))
+	}
+
+	return nil
+}
+
+// processDir processes the files mirroring srcDir into dstDir using the given number of workers,
+// skipping the files whose destination exists when skipExisting is set, and advancing the progress bar,
+// if any, as each file completes. Results are returned in the order of the files.
+func processDir(p *watermark.Pipeline, files []string, srcDir, dstDir string, workers int, skipExisting bool, bar *progressBar) []watermark.Result {
+	results := make([]watermark.Result, len(files))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = processFile(p, files[i], srcDir, dstDir, skipExisting)
+				bar.Increment()
+			}
+		}()
+	}
+
+	for i := range files {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// processFile processes a single file of srcDir into the mirrored path of dstDir.
+// The existence check is skipped with a dst pattern, whose output name is only known once processed.
+func processFile(p *watermark.Pipeline, f, srcDir, dstDir string, skipExisting bool) watermark.Result {
+	res := watermark.Result{Src: f}
+	rel, err := filepath.Rel(srcDir, f)
+	if err == nil {
+		dst := filepath.Join(dstDir, rel)
+		if skipExisting && p.DstPattern == "" {
+			if dstExists(f, dst) {
+				log.Info().Str("dst", dst).Msg(filepath.Base(f) + ": skipped")
+				res.Skipped = "destination exists"
+				return res
+			}
+		}
+		if err = os.MkdirAll(filepath.Dir(dst), 0o755); err == nil {
+			res, err = p.Process(f, dst)
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Str("image", f).Msg(filepath.Base(f))
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// dstExists reports whether the output of the file was already written to dst, multi-page documents
+// being written page by page to the numbered paths of watermark.PagePath.
+func dstExists(f, dst string) bool {
+	if watermark.IsMultiPage(f) {
+		return watermark.FirstPageExists(dst)
+	}
+	_, err := os.Stat(dst)
+	return err == nil
 }
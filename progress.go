@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressWidth is the number of characters of the progress bar itself
+const progressWidth = 30
+
+// progressBar draws the batch progress on the last terminal line, with the count, percentage and ETA.
+// It doubles as the log output, clearing the bar before each log line and redrawing it below.
+// A nil progressBar draws nothing.
+type progressBar struct {
+	mu    sync.Mutex
+	out   io.Writer
+	total int
+	done  int
+	start time.Time
+}
+
+// newProgressBar returns a progress bar of total images drawn on out.
+func newProgressBar(out io.Writer, total int) *progressBar {
+	b := &progressBar{out: out, total: total, start: time.Now()}
+	b.draw()
+	return b
+}
+
+// Write writes the log line above the progress bar.
+func (b *progressBar) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fmt.Fprint(b.out, "\r\033[K")
+	n, err := b.out.Write(p)
+	b.draw()
+	return n, err
+}
+
+// Increment counts an image as done.
+func (b *progressBar) Increment() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.done++
+	b.draw()
+}
+
+// Finish ends the progress bar line, leaving the final progress visible.
+func (b *progressBar) Finish() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fmt.Fprintln(b.out)
+}
+
+// draw redraws the progress bar over the current line.
+func (b *progressBar) draw() {
+	ratio := 1.0
+	if b.total > 0 {
+		ratio = float64(b.done) / float64(b.total)
+	}
+	filled := int(ratio * progressWidth)
+
+	eta := "?"
+	if b.done > 0 {
+		elapsed := time.Since(b.start)
+		eta = (elapsed / time.Duration(b.done) * time.Duration(b.total-b.done)).Round(time.Second).String()
+	}
+
+	fmt.Fprintf(b.out, "\r[%s%s] %d/%d %3.0f%% ETA %s\033[K",
+		strings.Repeat("=", filled), strings.Repeat(" ", progressWidth-filled), b.done, b.total, ratio*100, eta)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cyber-nic/rm-watermarks-cli/watermark"
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// watched is a file of the watched directory done being written, or that could not be waited for.
+type watched struct {
+	path string
+	err  error
+}
+
+// watchDir processes the images created in dir into dstDir as they appear, one at a time, until the context
+// is done. A file is read once its size stayed the same over the settle interval, as scanners and copies
+// write files in several steps. The metrics of every processed image are appended to metricsOut, if set.
+func watchDir(ctx context.Context, p *watermark.Pipeline, dir, dstDir string, settle time.Duration, metricsOut string) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watch: %w", err)
+	}
+	defer w.Close()
+	if err := w.Add(dir); err != nil {
+		return fmt.Errorf("watch %q: %w", dir, err)
+	}
+	log.Info().Str("dir", dir).Dur("settle", settle).Msg("watch mode, waiting for images")
+
+	// Files being written are waited for concurrently, creations and writes of the same file only once.
+	// Outputs are never processed again, should they land in the watched directory
+	ready := make(chan watched)
+	pending := map[string]bool{}
+	written := map[string]bool{}
+	processed, failed := 0, 0
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info().Int("processed", processed).Int("failed", failed).Msg("watch mode stopped")
+			return nil
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			log.Warn().Err(err).Str("dir", dir).Msg("watch error")
+
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+				continue
+			}
+			if pending[ev.Name] || written[absPath(ev.Name)] || !(watermark.IsImageFile(ev.Name) || watermark.IsPDFFile(ev.Name)) {
+				continue
+			}
+			pending[ev.Name] = true
+			go func(path string) {
+				err := waitStable(ctx, path, settle)
+				select {
+				case ready <- watched{path: path, err: err}:
+				case <-ctx.Done():
+				}
+			}(ev.Name)
+
+		case f := <-ready:
+			delete(pending, f.path)
+			if f.err != nil {
+				log.Warn().Err(f.err).Str("image", f.path).Msg("watched file skipped")
+				continue
+			}
+			res := processFile(p, f.path, dir, dstDir, false)
+			for _, dst := range watermark.SplitDst(res.Dst) {
+				written[absPath(dst)] = true
+			}
+			if res.Error != "" {
+				failed++
+				continue
+			}
+			processed++
+			if metricsOut != "" {
+				if err := watermark.AppendMetrics(metricsOut, []watermark.Result{res}); err != nil {
+					log.Error().Err(err).Str("metrics", metricsOut).Msg("metrics not written")
+				}
+			}
+		}
+	}
+}
+
+// sameDir reports whether the two paths name the same directory.
+func sameDir(a, b string) bool {
+	return absPath(a) == absPath(b)
+}
+
+// absPath returns the absolute path, or the cleaned path when it cannot be made absolute.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// waitStable waits until the file has a size that stayed the same over the interval.
+func waitStable(ctx context.Context, path string, interval time.Duration) error {
+	last := int64(-1)
+	for {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.Size() > 0 && info.Size() == last {
+			return nil
+		}
+		last = info.Size()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package watermark
+
+import (
+	"image"
+	"math"
+
+	"github.com/rs/zerolog/log"
+	"gocv.io/x/gocv"
+)
+
+// AutoThresholdProxySize is the largest side in pixels of the downscaled proxy the auto threshold sweep runs on
+const AutoThresholdProxySize = 512
+
+// AutoThresholdFactors are the candidate thresholds swept by the auto threshold, relative to the computed threshold
+var AutoThresholdFactors = []float32{0.7, 0.8, 0.9, 1, 1.1, 1.2, 1.3}
+
+// AutoThresholdTolerance is the SSIM a candidate may score below the highest one and still be picked for masking
+// fewer pixels
+const AutoThresholdTolerance = 0.01
+
+// thresholdCandidate is a threshold swept by the auto threshold, with the SSIM its result scored and the number of
+// pixels its mask covers.
+type thresholdCandidate struct {
+	threshold float32
+	ssim      float64
+	pixels    int
+}
+
+// pickThreshold returns the index of the candidate masking the fewest pixels among those whose SSIM is within
+// tolerance of the highest one, -1 when there is no candidate. Larger masks always bring the result closer to the
+// template area filled from its surroundings, and eventually erase the content it holds, so the smallest mask
+// scoring about as well as the best one is kept.
+func pickThreshold(candidates []thresholdCandidate, tolerance float64) int {
+	highest := math.Inf(-1)
+	for _, c := range candidates {
+		highest = math.Max(highest, c.ssim)
+	}
+	best := -1
+	for i, c := range candidates {
+		if c.ssim < highest-tolerance {
+			continue
+		}
+		if best < 0 || c.pixels < candidates[best].pixels {
+			best = i
+		}
+	}
+	return best
+}
+
+// thresholdScore returns the SSIM over area between the result of a candidate and the reference, the template
+// area inpainted from its surrounding untouched region.
+func thresholdScore(out, reference, area gocv.Mat) float64 {
+	x := grayFloat(out)
+	defer x.Close()
+	y := grayFloat(reference)
+	defer y.Close()
+	return maskedSSIM(x, y, area)
+}
+
+// autoThreshold sweeps the candidate thresholds around thresh on a downscaled proxy of the region image,
+// computing the mask and inpainting for each. Each result is scored by thresholdScore, its SSIM against the
+// template area filled from its surrounding untouched region, and the threshold is then picked by pickThreshold.
+// thresh is returned when no mask applies.
+func (p *Pipeline) autoThreshold(img gocv.Mat, placed []gocv.Mat, region image.Rectangle, thresh float32, base string) float32 {
+	scale := math.Min(1, float64(AutoThresholdProxySize)/float64(max(img.Cols(), img.Rows())))
+	size := image.Point{X: max(1, int(float64(img.Cols())*scale)), Y: max(1, int(float64(img.Rows())*scale))}
+	full := image.Rect(0, 0, size.X, size.Y)
+
+	proxy := gocv.NewMat()
+	defer proxy.Close()
+	gocv.Resize(img, &proxy, size, 0, 0, gocv.InterpolationArea)
+
+	// Downscale the placed masks, the union of the add masks being the template area. Masks which could
+	// not be located stay empty, as watermarkMask expects
+	area := gocv.NewMatWithSize(size.Y, size.X, gocv.MatTypeCV8UC1)
+	area.SetTo(gocv.Scalar{Val1: 0, Val2: 0, Val3: 0, Val4: 255})
+	defer area.Close()
+	proxyPlaced := make([]gocv.Mat, 0, len(placed))
+	defer func() {
+		for _, pm := range proxyPlaced {
+			pm.Close()
+		}
+	}()
+	for i, pm := range placed {
+		resized := gocv.NewMat()
+		proxyPlaced = append(proxyPlaced, resized)
+		if pm.Empty() {
+			continue
+		}
+		view := pm.Region(region)
+		gocv.Resize(view, &resized, size, 0, 0, gocv.InterpolationNearestNeighbor)
+		view.Close()
+		if p.Config.Masks[i].Mode != MaskModeSubtract {
+			CombineMasks(&area, resized, MaskCombineOr, false)
+		}
+	}
+	if gocv.CountNonZero(area) == 0 {
+		return thresh
+	}
+
+	// The reference fills the whole template area from its surroundings, the best any candidate mask can blend in
+	reference := RemoveWatermark(proxy, area, p.Method, p.Config.InpaintRadius)
+	defer reference.Close()
+
+	var candidates []thresholdCandidate
+	for _, factor := range AutoThresholdFactors {
+		t := thresh * factor
+		mask, err := p.computeMask(proxy, proxyPlaced, full, t, base)
+		if err != nil {
+			mask.Close()
+			continue
+		}
+		out := RemoveWatermark(proxy, mask, p.Method, p.Config.InpaintRadius)
+		c := thresholdCandidate{threshold: t, ssim: thresholdScore(out, reference, area), pixels: gocv.CountNonZero(mask)}
+		out.Close()
+		mask.Close()
+
+		log.Debug().Float32("threshold", t).Float64("ssim", c.ssim).Int("pixels", c.pixels).Msg(base + ": auto threshold candidate")
+		candidates = append(candidates, c)
+	}
+	i := pickThreshold(candidates, AutoThresholdTolerance)
+	if i < 0 {
+		return thresh
+	}
+
+	log.Info().
+		Float32("threshold", candidates[i].threshold).
+		Float32("computed", thresh).
+		Float64("ssim", candidates[i].ssim).
+		Msg(base + ": auto threshold")
+	return candidates[i].threshold
+}
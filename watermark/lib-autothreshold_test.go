@@ -0,0 +1,106 @@
+package watermark
+
+import (
+	"image"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+func TestPickThreshold(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []thresholdCandidate
+		tolerance  float64
+		want       int
+	}{
+		{name: "none", want: -1},
+		{name: "single", candidates: []thresholdCandidate{{threshold: 120, ssim: 0.6, pixels: 900}}, want: 0},
+		{
+			name: "highest SSIM",
+			candidates: []thresholdCandidate{
+				{threshold: 100, ssim: 0.5, pixels: 400},
+				{threshold: 120, ssim: 0.8, pixels: 900},
+				{threshold: 140, ssim: 0.7, pixels: 1600},
+			},
+			want: 1,
+		},
+		{
+			name: "smallest mask within tolerance",
+			candidates: []thresholdCandidate{
+				{threshold: 100, ssim: 0.78, pixels: 400},
+				{threshold: 120, ssim: 0.8, pixels: 900},
+				{threshold: 140, ssim: 0.79, pixels: 1600},
+			},
+			tolerance: 0.05,
+			want:      0,
+		},
+		{
+			name: "smaller mask beyond tolerance",
+			candidates: []thresholdCandidate{
+				{threshold: 100, ssim: 0.7, pixels: 100},
+				{threshold: 120, ssim: 0.76, pixels: 900},
+				{threshold: 140, ssim: 0.8, pixels: 1600},
+			},
+			tolerance: 0.05,
+			want:      1,
+		},
+		{
+			name: "equal masks keep the first",
+			candidates: []thresholdCandidate{
+				{threshold: 100, ssim: 0.8, pixels: 900},
+				{threshold: 120, ssim: 0.8, pixels: 900},
+			},
+			want: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pickThreshold(tt.candidates, tt.tolerance); got != tt.want {
+				t.Errorf("pickThreshold() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThresholdScore(t *testing.T) {
+	// A flat gray page, the template area in its center filled to match it
+	reference := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(128, 128, 128, 0), 64, 64, gocv.MatTypeCV8UC3)
+	defer reference.Close()
+	area := gocv.NewMatWithSize(64, 64, gocv.MatTypeCV8UC1)
+	defer area.Close()
+	center := area.Region(image.Rect(16, 16, 48, 48))
+	center.SetTo(gocv.NewScalar(255, 0, 0, 0))
+	center.Close()
+
+	// result returns the page with a watermark stroke of the given gray left across the template area
+	result := func(gray float64) gocv.Mat {
+		out := reference.Clone()
+		stroke := out.Region(image.Rect(16, 28, 48, 36))
+		stroke.SetTo(gocv.NewScalar(gray, gray, gray, 0))
+		stroke.Close()
+		return out
+	}
+	removed := reference.Clone()
+	defer removed.Close()
+	faint := result(110)
+	defer faint.Close()
+	strong := result(40)
+	defer strong.Close()
+
+	// The less of the watermark a candidate leaves, the higher it scores
+	scores := []float64{
+		thresholdScore(removed, reference, area),
+		thresholdScore(faint, reference, area),
+		thresholdScore(strong, reference, area),
+	}
+	if scores[0] < 0.999 {
+		t.Errorf("thresholdScore() of the removed watermark = %g, want 1", scores[0])
+	}
+	for i := 1; i < len(scores); i++ {
+		if scores[i] >= scores[i-1] {
+			t.Errorf("thresholdScore() = %v, want decreasing as the watermark left grows", scores)
+			break
+		}
+	}
+}
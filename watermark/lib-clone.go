@@ -0,0 +1,79 @@
+package watermark
+
+import (
+	"image"
+
+	"gocv.io/x/gocv"
+)
+
+// ClonePadding is the margin in pixels kept around the masked areas cloned over, giving the blending
+// a band of surrounding pixels to match. Nearby areas within twice the padding are cloned together.
+const ClonePadding = 3
+
+// CloneFill covers the masked pixels of the image with the clean sample found at the offset of each masked
+// area, blended into its surroundings by seamless (Poisson) cloning. Unlike inpainting, which smears the
+// surrounding pixels inwards, the sample brings its own texture, which suits opaque logos over textured or
+// uniformly colored backgrounds. The masked areas whose sample falls outside the image are left as is,
+// and returned in rest for the caller to fill otherwise.
+func CloneFill(img, mask gocv.Mat, o CloneOptions) (out, rest gocv.Mat) {
+	// Seamless cloning works on color images
+	bgr := img
+	if img.Channels() == 1 {
+		bgr = gocv.NewMat()
+		defer bgr.Close()
+		gocv.CvtColor(img, &bgr, gocv.ColorGrayToBGR)
+	}
+
+	out = bgr.Clone()
+	rest = mask.Clone()
+
+	// Clone area by area, the image border excluded as the blending needs pixels all around
+	contours := gocv.FindContours(mask, gocv.RetrievalExternal, gocv.ChainApproxSimple)
+	rects := make([]image.Rectangle, 0, contours.Size())
+	for i := 0; i < contours.Size(); i++ {
+		rects = append(rects, gocv.BoundingRect(contours.At(i)))
+	}
+	contours.Close()
+
+	bounds := image.Rect(0, 0, img.Cols(), img.Rows())
+	offset := image.Point{X: o.OffsetX, Y: o.OffsetY}
+	for _, r := range MergeRects(rects, ClonePadding, bounds.Inset(1)) {
+		sample := r.Add(offset)
+		if !sample.In(bounds) || r.Dx() < 3 || r.Dy() < 3 {
+			continue
+		}
+
+		// Blend the whole sample in, OpenCV leaving its outer pixels to the destination
+		patch := bgr.Region(sample)
+		full := gocv.NewMatWithSize(r.Dy(), r.Dx(), gocv.MatTypeCV8UC1)
+		full.SetTo(gocv.Scalar{Val1: 255})
+		blended := gocv.NewMat()
+		center := image.Point{X: (r.Min.X + r.Max.X) / 2, Y: (r.Min.Y + r.Max.Y) / 2}
+		gocv.SeamlessClone(patch, out, full, center, &blended, gocv.NormalClone)
+		patch.Close()
+		full.Close()
+
+		// Only replace the masked pixels of the area
+		areaMask := mask.Region(r)
+		from := blended.Region(r)
+		to := out.Region(r)
+		from.CopyToWithMask(&to, areaMask)
+		to.Close()
+		from.Close()
+		blended.Close()
+
+		done := rest.Region(r)
+		done.SetTo(gocv.Scalar{})
+		done.Close()
+		areaMask.Close()
+	}
+
+	// Match the input channels
+	if img.Channels() == 1 {
+		gray := gocv.NewMat()
+		gocv.CvtColor(out, &gray, gocv.ColorBGRToGray)
+		out.Close()
+		out = gray
+	}
+	return out, rest
+}
@@ -0,0 +1,73 @@
+package watermark
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// EffectiveConfigFilename is the name of the run-level config record written into the output directory.
+const EffectiveConfigFilename = "effective-config.yaml"
+
+// MarshalEffectiveConfig serializes the fully-resolved config to YAML,
+// prefixed with the tool version and a timestamp as comments.
+func MarshalEffectiveConfig(cfg Config, now time.Time) ([]byte, error) {
+	body, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# rm-watermarks-cli %s\n", Version)
+	fmt.Fprintf(&buf, "# generated %s\n", now.Format(time.RFC3339))
+	buf.Write(body)
+
+	return buf.Bytes(), nil
+}
+
+// WriteEffectiveConfig writes the fully-resolved config into dir and returns the written file path.
+func WriteEffectiveConfig(cfg Config, dir string, now time.Time) (string, error) {
+	data, err := MarshalEffectiveConfig(cfg, now)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, EffectiveConfigFilename)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// LogLevels are the values accepted by the -log-level flag.
+var LogLevels = map[string]zerolog.Level{
+	"error": zerolog.ErrorLevel,
+	"info":  zerolog.InfoLevel,
+	"debug": zerolog.DebugLevel,
+}
+
+// ResolveLogLevel selects the log level using the following precedence, highest first:
+// the -log-level flag, the -debug flag, the config debug setting, the config info setting.
+// The level defaults to error.
+func ResolveLogLevel(flagLevel string, debugFlag bool, cfg Config) (zerolog.Level, error) {
+	switch {
+	case flagLevel != "":
+		level, ok := LogLevels[flagLevel]
+		if !ok {
+			return zerolog.ErrorLevel, fmt.Errorf("invalid log level %q: expected error, info or debug", flagLevel)
+		}
+		return level, nil
+	case debugFlag, cfg.Debug:
+		return zerolog.DebugLevel, nil
+	case cfg.Info:
+		return zerolog.InfoLevel, nil
+	default:
+		return zerolog.ErrorLevel, nil
+	}
+}
@@ -0,0 +1,37 @@
+package watermark
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestResolveLogLevel(t *testing.T) {
+	tests := []struct {
+		name      string
+		flagLevel string
+		debugFlag bool
+		cfg       Config
+		want      zerolog.Level
+		wantErr   bool
+	}{
+		{name: "default", want: zerolog.ErrorLevel},
+		{name: "config info", cfg: Config{Info: true}, want: zerolog.InfoLevel},
+		{name: "config debug over info", cfg: Config{Debug: true, Info: true}, want: zerolog.DebugLevel},
+		{name: "debug flag over config", debugFlag: true, cfg: Config{Info: true}, want: zerolog.DebugLevel},
+		{name: "level flag over debug", flagLevel: "info", debugFlag: true, cfg: Config{Debug: true}, want: zerolog.InfoLevel},
+		{name: "level flag error", flagLevel: "error", cfg: Config{Info: true}, want: zerolog.ErrorLevel},
+		{name: "invalid level flag", flagLevel: "trace", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveLogLevel(tt.flagLevel, tt.debugFlag, tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveLogLevel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ResolveLogLevel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !cuda
+
+package watermark
+
+import (
+	"gocv.io/x/gocv"
+)
+
+// CudaCompiled reports whether the OpenCV CUDA modules are compiled in.
+// Build with -tags cuda against an OpenCV build including the CUDA modules to enable them.
+const CudaCompiled = false
+
+// CudaAvailable reports whether a CUDA device can be used, never without the CUDA modules.
+func CudaAvailable() bool {
+	return false
+}
+
+// CudaBlurImage falls back to blurring on the CPU when the CUDA modules are not compiled in.
+func CudaBlurImage(img gocv.Mat, ksize int) gocv.Mat {
+	return BlurImage(img, ksize)
+}
@@ -0,0 +1,1489 @@
+package watermark
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"gocv.io/x/gocv"
+)
+
+// InpaintMethodNames maps the inpaint method names accepted in config to the methods exposed by GoCV.
+var InpaintMethodNames = map[string]gocv.InpaintMethods{
+	"ns":    gocv.NS,
+	"telea": gocv.Telea,
+}
+
+// XPhotoMethod is an inpainting algorithm of the OpenCV contrib xphoto module.
+type XPhotoMethod int
+
+// XPhotoMethodNames maps the xphoto inpaint method names accepted in config to their algorithms.
+// These require building with -tags xphoto, see XPhotoAvailable.
+var XPhotoMethodNames = map[string]XPhotoMethod{
+	"shiftmap": 0,
+	"fsr-best": 1,
+	"fsr-fast": 2,
+}
+
+// ParseInpaintMethod resolves an inpaint method from either its name or its raw OpenCV flag value.
+// Raw values unknown to GoCV are accepted so that methods of custom OpenCV builds can be used.
+// An empty value defaults to Telea.
+func ParseInpaintMethod(s string) (gocv.InpaintMethods, error) {
+	if s == "" {
+		return gocv.Telea, nil
+	}
+
+	if method, ok := InpaintMethodNames[strings.ToLower(s)]; ok {
+		return method, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("unsupported inpaint method %q: expected telea, ns or a non-negative OpenCV flag value", s)
+	}
+
+	return gocv.InpaintMethods(n), nil
+}
+
+// IsKnownInpaintMethod reports whether the method is one of the inpaint methods exposed by GoCV.
+func IsKnownInpaintMethod(method gocv.InpaintMethods) bool {
+	for _, m := range InpaintMethodNames {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultInpaintRadius is the inpainting neighborhood radius in pixels used when none is configured
+const DefaultInpaintRadius float32 = 3
+
+// RemoveWatermark removes a watermark from an image using inpainting
+// considering a neighborhood of radius pixels around each inpainted pixel.
+func RemoveWatermark(src, mask gocv.Mat, method gocv.InpaintMethods, radius float32) gocv.Mat {
+	inpaintedImage := gocv.NewMat()
+
+	gocv.Inpaint(src, mask, &inpaintedImage, radius, method)
+	return inpaintedImage
+}
+
+// CombineMasks aggregates msk into mask using the given bitwise operator ("or" or "and").
+// The first mask to be combined is copied as is, otherwise "and" would always yield an empty mask.
+func CombineMasks(mask *gocv.Mat, msk gocv.Mat, op string, first bool) {
+	if first {
+		msk.CopyTo(mask)
+		return
+	}
+
+	// Write into a new mask rather than over the operand
+	combined := gocv.NewMat()
+	switch op {
+	case MaskCombineAnd:
+		gocv.BitwiseAnd(*mask, msk, &combined)
+	default:
+		gocv.BitwiseOr(*mask, msk, &combined)
+	}
+	mask.Close()
+	*mask = combined
+}
+
+// SubtractMask removes the sub mask pixels from mask.
+func SubtractMask(mask *gocv.Mat, sub gocv.Mat) {
+	inv := gocv.NewMat()
+	defer inv.Close()
+	gocv.BitwiseNot(sub, &inv)
+
+	kept := gocv.NewMat()
+	gocv.BitwiseAnd(*mask, inv, &kept)
+	mask.Close()
+	*mask = kept
+}
+
+// DilateMask grows the mask with a ksize x ksize elliptical kernel.
+func DilateMask(mask *gocv.Mat, ksize int) {
+	kernel := gocv.GetStructuringElement(gocv.MorphEllipse, image.Point{X: ksize, Y: ksize})
+	defer kernel.Close()
+
+	dilated := gocv.NewMat()
+	gocv.Dilate(*mask, &dilated, kernel)
+	mask.Close()
+	*mask = dilated
+}
+
+// BlurWithinMask returns a copy of the image smoothed with a ksize x ksize Gaussian kernel within the mask
+// grown by the kernel size, leaving the rest of the image crisp. blur computes the smoothed image, eg. BlurImage.
+func BlurWithinMask(img, mask gocv.Mat, ksize int, blur func(gocv.Mat, int) gocv.Mat) gocv.Mat {
+	region := mask.Clone()
+	defer region.Close()
+	DilateMask(&region, ksize)
+
+	blurred := blur(img, ksize)
+	defer blurred.Close()
+
+	out := img.Clone()
+	blurred.CopyToWithMask(&out, region)
+	return out
+}
+
+// SoftBlend blends the inpainted image with the source image proportionally to the watermark intensity.
+// The intensity is estimated per pixel as the difference between the source and inpainted images,
+// normalized by its maximum, so that faintly watermarked pixels are only lightly corrected.
+// Pixels outside the inpaint mask are left untouched since they do not differ.
+func SoftBlend(src, inpainted gocv.Mat) gocv.Mat {
+	// Estimate the watermark intensity
+	diff := gocv.NewMat()
+	defer diff.Close()
+	gocv.AbsDiff(src, inpainted, &diff)
+
+	intensity := gocv.NewMat()
+	defer intensity.Close()
+	if diff.Channels() > 1 {
+		gocv.CvtColor(diff, &intensity, gocv.ColorBGRToGray)
+	} else {
+		diff.CopyTo(&intensity)
+	}
+
+	_, maxVal, _, _ := gocv.MinMaxLoc(intensity)
+	if maxVal == 0 {
+		return inpainted.Clone()
+	}
+
+	// Build a float alpha mask in the [0, 1] range
+	alpha := gocv.NewMat()
+	defer alpha.Close()
+	intensity.ConvertToWithParams(&alpha, gocv.MatTypeCV32F, 1/maxVal, 0)
+
+	return BlendWithWeights(src, inpainted, alpha)
+}
+
+// BlendWithWeights returns a + weights * (b - a), blending the images with the CV32FC1 weights in the [0, 1] range,
+// 0 keeping a and 1 taking b. The result has the type of a.
+func BlendWithWeights(a, b, weights gocv.Mat) gocv.Mat {
+	// One weights plane per image channel
+	planes := make([]gocv.Mat, a.Channels())
+	for i := range planes {
+		planes[i] = weights
+	}
+	alphas := gocv.NewMat()
+	defer alphas.Close()
+	gocv.Merge(planes, &alphas)
+
+	s := gocv.NewMat()
+	defer s.Close()
+	a.ConvertTo(&s, gocv.MatTypeCV32F)
+
+	p := gocv.NewMat()
+	defer p.Close()
+	b.ConvertTo(&p, gocv.MatTypeCV32F)
+
+	delta := gocv.NewMat()
+	defer delta.Close()
+	gocv.Subtract(p, s, &delta)
+
+	weighted := gocv.NewMat()
+	defer weighted.Close()
+	gocv.Multiply(delta, alphas, &weighted)
+
+	sum := gocv.NewMat()
+	defer sum.Close()
+	gocv.Add(s, weighted, &sum)
+
+	out := gocv.NewMat()
+	sum.ConvertTo(&out, a.Type())
+
+	return out
+}
+
+// ComputeWatermarkMask computes a mask for the watermark in the input image.
+// This excludes the foreground text from the watermark mask.
+// Return the binary and foreground text images for debugging purposes.
+func ComputeWatermarkMask(img, maskTpl gocv.Mat, gravity string, thresh float32, opts ThresholdOptions, fgCfg ForegroundConfig, excludeForeground bool) (gocv.Mat, gocv.Mat, gocv.Mat, gocv.Mat, error) {
+	// Crop the watermark mask template to match src image size
+	crop, err := CropWithGravity(maskTpl, img.Cols(), img.Rows(), gravity)
+	if err != nil {
+		crop.Close()
+		return gocv.NewMat(), gocv.NewMat(), gocv.NewMat(), gocv.NewMat(), err
+	}
+
+	// Compute binary image to extract the foreground text with the watermark
+	bin := ConvertToBinary(img, thresh, opts)
+
+	// Extract foreground text from binary image
+	fg := ExtractForegroundText(bin, fgCfg)
+
+	// Subtract the text area from the watermark mask
+	var mask gocv.Mat
+	if excludeForeground {
+		mask = gocv.NewMat()
+		gocv.BitwiseAnd(crop, fg, &mask)
+	} else {
+		mask = crop.Clone()
+	}
+
+	return crop, bin, fg, mask, nil
+}
+
+// DefaultGradientKernel is the morphological gradient kernel size used when none is configured
+const DefaultGradientKernel = 3
+
+// ComputeGradientMask builds the watermark mask from the outlines highlighted by a morphological gradient
+// (dilate minus erode), restricted to the template. It returns the template crop, the binary gradient and the mask.
+func ComputeGradientMask(img, maskTpl gocv.Mat, gravity string, ksize int) (gocv.Mat, gocv.Mat, gocv.Mat, error) {
+	// Crop the watermark mask template to match src image size
+	crop, err := CropWithGravity(maskTpl, img.Cols(), img.Rows(), gravity)
+	if err != nil {
+		crop.Close()
+		return gocv.NewMat(), gocv.NewMat(), gocv.NewMat(), err
+	}
+
+	gray := gocv.NewMat()
+	defer gray.Close()
+	if img.Channels() > 1 {
+		gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
+	} else {
+		img.CopyTo(&gray)
+	}
+
+	// Highlight the watermark outlines
+	kernel := gocv.GetStructuringElement(gocv.MorphEllipse, image.Point{X: ksize, Y: ksize})
+	defer kernel.Close()
+	gradient := gocv.NewMat()
+	defer gradient.Close()
+	gocv.MorphologyEx(gray, &gradient, gocv.MorphGradient, kernel)
+
+	// Keep the strong edges, the Otsu algorithm picks the threshold
+	bin := gocv.NewMat()
+	gocv.Threshold(gradient, &bin, 0, 255, gocv.ThresholdBinary+gocv.ThresholdOtsu)
+
+	mask := gocv.NewMat()
+	gocv.BitwiseAnd(crop, bin, &mask)
+
+	return crop, bin, mask, nil
+}
+
+// ComputeImageChannelMetrics calculates key statistical measures, including mean and standard deviation,
+// across color channels of an image to quantify its brightness, color balance, and contrast. Where:
+// b captures the overall average brightness of the image
+// m represents the average of the channel-wise means, indicating the image's overall color balance
+// s measures the average spread of pixel values across channels, reflecting the image's overall contrast or detail level
+func ComputeImageChannelMetrics(img gocv.Mat) (float32, float32, float32) {
+	// Create Mats to store mean and standard deviation
+	mean := gocv.NewMat()
+	stdDev := gocv.NewMat()
+
+	// Calculate the mean color across all channels
+	gocv.MeanStdDev(img, &mean, &stdDev)
+
+	// Represents the overall mean pixel value of the original image img, compared to the carbon copy threshold
+	// Calculated using ComputeMatMean(img), directly averaging all pixel values across all channels.
+	b := ComputeMatMean(img)
+
+	// Represents the mean of the mean values across all channels.
+	// Calculated using ComputeMatMean(mean), averaging the mean values stored in the mean Mat.
+	// Provides a single-value summary of the overall central tendency of the image's colors.
+	m := ComputeMatMean(mean)
+
+	// Represents the mean of the standard deviation values across all channels.
+	// Calculated using ComputeMatMean(stdDev), averaging the standard deviation values stored in the stdDev Mat.
+	// Provides a single-value summary of the overall spread or variability of the image's pixel values.
+	s := ComputeMatMean(stdDev)
+
+	return b, m, s
+}
+
+func ConvertToBinaryUsingMeanThreshold(img gocv.Mat, t float32) gocv.Mat {
+	// Convert to grayscale if it's a color image, leaving the input image untouched
+	gray := img
+	if img.Channels() > 1 {
+		gray = gocv.NewMat()
+		defer gray.Close()
+		gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
+	}
+
+	// Apply thresholding using the mean value as the threshold
+	bin := gocv.NewMat()
+	defer bin.Close()
+	gocv.Threshold(gray, &bin, t, 255, gocv.ThresholdBinary)
+
+	// Convert back to BGR (3 channels) while keeping it grayscale
+	bgr := gocv.NewMat()
+	gocv.CvtColor(bin, &bgr, gocv.ColorGrayToBGR)
+
+	return bgr
+}
+
+const (
+	// DefaultAdaptiveBlockSize is the adaptive thresholding neighborhood size in pixels used when none is configured
+	DefaultAdaptiveBlockSize = 31
+	// DefaultAdaptiveC is the constant subtracted from the neighborhood mean used when none is configured
+	DefaultAdaptiveC float32 = 10
+)
+
+// ConvertToBinary binarizes the image with the configured thresholding method, at the mean threshold t
+// or adaptively.
+func ConvertToBinary(img gocv.Mat, t float32, opts ThresholdOptions) gocv.Mat {
+	if opts.Method == ThresholdAdaptive {
+		return ConvertToBinaryUsingAdaptiveThreshold(img, opts.BlockSize, opts.C)
+	}
+	return ConvertToBinaryUsingMeanThreshold(img, t)
+}
+
+// ConvertToBinaryUsingAdaptiveThreshold binarizes the image at the mean of each blockSize neighborhood
+// minus c, coping with uneven lighting. The result is returned as a 3 channel image.
+func ConvertToBinaryUsingAdaptiveThreshold(img gocv.Mat, blockSize int, c float32) gocv.Mat {
+	gray := gocv.NewMat()
+	defer gray.Close()
+	if img.Channels() > 1 {
+		gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
+	} else {
+		img.CopyTo(&gray)
+	}
+
+	bin := gocv.NewMat()
+	defer bin.Close()
+	gocv.AdaptiveThreshold(gray, &bin, 255, gocv.AdaptiveThresholdMean, gocv.ThresholdBinary, blockSize, c)
+
+	// Convert back to BGR (3 channels) while keeping it grayscale
+	bgr := gocv.NewMat()
+	gocv.CvtColor(bin, &bgr, gocv.ColorGrayToBGR)
+
+	return bgr
+}
+
+// DefaultForegroundThreshold is the manual foreground text threshold used when none is configured
+const DefaultForegroundThreshold float32 = 128
+
+// DefaultForegroundKernelSize is the width and height of the foreground text dilation kernel used when none is configured
+const DefaultForegroundKernelSize = 3
+
+// MaxForegroundIterations caps the foreground text dilation passes, beyond which the dilated text
+// swallows the watermark pixels around it
+const MaxForegroundIterations = 5
+
+// Morphology kernel shapes accepted in config
+const (
+	MorphShapeRect    = "rect"
+	MorphShapeEllipse = "ellipse"
+	MorphShapeCross   = "cross"
+)
+
+// MorphShapeNames maps the kernel shapes accepted in config to their GoCV shapes.
+var MorphShapeNames = map[string]gocv.MorphShape{
+	MorphShapeRect:    gocv.MorphRect,
+	MorphShapeEllipse: gocv.MorphEllipse,
+	MorphShapeCross:   gocv.MorphCross,
+}
+
+// ExtractForegroundText returns the foreground text of the image in black on a white background.
+func ExtractForegroundText(img gocv.Mat, cfg ForegroundConfig) gocv.Mat {
+	// Convert to grayscale
+	gray := gocv.NewMat()
+	gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
+
+	// current extraction strategy is to dilate the image to enhance the watermark features
+	return DilateImageToExtractForegroundText(gray, cfg)
+}
+
+// DilateImageToExtractForegroundText dilates the input image to enhance the watermark features.
+func DilateImageToExtractForegroundText(gray gocv.Mat, cfg ForegroundConfig) gocv.Mat {
+	// Apply thresholding to highlight watermark
+	// Assuming the watermark is lighter than the background
+	thresholdImage := gocv.NewMat()
+	defer thresholdImage.Close()
+
+	// ThresholdBinary  0
+	// ThresholdBinaryInv  1
+	// ThresholdTrunc  2
+	// ThresholdToZero  3
+	// ThresholdToZeroInv  4
+	// ThresholdMask  7
+	// ThresholdOtsu  8
+	// ThresholdTriangle  16
+
+	// var t gocv.ThresholdType = gocv.ThresholdBinaryInv + gocv.ThresholdOtsu
+	// gocv.Threshold(gray, &thresholdImage, thresh, maxvalue, t)
+	var thresh float32 // this value is ignored when using the Otsu algorithm
+
+	var t gocv.ThresholdType = gocv.ThresholdBinaryInv + gocv.ThresholdOtsu
+	if cfg.Threshold == ForegroundThresholdManual {
+		thresh = cfg.Value
+		t = gocv.ThresholdBinaryInv
+	}
+
+	gocv.Threshold(gray, &thresholdImage, thresh, 255, t)
+	// gocv.NewWindow("Thresh").IMShow(thresholdImage)
+
+	// Use morphology to enhance the watermark features
+	// Create a kernel for morphological operations
+	ksize := image.Point{X: cfg.KernelWidth, Y: cfg.KernelHeight}
+	kernel := gocv.GetStructuringElement(MorphShapeNames[cfg.KernelShape], ksize)
+
+	defer kernel.Close()
+
+	// Dilate to enhance the features of the watermark
+	dilatedImage := gocv.NewMat()
+	defer dilatedImage.Close()
+	if cfg.Iterations > 1 {
+		gocv.DilateWithParams(thresholdImage, &dilatedImage, kernel, image.Point{X: -1, Y: -1}, gocv.BorderType(cfg.Iterations), gocv.BorderConstant, color.RGBA{})
+	} else {
+		gocv.Dilate(thresholdImage, &dilatedImage, kernel)
+	}
+	// gocv.NewWindow("Dilated").IMShow(dilatedImage)
+
+	// Invert the colors to get the watermark in black on a white background
+	invertedImage := gocv.NewMat()
+	gocv.BitwiseNot(dilatedImage, &invertedImage)
+
+	// Return the image with the watermark
+	return invertedImage
+}
+
+// TextSafeZone returns a mask of the foreground text detected across the image, grown by buffer pixels.
+func TextSafeZone(img gocv.Mat, thresh float32, opts ThresholdOptions, fgCfg ForegroundConfig, buffer int) gocv.Mat {
+	bin := ConvertToBinary(img, thresh, opts)
+	defer bin.Close()
+
+	// Foreground text is black on a white background
+	fg := ExtractForegroundText(bin, fgCfg)
+	defer fg.Close()
+
+	text := gocv.NewMat()
+	defer text.Close()
+	gocv.BitwiseNot(fg, &text)
+
+	kernel := gocv.GetStructuringElement(gocv.MorphEllipse, image.Point{X: 2*buffer + 1, Y: 2*buffer + 1})
+	defer kernel.Close()
+
+	zone := gocv.NewMat()
+	gocv.Dilate(text, &zone, kernel)
+
+	return zone
+}
+
+// BlurImage returns a Gaussian-blurred copy of the image using a ksize x ksize kernel.
+func BlurImage(img gocv.Mat, ksize int) gocv.Mat {
+	blurred := gocv.NewMat()
+	gocv.GaussianBlur(img, &blurred, image.Point{X: ksize, Y: ksize}, 0, 0, gocv.BorderDefault)
+	return blurred
+}
+
+// CropGravitySouthWest crops the input image to match the specified width and height,
+// starting from the bottom left corner of the image.
+func CropGravitySouthWest(img gocv.Mat, width, height int) gocv.Mat {
+	imgSize := img.Size()
+
+	// Calculate the starting point (bottom left) for the crop
+	startX := 0
+	startY := imgSize[0] - height
+	if startY < 0 {
+		startY = 0
+	}
+
+	// Ensure the width and height do not exceed the image's dimensions
+	if startX+width > imgSize[1] {
+		width = imgSize[1] - startX
+	}
+	if startY+height > imgSize[0] {
+		height = imgSize[0] - startY
+	}
+
+	// Define the region of interest (ROI) and crop
+	rect := image.Rect(startX, startY, startX+width, startY+height)
+	cropped := img.Region(rect)
+
+	return cropped
+}
+
+// Gravities are the gravities accepted by CropWithGravity.
+var Gravities = []string{"north", "north-west", "north-east", "west", "east", "south", "south-west", "south-east", "center"}
+
+// ValidateGravity checks the gravity is one of Gravities.
+func ValidateGravity(gravity string) error {
+	for _, g := range Gravities {
+		if g == gravity {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid gravity %q", gravity)
+}
+
+// CropWithGravity crops the image to width x height from the side given by the gravity.
+func CropWithGravity(img gocv.Mat, width, height int, gravity string) (gocv.Mat, error) {
+	imgSize := img.Size()
+
+	// Calculate starting coordinates based on gravity
+	startX, startY := 0, 0
+	switch gravity {
+	case "north":
+		startY = 0
+	case "north-west":
+		startY = 0
+		startX = 0
+	case "north-east":
+		startY = 0
+		startX = imgSize[1] - width
+		if startX < 0 {
+			startX = 0
+			width = imgSize[1] // Adjust width to fit
+		}
+	case "west":
+		startX = 0
+	case "east":
+		startX = imgSize[1] - width
+		if startX < 0 {
+			startX = 0
+			width = imgSize[1] // Adjust width to fit
+		}
+	case "south":
+		startY = imgSize[0] - height
+		if startY < 0 {
+			startY = 0
+			height = imgSize[0] // Adjust height to fit
+		}
+	case "south-west":
+		startX = 0
+		startY = imgSize[0] - height
+		if startY < 0 {
+			startY = 0
+			height = imgSize[0] // Adjust height to fit
+		}
+	case "south-east":
+		startY = imgSize[0] - height
+		if startY < 0 {
+			startY = 0
+			height = imgSize[0] // Adjust height to fit
+		}
+		startX = imgSize[1] - width
+		if startX < 0 {
+			startX = 0
+			width = imgSize[1] // Adjust width to fit
+		}
+	case "center":
+		startX = (imgSize[1] - width) / 2
+		if startX < 0 {
+			startX = 0
+			width = imgSize[1] // Adjust width to fit
+		}
+		startY = (imgSize[0] - height) / 2
+		if startY < 0 {
+			startY = 0
+			height = imgSize[0] // Adjust height to fit
+		}
+	default:
+		return gocv.NewMat(), fmt.Errorf("invalid gravity %q", gravity)
+	}
+
+	// Ensure width and height do not exceed image dimensions
+	if startX+width > imgSize[1] {
+		width = imgSize[1] - startX
+	}
+	if startY+height > imgSize[0] {
+		height = imgSize[0] - startY
+	}
+
+	// Define the region of interest (ROI) and crop
+	rect := image.Rect(startX, startY, startX+width, startY+height)
+	cropped := img.Region(rect)
+
+	return cropped, nil
+}
+
+// PlaceTemplate returns a width x height mask holding the template aligned on the gravity side.
+// Templates larger than the mask are cropped with CropWithGravity, smaller ones are padded with zeros.
+func PlaceTemplate(tpl gocv.Mat, width, height int, gravity string) (gocv.Mat, error) {
+	crop, err := CropWithGravity(tpl, width, height, gravity)
+	defer crop.Close()
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+
+	placed := gocv.NewMatWithSize(height, width, crop.Type())
+	placed.SetTo(gocv.Scalar{Val1: 0, Val2: 0, Val3: 0, Val4: 255})
+
+	x, y := 0, 0
+	if gravity == "center" {
+		x = (width - crop.Cols()) / 2
+		y = (height - crop.Rows()) / 2
+	}
+	if strings.HasSuffix(gravity, "east") {
+		x = width - crop.Cols()
+	}
+	if strings.HasPrefix(gravity, "south") {
+		y = height - crop.Rows()
+	}
+
+	region := placed.Region(image.Rect(x, y, x+crop.Cols(), y+crop.Rows()))
+	crop.CopyTo(&region)
+	region.Close()
+
+	return placed, nil
+}
+
+// ParseRect converts an [x, y, width, height] rectangle, checking it lies within bounds.
+func ParseRect(r []int, bounds image.Rectangle) (image.Rectangle, error) {
+	if len(r) != 4 {
+		return image.Rectangle{}, fmt.Errorf("rect %v: expected [x, y, width, height]", r)
+	}
+	rect := image.Rect(r[0], r[1], r[0]+r[2], r[1]+r[3])
+	if r[2] <= 0 || r[3] <= 0 || !rect.In(bounds) {
+		return image.Rectangle{}, fmt.Errorf("rect %v: must be non-empty and lie within %v", r, bounds)
+	}
+	return rect, nil
+}
+
+// RectMask returns a width x height mask with the [x, y, width, height] rectangle filled,
+// checking the rectangle lies within the image.
+func RectMask(width, height int, r []int) (gocv.Mat, error) {
+	rect, err := ParseRect(r, image.Rect(0, 0, width, height))
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+
+	mask := gocv.NewMatWithSize(height, width, gocv.MatTypeCV8UC1)
+	mask.SetTo(gocv.Scalar{Val1: 0, Val2: 0, Val3: 0, Val4: 255})
+	region := mask.Region(rect)
+	region.SetTo(gocv.Scalar{Val1: 255, Val2: 255, Val3: 255, Val4: 255})
+	region.Close()
+
+	return mask, nil
+}
+
+// PolygonMask returns a width x height mask with the polygon of [x, y] vertices filled,
+// checking every vertex lies within the image.
+func PolygonMask(width, height int, vertices [][]int) (gocv.Mat, error) {
+	bounds := image.Rect(0, 0, width, height)
+	pts := make([]image.Point, 0, len(vertices))
+	for _, v := range vertices {
+		if len(v) != 2 {
+			return gocv.NewMat(), fmt.Errorf("polygon point %v: expected [x, y]", v)
+		}
+		pt := image.Point{X: v[0], Y: v[1]}
+		if !pt.In(bounds) {
+			return gocv.NewMat(), fmt.Errorf("polygon point %v: must lie within %v", v, bounds)
+		}
+		pts = append(pts, pt)
+	}
+
+	mask := gocv.NewMatWithSize(height, width, gocv.MatTypeCV8UC1)
+	mask.SetTo(gocv.Scalar{Val1: 0, Val2: 0, Val3: 0, Val4: 255})
+	polygon := gocv.NewPointsVectorFromPoints([][]image.Point{pts})
+	defer polygon.Close()
+	gocv.FillPoly(&mask, polygon, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+
+	return mask, nil
+}
+
+// ExcludeRects zeroes the [x, y, width, height] rectangles out of the mask template.
+func ExcludeRects(tpl *gocv.Mat, rects [][]int) error {
+	bounds := image.Rect(0, 0, tpl.Cols(), tpl.Rows())
+	for _, r := range rects {
+		rect, err := ParseRect(r, bounds)
+		if err != nil {
+			return err
+		}
+		region := tpl.Region(rect)
+		region.SetTo(gocv.Scalar{Val1: 0, Val2: 0, Val3: 0, Val4: 255})
+		region.Close()
+	}
+	return nil
+}
+
+// PlaceTemplateAt returns a width x height mask holding the non-zero bounding rectangle of the template
+// with its top left corner at pt.
+func PlaceTemplateAt(tpl gocv.Mat, width, height int, pt image.Point) gocv.Mat {
+	placed := gocv.NewMatWithSize(height, width, tpl.Type())
+	placed.SetTo(gocv.Scalar{Val1: 0, Val2: 0, Val3: 0, Val4: 255})
+
+	bounds := MaskBoundingRect(tpl)
+	rect := bounds.Sub(bounds.Min).Add(pt).Intersect(image.Rect(0, 0, width, height))
+	if rect.Empty() {
+		return placed
+	}
+
+	crop := tpl.Region(image.Rectangle{Min: bounds.Min, Max: bounds.Min.Add(rect.Size())})
+	defer crop.Close()
+	region := placed.Region(rect)
+	crop.CopyTo(&region)
+	region.Close()
+
+	return placed
+}
+
+// ShiftMask returns a copy of the mask moved by dx, dy pixels, the part moved past the image bounds being dropped.
+func ShiftMask(mask gocv.Mat, dx, dy int) gocv.Mat {
+	shifted := gocv.NewMatWithSize(mask.Rows(), mask.Cols(), mask.Type())
+	shifted.SetTo(gocv.Scalar{Val1: 0, Val2: 0, Val3: 0, Val4: 255})
+
+	bounds := image.Rect(0, 0, mask.Cols(), mask.Rows())
+	dst := bounds.Add(image.Pt(dx, dy)).Intersect(bounds)
+	if dst.Empty() {
+		return shifted
+	}
+
+	src := mask.Region(dst.Sub(image.Pt(dx, dy)))
+	defer src.Close()
+	region := shifted.Region(dst)
+	src.CopyTo(&region)
+	region.Close()
+
+	return shifted
+}
+
+// MaskBoundingRect returns the bounding rectangle of the non-zero pixels of the mask.
+func MaskBoundingRect(mask gocv.Mat) image.Rectangle {
+	contours := gocv.FindContours(mask, gocv.RetrievalExternal, gocv.ChainApproxSimple)
+	defer contours.Close()
+
+	var rect image.Rectangle
+	for i := 0; i < contours.Size(); i++ {
+		rect = rect.Union(gocv.BoundingRect(contours.At(i)))
+	}
+
+	return rect
+}
+
+// ChangedPixelsThreshold is the absolute difference above which a pixel is considered changed
+const ChangedPixelsThreshold = 8
+
+// DiffMask returns the mask of the pixels differing by more than thresh between the images,
+// converting the after image to the channels of the before image.
+func DiffMask(before, after gocv.Mat, thresh float32) gocv.Mat {
+	converted := after.Clone()
+	defer converted.Close()
+	switch {
+	case before.Channels() == 1 && after.Channels() == 3:
+		gocv.CvtColor(after, &converted, gocv.ColorBGRToGray)
+	case before.Channels() == 3 && after.Channels() == 1:
+		gocv.CvtColor(after, &converted, gocv.ColorGrayToBGR)
+	}
+
+	diff := gocv.NewMat()
+	defer diff.Close()
+	gocv.AbsDiff(before, converted, &diff)
+	if diff.Channels() > 1 {
+		gray := gocv.NewMat()
+		gocv.CvtColor(diff, &gray, gocv.ColorBGRToGray)
+		diff.Close()
+		diff = gray
+	}
+
+	mask := gocv.NewMat()
+	gocv.Threshold(diff, &mask, thresh, 255, gocv.ThresholdBinary)
+	return mask
+}
+
+// ChangedRegions returns the number of changed pixels of the mask and the bounding rectangles
+// of the changed regions as [x, y, width, height].
+func ChangedRegions(mask gocv.Mat) (int, [][4]int) {
+	contours := gocv.FindContours(mask, gocv.RetrievalExternal, gocv.ChainApproxSimple)
+	defer contours.Close()
+
+	boxes := make([][4]int, 0, contours.Size())
+	for i := 0; i < contours.Size(); i++ {
+		r := gocv.BoundingRect(contours.At(i))
+		boxes = append(boxes, [4]int{r.Min.X, r.Min.Y, r.Dx(), r.Dy()})
+	}
+
+	return gocv.CountNonZero(mask), boxes
+}
+
+// MergeRects pads the rectangles, clips them to bounds and merges the overlapping ones.
+func MergeRects(rects []image.Rectangle, padding int, bounds image.Rectangle) []image.Rectangle {
+	var merged []image.Rectangle
+	for _, r := range rects {
+		if r.Empty() {
+			continue
+		}
+		merged = append(merged, r.Inset(-padding).Intersect(bounds))
+	}
+
+	// Merge until no rectangles overlap
+	for changed := true; changed; {
+		changed = false
+		for i := 0; i < len(merged) && !changed; i++ {
+			for j := i + 1; j < len(merged); j++ {
+				if merged[i].Overlaps(merged[j]) {
+					merged[i] = merged[i].Union(merged[j])
+					merged = append(merged[:j], merged[j+1:]...)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	return merged
+}
+
+// FitToMaxPixels downscales the input image, preserving its aspect ratio, so that rows*cols
+// does not exceed maxPixels. The input image is closed and replaced by the downscaled one.
+func FitToMaxPixels(img gocv.Mat, maxPixels int) gocv.Mat {
+	pixels := img.Rows() * img.Cols()
+	if maxPixels <= 0 || pixels <= maxPixels {
+		return img
+	}
+
+	scale := math.Sqrt(float64(maxPixels) / float64(pixels))
+	size := image.Point{X: int(float64(img.Cols()) * scale), Y: int(float64(img.Rows()) * scale)}
+
+	resized := gocv.NewMat()
+	gocv.Resize(img, &resized, size, 0, 0, gocv.InterpolationArea)
+	img.Close()
+
+	return resized
+}
+
+// ConvertTo8Bit converts an image of higher bit depth, such as a 16-bit TIFF scan, to 8-bit, and returns the
+// input value range mapped over 0-255. 16-bit images are divided by 256, keeping their high byte, so that every
+// image of a batch gets the same tone curve. With stretch, and for other depths, the minimum to maximum value
+// range of the image itself is stretched over 0-255 instead, keeping more tonal detail of scans which use a
+// small part of the 16-bit range at the cost of tones differing across images. 8-bit images are returned as
+// is, otherwise the input image is closed.
+func ConvertTo8Bit(img gocv.Mat, stretch bool) (gocv.Mat, float32, float32) {
+	if img.Type()&7 == gocv.MatTypeCV8U {
+		return img, 0, 255
+	}
+
+	out := gocv.NewMat()
+	defer img.Close()
+	if !stretch && img.Type()&7 == gocv.MatTypeCV16U {
+		img.ConvertToWithParams(&out, gocv.MatTypeCV8U, 1.0/256, 0)
+		return out, 0, 65535
+	}
+
+	// Find the range across all channels
+	flat := img.Reshape(1, 0)
+	minVal, maxVal, _, _ := gocv.MinMaxLoc(flat)
+	flat.Close()
+
+	alpha := float32(0)
+	if maxVal > minVal {
+		alpha = 255 / (maxVal - minVal)
+	}
+	img.ConvertToWithParams(&out, gocv.MatTypeCV8U, alpha, -minVal*alpha)
+
+	return out, minVal, maxVal
+}
+
+// Thumbnail returns a copy of the image downscaled to fit width x height, preserving its aspect ratio.
+// Smaller images are not upscaled. With letterbox, the thumbnail is centered on a white width x height
+// canvas, giving every thumbnail the same size.
+func Thumbnail(img gocv.Mat, size image.Point, letterbox bool) gocv.Mat {
+	scale := math.Min(1, math.Min(float64(size.X)/float64(img.Cols()), float64(size.Y)/float64(img.Rows())))
+	fit := image.Point{X: max(1, int(float64(img.Cols())*scale)), Y: max(1, int(float64(img.Rows())*scale))}
+
+	thumb := gocv.NewMat()
+	gocv.Resize(img, &thumb, fit, 0, 0, gocv.InterpolationArea)
+	if !letterbox || fit == size {
+		return thumb
+	}
+	defer thumb.Close()
+
+	left, top := (size.X-fit.X)/2, (size.Y-fit.Y)/2
+	boxed := gocv.NewMat()
+	gocv.CopyMakeBorder(thumb, &boxed, top, size.Y-fit.Y-top, left, size.X-fit.X-left, gocv.BorderConstant, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	return boxed
+}
+
+// ApplyCLAHE returns a copy of the image with its contrast locally equalized by CLAHE, in tileGrid x tileGrid
+// tiles (8 when 0) whose amplification is capped by clipLimit. Color images are equalized on their
+// lightness only, keeping their colors.
+func ApplyCLAHE(img gocv.Mat, clipLimit float64, tileGrid int) gocv.Mat {
+	if tileGrid <= 0 {
+		tileGrid = 8
+	}
+	clahe := gocv.NewCLAHEWithParams(clipLimit, image.Point{X: tileGrid, Y: tileGrid})
+	defer clahe.Close()
+
+	return applyToLuminance(img, clahe.Apply)
+}
+
+// EqualizeHistogram returns a copy of the image with its histogram equalized over the whole image.
+// Color images are equalized on their lightness only, keeping their colors.
+func EqualizeHistogram(img gocv.Mat) gocv.Mat {
+	return applyToLuminance(img, gocv.EqualizeHist)
+}
+
+// CompareSeparatorWidth is the width in pixels of the gray line separating the images of a comparison
+const CompareSeparatorWidth = 4
+
+// SideBySide returns the before and after images concatenated horizontally as BGR, separated by a gray line,
+// for visual review. The after image is resized to the before image size when they differ.
+func SideBySide(before, after gocv.Mat) gocv.Mat {
+	toBGR := func(img gocv.Mat) gocv.Mat {
+		bgr := gocv.NewMat()
+		switch img.Channels() {
+		case 1:
+			gocv.CvtColor(img, &bgr, gocv.ColorGrayToBGR)
+		case 4:
+			gocv.CvtColor(img, &bgr, gocv.ColorBGRAToBGR)
+		default:
+			img.CopyTo(&bgr)
+		}
+		return bgr
+	}
+	left := toBGR(before)
+	defer left.Close()
+	right := toBGR(after)
+	defer right.Close()
+	if right.Rows() != left.Rows() || right.Cols() != left.Cols() {
+		resized := gocv.NewMat()
+		gocv.Resize(right, &resized, image.Point{X: left.Cols(), Y: left.Rows()}, 0, 0, gocv.InterpolationArea)
+		right.Close()
+		right = resized
+	}
+
+	separator := gocv.NewMatWithSize(left.Rows(), CompareSeparatorWidth, gocv.MatTypeCV8UC3)
+	defer separator.Close()
+	separator.SetTo(gocv.Scalar{Val1: 128, Val2: 128, Val3: 128})
+
+	withSeparator := gocv.NewMat()
+	defer withSeparator.Close()
+	gocv.Hconcat(left, separator, &withSeparator)
+	out := gocv.NewMat()
+	gocv.Hconcat(withSeparator, right, &out)
+	return out
+}
+
+// TileTemplate repeats the tile template across a width x height mask. Tiles are separated by
+// spacingX/spacingY pixels and the grid is shifted by offsetX/offsetY pixels.
+func TileTemplate(tile gocv.Mat, width, height, spacingX, spacingY, offsetX, offsetY int) gocv.Mat {
+	out := gocv.NewMatWithSize(height, width, tile.Type())
+	out.SetTo(gocv.Scalar{Val1: 0, Val2: 0, Val3: 0, Val4: 255})
+
+	stepX := tile.Cols() + spacingX
+	if stepX < 1 {
+		stepX = 1
+	}
+	stepY := tile.Rows() + spacingY
+	if stepY < 1 {
+		stepY = 1
+	}
+
+	// Start from the left-most and top-most tiles that still overlap the image
+	startX := offsetX % stepX
+	if startX > 0 {
+		startX -= stepX
+	}
+	startY := offsetY % stepY
+	if startY > 0 {
+		startY -= stepY
+	}
+
+	bounds := image.Rect(0, 0, width, height)
+	for y := startY; y < height; y += stepY {
+		for x := startX; x < width; x += stepX {
+			// Clip the tile to the image bounds
+			dst := image.Rect(x, y, x+tile.Cols(), y+tile.Rows()).Intersect(bounds)
+			if dst.Empty() {
+				continue
+			}
+
+			src := tile.Region(dst.Sub(image.Point{X: x, Y: y}))
+			region := out.Region(dst)
+			src.CopyTo(&region)
+			src.Close()
+			region.Close()
+		}
+	}
+
+	return out
+}
+
+// ReadMaskFile reads a precomputed mask of an image of the given size, eg. written by -dump-mask, as an 8-bit
+// single channel Mat whose non-zero pixels are inpainted. A mask of another size is resized to the image
+// with nearest neighbor interpolation when resize is set, and is an error otherwise.
+func ReadMaskFile(path string, size image.Point, resize bool) (gocv.Mat, error) {
+	mask, err := ReadTemplate(path)
+	if err != nil {
+		return mask, err
+	}
+	if mask.Cols() == size.X && mask.Rows() == size.Y {
+		return mask, nil
+	}
+	if !resize {
+		mask.Close()
+		return gocv.NewMat(), fmt.Errorf("%s: mask is %dx%d, image is %dx%d", path, mask.Cols(), mask.Rows(), size.X, size.Y)
+	}
+	defer mask.Close()
+	resized := gocv.NewMat()
+	gocv.Resize(mask, &resized, size, 0, 0, gocv.InterpolationNearestNeighbor)
+	return resized, nil
+}
+
+// ReadTemplate reads a watermark mask template. Templates with an alpha channel are masked by their
+// non-transparent pixels, others are read as grayscale. Missing or undecodable files are an error.
+func ReadTemplate(path string) (gocv.Mat, error) {
+	img := gocv.IMRead(path, gocv.IMReadUnchanged)
+	if img.Empty() {
+		img.Close()
+		return gocv.NewMat(), fmt.Errorf("%s: unable to read mask template", path)
+	}
+	if img.Channels() != 4 {
+		img.Close()
+		return gocv.IMRead(path, gocv.IMReadGrayScale), nil
+	}
+	defer img.Close()
+
+	channels := gocv.Split(img)
+	for _, c := range channels {
+		defer c.Close()
+	}
+
+	// Any opacity marks the watermark, including anti-aliased edges
+	tpl := gocv.NewMat()
+	gocv.Threshold(channels[3], &tpl, 0, 255, gocv.ThresholdBinary)
+	return tpl, nil
+}
+
+// ApplyExifOrientation returns a copy of the image turned upright according to the EXIF orientation (1 to 8).
+// Unknown orientations leave the image as is.
+func ApplyExifOrientation(img gocv.Mat, orientation int) gocv.Mat {
+	out := gocv.NewMat()
+	switch orientation {
+	case 2:
+		gocv.Flip(img, &out, 1)
+	case 3:
+		gocv.Rotate(img, &out, gocv.Rotate180Clockwise)
+	case 4:
+		gocv.Flip(img, &out, 0)
+	case 5:
+		gocv.Transpose(img, &out)
+	case 6:
+		gocv.Rotate(img, &out, gocv.Rotate90Clockwise)
+	case 7:
+		transposed := gocv.NewMat()
+		defer transposed.Close()
+		gocv.Transpose(img, &transposed)
+		gocv.Flip(transposed, &out, -1)
+	case 8:
+		gocv.Rotate(img, &out, gocv.Rotate90CounterClockwise)
+	default:
+		img.CopyTo(&out)
+	}
+	return out
+}
+
+// RotateTemplate rotates the template counterclockwise by degrees around its center. The canvas grows
+// to fit the rotated template so that no corner is clipped. Nearest neighbour interpolation keeps the mask binary.
+func RotateTemplate(tpl gocv.Mat, degrees float64) gocv.Mat {
+	w, h := float64(tpl.Cols()), float64(tpl.Rows())
+	rad := degrees * math.Pi / 180
+	cos, sin := math.Abs(math.Cos(rad)), math.Abs(math.Sin(rad))
+	width := int(math.Ceil(w*cos + h*sin))
+	height := int(math.Ceil(w*sin + h*cos))
+
+	rot := gocv.GetRotationMatrix2D(image.Point{X: tpl.Cols() / 2, Y: tpl.Rows() / 2}, degrees, 1)
+	defer rot.Close()
+
+	// Shift the rotated template to the center of the grown canvas
+	rot.SetDoubleAt(0, 2, rot.GetDoubleAt(0, 2)+float64(width-tpl.Cols())/2)
+	rot.SetDoubleAt(1, 2, rot.GetDoubleAt(1, 2)+float64(height-tpl.Rows())/2)
+
+	rotated := gocv.NewMat()
+	gocv.WarpAffineWithParams(tpl, &rotated, rot, image.Point{X: width, Y: height},
+		gocv.InterpolationNearestNeighbor, gocv.BorderConstant, color.RGBA{})
+
+	return rotated
+}
+
+// BuildCalibrationLUT builds the 256 entries lookup table described by the calibration config.
+// The LUT file takes precedence over the levels parameters.
+func BuildCalibrationLUT(c Calibration) ([]byte, error) {
+	if c.File != "" {
+		return LoadLUT(c.File)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	white, gamma := c.levels()
+	return LevelsLUT(c.Black, white, gamma), nil
+}
+
+// Validate checks the calibration levels. The LUT file, which takes precedence over them, is checked
+// when read by BuildCalibrationLUT.
+func (c Calibration) Validate() error {
+	if c.File != "" {
+		return nil
+	}
+	white, gamma := c.levels()
+	if c.Black < 0 || white > 255 || c.Black >= white {
+		return fmt.Errorf("invalid calibration levels: black %d, white %d", c.Black, white)
+	}
+	if gamma < 0 {
+		return fmt.Errorf("invalid calibration gamma: %v", gamma)
+	}
+	return nil
+}
+
+// levels returns the white level and gamma of the calibration, defaulting to 255 and 1.
+func (c Calibration) levels() (int, float64) {
+	white := c.White
+	if white == 0 {
+		white = 255
+	}
+	gamma := c.Gamma
+	if gamma == 0 {
+		gamma = 1
+	}
+	return white, gamma
+}
+
+// LoadLUT reads a lookup table file made of 256 whitespace-separated values in the 0-255 range.
+func LoadLUT(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 256 {
+		return nil, fmt.Errorf("LUT %s: expected 256 values, got %d", path, len(fields))
+	}
+
+	lut := make([]byte, 256)
+	for i, f := range fields {
+		v, err := strconv.Atoi(f)
+		if err != nil || v < 0 || v > 255 {
+			return nil, fmt.Errorf("LUT %s: invalid value %q at index %d", path, f, i)
+		}
+		lut[i] = byte(v)
+	}
+
+	return lut, nil
+}
+
+// LevelsLUT builds a lookup table stretching the [black, white] input range to [0, 255] with the gamma
+// curve out = in^gamma over the 0-1 range. Values < 1 brighten midtones, values > 1 darken them.
+func LevelsLUT(black, white int, gamma float64) []byte {
+	lut := make([]byte, 256)
+	for i := range lut {
+		v := float64(i-black) / float64(white-black)
+		v = math.Max(0, math.Min(1, v))
+		lut[i] = byte(math.Round(math.Pow(v, gamma) * 255))
+	}
+
+	return lut
+}
+
+// IsIdentityLUT reports whether the lookup table leaves every value unchanged.
+func IsIdentityLUT(lut []byte) bool {
+	for i, v := range lut {
+		if int(v) != i {
+			return false
+		}
+	}
+	return true
+}
+
+// ApplyLUT maps every channel of the input image through the 256 entries lookup table.
+func ApplyLUT(img gocv.Mat, lut []byte) gocv.Mat {
+	table, err := gocv.NewMatFromBytes(1, 256, gocv.MatTypeCV8UC1, lut)
+	if err != nil {
+		return img.Clone()
+	}
+	defer table.Close()
+
+	out := gocv.NewMat()
+	gocv.LUT(img, table, &out)
+
+	return out
+}
+
+// MatchBrightness offsets the image pixel values so that its mean brightness matches the target.
+func MatchBrightness(img gocv.Mat, target float32) gocv.Mat {
+	offset := target - ComputeMatMean(img)
+
+	out := gocv.NewMat()
+	img.ConvertToWithParams(&out, img.Type(), 1, offset)
+
+	return out
+}
+
+// Annotate draws the text at one of the image corners.
+func Annotate(img *gocv.Mat, text string, a Annotation) error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	scale := a.Scale
+	if scale <= 0 {
+		scale = 1
+	}
+	thickness := a.Thickness
+	if thickness <= 0 {
+		thickness = 1
+	}
+	c := color.RGBA{A: 255}
+	if len(a.Color) == 3 {
+		c.R, c.G, c.B = uint8(a.Color[0]), uint8(a.Color[1]), uint8(a.Color[2])
+	}
+
+	// PutText origin is the bottom-left corner of the text
+	const margin = 10
+	font := gocv.FontHersheySimplex
+	size := gocv.GetTextSize(text, font, scale, thickness)
+	var org image.Point
+	switch a.Position {
+	case "north-west":
+		org = image.Point{X: margin, Y: margin + size.Y}
+	case "north-east":
+		org = image.Point{X: img.Cols() - margin - size.X, Y: margin + size.Y}
+	case "south-west":
+		org = image.Point{X: margin, Y: img.Rows() - margin}
+	default: // south-east
+		org = image.Point{X: img.Cols() - margin - size.X, Y: img.Rows() - margin}
+	}
+
+	gocv.PutText(img, text, org, font, scale, c, thickness)
+	return nil
+}
+
+// Validate checks the annotation color and position.
+func (a Annotation) Validate() error {
+	if len(a.Color) != 0 {
+		if len(a.Color) != 3 {
+			return fmt.Errorf("invalid annotation color %v: expected [r, g, b]", a.Color)
+		}
+		for _, v := range a.Color {
+			if v < 0 || v > 255 {
+				return fmt.Errorf("invalid annotation color %v: values must be in the 0-255 range", a.Color)
+			}
+		}
+	}
+	switch a.Position {
+	case "north-west", "north-east", "south-west", "south-east", "":
+	default:
+		return fmt.Errorf("invalid annotation position %q, expected north-west, north-east, south-west or south-east", a.Position)
+	}
+	return nil
+}
+
+// Validate checks the sharpen settings, zero values selecting the defaults.
+func (s Sharpen) Validate() error {
+	if s.Amount < 0 || s.Radius < 0 || s.Clamp < 0 || s.Band < 0 {
+		return fmt.Errorf("invalid sharpen amount %g, radius %d, clamp %g or band %d, must not be negative", s.Amount, s.Radius, s.Clamp, s.Band)
+	}
+	return nil
+}
+
+// SharpenBand applies an unsharp mask to the image within a band around the mask.
+// The added high-frequency component is clamped to +/- clamp so that no pixel moves further than
+// clamp from its original value, which avoids ringing around high-contrast text edges.
+func SharpenBand(img, mask gocv.Mat, s Sharpen) gocv.Mat {
+	radius := s.Radius
+	if radius <= 0 {
+		radius = 1
+	}
+	clamp := float32(s.Clamp)
+	if clamp <= 0 {
+		clamp = 16
+	}
+	band := s.Band
+	if band <= 0 {
+		band = 8
+	}
+
+	// Compute the high-frequency component
+	blurred := gocv.NewMat()
+	defer blurred.Close()
+	ksize := 2*radius + 1
+	gocv.GaussianBlur(img, &blurred, image.Point{X: ksize, Y: ksize}, 0, 0, gocv.BorderDefault)
+
+	f := gocv.NewMat()
+	defer f.Close()
+	img.ConvertTo(&f, gocv.MatTypeCV32F)
+
+	fb := gocv.NewMat()
+	defer fb.Close()
+	blurred.ConvertTo(&fb, gocv.MatTypeCV32F)
+
+	detail := gocv.NewMat()
+	defer detail.Close()
+	gocv.Subtract(f, fb, &detail)
+	detail.MultiplyFloat(float32(s.Amount))
+
+	// Clamp the enhancement to [-clamp, clamp]
+	gocv.Threshold(detail, &detail, clamp, 0, gocv.ThresholdTrunc)
+	detail.MultiplyFloat(-1)
+	gocv.Threshold(detail, &detail, clamp, 0, gocv.ThresholdTrunc)
+	detail.MultiplyFloat(-1)
+
+	sum := gocv.NewMat()
+	defer sum.Close()
+	gocv.Add(f, detail, &sum)
+
+	sharpened := gocv.NewMat()
+	defer sharpened.Close()
+	sum.ConvertTo(&sharpened, img.Type())
+
+	// Restrict sharpening to a band around the mask
+	kernel := gocv.GetStructuringElement(gocv.MorphEllipse, image.Point{X: 2*band + 1, Y: 2*band + 1})
+	defer kernel.Close()
+	area := gocv.NewMat()
+	defer area.Close()
+	gocv.Dilate(mask, &area, kernel)
+
+	out := img.Clone()
+	sharpened.CopyToWithMask(&out, area)
+
+	return out
+}
+
+// AutoContrastClipPercent is the share of darkest and brightest pixels ignored by the auto contrast.
+const AutoContrastClipPercent = 1.0
+
+// ComputeAutoContrast computes the gain (alpha) and offset (beta) stretching the grayscale histogram
+// of the image to the full [0, 255] range, ignoring clipPercent of the pixels at each end.
+// Apply them with gocv.ConvertScaleAbs.
+func ComputeAutoContrast(img gocv.Mat, clipPercent float64) (float64, float64) {
+	gray := gocv.NewMat()
+	defer gray.Close()
+	if img.Channels() > 1 {
+		gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
+	} else {
+		img.CopyTo(&gray)
+	}
+
+	// Compute the histogram
+	var hist [256]int
+	data := gray.ToBytes()
+	for _, v := range data {
+		hist[v]++
+	}
+
+	// Find the clipped min and max gray levels
+	clip := int(float64(len(data)) * clipPercent / 100)
+	lo, acc := 0, 0
+	for ; lo < 255; lo++ {
+		acc += hist[lo]
+		if acc > clip {
+			break
+		}
+	}
+	hi := 255
+	acc = 0
+	for ; hi > 0; hi-- {
+		acc += hist[hi]
+		if acc > clip {
+			break
+		}
+	}
+
+	if hi <= lo {
+		return 1, 0
+	}
+
+	alpha := 255 / float64(hi-lo)
+	beta := -float64(lo) * alpha
+
+	return alpha, beta
+}
+
+// Cutout converts the image to BGRA, making the masked pixels fully transparent.
+func Cutout(img, mask gocv.Mat) gocv.Mat {
+	bgra := gocv.NewMat()
+	defer bgra.Close()
+	if img.Channels() == 1 {
+		gocv.CvtColor(img, &bgra, gocv.ColorGrayToBGRA)
+	} else {
+		gocv.CvtColor(img, &bgra, gocv.ColorBGRToBGRA)
+	}
+
+	channels := gocv.Split(bgra)
+	defer func() {
+		for _, c := range channels {
+			c.Close()
+		}
+	}()
+
+	// Alpha is 0 where the watermark was
+	gocv.BitwiseNot(mask, &channels[3])
+
+	out := gocv.NewMat()
+	gocv.Merge(channels, &out)
+
+	return out
+}
+
+// InvertColors inverts the colors of the input image.
+func InvertColors(img gocv.Mat) gocv.Mat {
+	invertedImg := gocv.NewMat()
+	gocv.BitwiseNot(img, &invertedImg)
+
+	return invertedImg
+}
+
+// ComputeMatMean calculates the mean (average) pixel value of an image represented as a gocv.Mat object,
+// averaging the means of every channel so that all of the B, G and R channels of color images are sampled.
+// This function can be useful for determining if an image is dark (eg. carbon copy)
+func ComputeMatMean(img gocv.Mat) float32 {
+	// Mean is computed in native code, one value per channel
+	mean := img.Mean()
+	values := []float64{mean.Val1, mean.Val2, mean.Val3, mean.Val4}
+
+	channels := img.Channels()
+	if channels < 1 || channels > len(values) {
+		channels = 1
+	}
+
+	sum := 0.0
+	for _, v := range values[:channels] {
+		sum += v
+	}
+
+	return float32(sum / float64(channels))
+}
+
+// RemoveColors converts the input image to grayscale, then converts it back to BGR (3 channels).
+func RemoveColors(img gocv.Mat) gocv.Mat {
+	// Convert to grayscale
+	gray := gocv.NewMat()
+	defer gray.Close()
+	gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
+
+	// Convert back to BGR (3 channels) while keeping it grayscale
+	bgr := gocv.NewMat()
+	gocv.CvtColor(gray, &bgr, gocv.ColorGrayToBGR)
+
+	return bgr // Return the 3-channel grayscale image
+}
+
+const (
+	// DefaultColorSaturationThreshold is the HSV saturation (0-255) from which pixels count as colored
+	DefaultColorSaturationThreshold = 32
+	// colorMinValue is the HSV value (0-255) below which pixels never count as colored, the saturation of
+	// near black pixels being noise
+	colorMinValue = 32
+	// colorMinHue is the HSV hue (0-179) below which pixels do not count as colored unless every hue is
+	// enabled, leaving the reds and oranges out
+	colorMinHue = 32
+)
+
+// IsColor checks if more than minFraction (0-1) of the image pixels are colored, their HSV saturation
+// reaching the saturation threshold and their hue reaching colorMinHue, or whatever their hue when allHues
+// is set. A zero minFraction makes a single colored pixel enough.
+func IsColor(img gocv.Mat, saturation int, minFraction float64, allHues bool) bool {
+	// Convert to HSV color space (preferred for color detection)
+	hsv := gocv.NewMat()
+	gocv.CvtColor(img, &hsv, gocv.ColorBGRToHSV)
+	defer hsv.Close()
+
+	// hue, saturation, value
+	minRange := gocv.Scalar{Val1: colorMinHue, Val2: float64(saturation), Val3: colorMinValue}
+	if allHues {
+		minRange.Val1 = 0
+	}
+	maxRange := gocv.Scalar{Val1: 255, Val2: 255, Val3: 255}
+
+	// Create a mask for the color
+	mask := gocv.NewMat()
+	gocv.InRangeWithScalar(hsv, minRange, maxRange, &mask)
+	defer mask.Close()
+
+	// Check if enough pixels match the color mask
+	return float64(gocv.CountNonZero(mask)) > minFraction*float64(img.Rows()*img.Cols())
+}
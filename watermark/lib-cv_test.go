@@ -0,0 +1,326 @@
+package watermark
+
+import (
+	"image"
+	"math"
+	"slices"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+func TestMergeRects(t *testing.T) {
+	bounds := image.Rect(0, 0, 100, 100)
+	tests := []struct {
+		name    string
+		rects   []image.Rectangle
+		padding int
+		want    []image.Rectangle
+	}{
+		{name: "none", want: nil},
+		{name: "empty skipped", rects: []image.Rectangle{{}}, want: nil},
+		{
+			name:    "padded and clipped",
+			rects:   []image.Rectangle{image.Rect(2, 90, 10, 98)},
+			padding: 5,
+			want:    []image.Rectangle{image.Rect(0, 85, 15, 100)},
+		},
+		{
+			name:  "disjoint kept",
+			rects: []image.Rectangle{image.Rect(0, 0, 10, 10), image.Rect(20, 20, 30, 30)},
+			want:  []image.Rectangle{image.Rect(0, 0, 10, 10), image.Rect(20, 20, 30, 30)},
+		},
+		{
+			name:    "merged by padding",
+			rects:   []image.Rectangle{image.Rect(10, 10, 20, 20), image.Rect(24, 10, 30, 20)},
+			padding: 3,
+			want:    []image.Rectangle{image.Rect(7, 7, 33, 23)},
+		},
+		{
+			name: "merged through a union",
+			rects: []image.Rectangle{
+				image.Rect(0, 0, 10, 10),
+				image.Rect(50, 0, 60, 10),
+				image.Rect(5, 5, 55, 8),
+			},
+			want: []image.Rectangle{image.Rect(0, 0, 60, 10)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MergeRects(tt.rects, tt.padding, bounds)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("MergeRects() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSharpenBand(t *testing.T) {
+	// A dark to light edge across the middle of the image, masked around its center
+	img := gocv.NewMatWithSize(100, 100, gocv.MatTypeCV8UC1)
+	defer img.Close()
+	img.SetTo(gocv.NewScalar(30, 0, 0, 0))
+	light := img.Region(image.Rect(50, 0, 100, 100))
+	light.SetTo(gocv.NewScalar(220, 0, 0, 0))
+	light.Close()
+
+	mask := gocv.NewMatWithSize(100, 100, gocv.MatTypeCV8UC1)
+	defer mask.Close()
+	masked := mask.Region(image.Rect(40, 40, 60, 60))
+	masked.SetTo(gocv.NewScalar(255, 0, 0, 0))
+	masked.Close()
+
+	tests := []struct {
+		name  string
+		s     Sharpen
+		clamp int
+		band  int
+	}{
+		{name: "defaults", s: Sharpen{Amount: 5}, clamp: 16, band: 8},
+		{name: "small clamp", s: Sharpen{Amount: 5, Radius: 2, Clamp: 4, Band: 4}, clamp: 4, band: 4},
+		{name: "large clamp", s: Sharpen{Amount: 2, Radius: 3, Clamp: 40, Band: 2}, clamp: 40, band: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := SharpenBand(img, mask, tt.s)
+			defer out.Close()
+
+			area := image.Rect(40-tt.band, 40-tt.band, 60+tt.band, 60+tt.band)
+			changed := 0
+			for y := 0; y < img.Rows(); y++ {
+				for x := 0; x < img.Cols(); x++ {
+					orig, got := int(img.GetUCharAt(y, x)), int(out.GetUCharAt(y, x))
+					if got < orig-tt.clamp || got > orig+tt.clamp {
+						t.Fatalf("pixel (%d, %d) = %d, want within %d of %d", x, y, got, tt.clamp, orig)
+					}
+					if got != orig {
+						changed++
+						if !image.Pt(x, y).In(area) {
+							t.Fatalf("pixel (%d, %d) changed outside the band", x, y)
+						}
+					}
+				}
+			}
+			if changed == 0 {
+				t.Error("SharpenBand() left the edge unchanged")
+			}
+		})
+	}
+}
+
+func TestRotateTemplate(t *testing.T) {
+	// A solid 40x20 bar, placed at the bottom right of a 200x100 image once rotated
+	tpl := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(255, 0, 0, 0), 20, 40, gocv.MatTypeCV8UC1)
+	defer tpl.Close()
+
+	tests := []struct {
+		name    string
+		degrees float64
+		size    image.Point
+		// corner is whether the top-left corner of the bounding rectangle belongs to the rotated bar
+		corner bool
+	}{
+		{name: "none", degrees: 0, size: image.Pt(40, 20), corner: true},
+		{name: "quarter turn", degrees: 90, size: image.Pt(20, 40), corner: true},
+		{name: "45 degrees", degrees: 45, size: image.Pt(43, 43)},
+		{name: "-45 degrees", degrees: -45, size: image.Pt(43, 43)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rotated := RotateTemplate(tpl, tt.degrees)
+			defer rotated.Close()
+			if got := image.Pt(rotated.Cols(), rotated.Rows()); got != tt.size {
+				t.Fatalf("RotateTemplate() size = %v, want %v", got, tt.size)
+			}
+
+			placed, err := PlaceTemplate(rotated, 200, 100, "south-east")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer placed.Close()
+
+			// The rotated bar sits in the bottom right corner, its bounding rectangle matching the canvas up to
+			// the pixel lost to the nearest neighbor sampling
+			got := MaskBoundingRect(placed)
+			want := image.Rect(200-tt.size.X, 100-tt.size.Y, 200, 100)
+			if abs(got.Min.X-want.Min.X) > 1 || abs(got.Min.Y-want.Min.Y) > 1 || abs(got.Max.X-want.Max.X) > 1 || abs(got.Max.Y-want.Max.Y) > 1 {
+				t.Errorf("placed bounding rect = %v, want %v", got, want)
+			}
+			center := got.Min.Add(got.Max).Div(2)
+			if placed.GetUCharAt(center.Y, center.X) == 0 {
+				t.Errorf("placed center %v is not masked", center)
+			}
+			if corner := placed.GetUCharAt(got.Min.Y, got.Min.X) != 0; corner != tt.corner {
+				t.Errorf("placed corner %v masked = %v, want %v", got.Min, corner, tt.corner)
+			}
+		})
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func BenchmarkComputeMatMean(b *testing.B) {
+	// A 4000x3000 scan, about a 12 MP page
+	img := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(40, 120, 200, 0), 3000, 4000, gocv.MatTypeCV8UC3)
+	defer img.Close()
+
+	b.Run("mean", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ComputeMatMean(img)
+		}
+	})
+
+	// The pixel loop ComputeMatMean replaced, for comparison
+	b.Run("pixel loop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			sum := float32(0)
+			for y := 0; y < img.Rows(); y++ {
+				for x := 0; x < img.Cols(); x++ {
+					sum += float32(img.GetUCharAt(y, x))
+				}
+			}
+			_ = sum / float32(img.Rows()*img.Cols())
+		}
+	})
+}
+
+func TestComputeMatMean(t *testing.T) {
+	// Blue on the left half and red on the right one, whose blue channel alone averages 127.5
+	split := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(255, 0, 0, 0), 60, 80, gocv.MatTypeCV8UC3)
+	defer split.Close()
+	red := split.Region(image.Rect(40, 0, 80, 60))
+	red.SetTo(gocv.NewScalar(0, 0, 255, 0))
+	red.Close()
+
+	solid := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(10, 100, 200, 0), 30, 40, gocv.MatTypeCV8UC3)
+	defer solid.Close()
+	gray := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(80, 0, 0, 0), 30, 40, gocv.MatTypeCV8UC1)
+	defer gray.Close()
+
+	tests := []struct {
+		name string
+		img  gocv.Mat
+		want float32
+	}{
+		{name: "blue and red halves", img: split, want: 85},
+		{name: "solid color", img: solid, want: 310.0 / 3},
+		{name: "grayscale", img: gray, want: 80},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ComputeMatMean(tt.img)
+			if math.Abs(float64(got-tt.want)) > 1e-3 {
+				t.Errorf("ComputeMatMean() = %g, want %g", got, tt.want)
+			}
+
+			// Every channel counts, as averaged from the gocv Mat mean
+			mean := tt.img.Mean()
+			channels := []float64{mean.Val1, mean.Val2, mean.Val3, mean.Val4}[:tt.img.Channels()]
+			sum := 0.0
+			for _, v := range channels {
+				sum += v
+			}
+			if want := sum / float64(len(channels)); math.Abs(float64(got)-want) > 1e-3 {
+				t.Errorf("ComputeMatMean() = %g, want the Mat.Mean channel average %g", got, want)
+			}
+		})
+	}
+}
+
+func TestIsColor(t *testing.T) {
+	tests := []struct {
+		name    string
+		bgr     gocv.Scalar
+		allHues bool
+		want    bool
+	}{
+		{name: "gray", bgr: gocv.NewScalar(128, 128, 128, 0)},
+		{name: "blue", bgr: gocv.NewScalar(200, 40, 40, 0), want: true},
+		{name: "green", bgr: gocv.NewScalar(40, 200, 40, 0), want: true},
+		{name: "red below the hue floor", bgr: gocv.NewScalar(40, 40, 200, 0)},
+		{name: "red with every hue", bgr: gocv.NewScalar(40, 40, 200, 0), allHues: true, want: true},
+		{name: "near black", bgr: gocv.NewScalar(20, 0, 0, 0), allHues: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := gocv.NewMatWithSizeFromScalar(tt.bgr, 10, 10, gocv.MatTypeCV8UC3)
+			defer img.Close()
+			if got := IsColor(img, DefaultColorSaturationThreshold, 0, tt.allHues); got != tt.want {
+				t.Errorf("IsColor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSideBySide(t *testing.T) {
+	before := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(200, 100, 50, 0), 50, 100, gocv.MatTypeCV8UC3)
+	defer before.Close()
+	same := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(90, 0, 0, 0), 50, 100, gocv.MatTypeCV8UC1)
+	defer same.Close()
+	smaller := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(90, 0, 0, 0), 25, 50, gocv.MatTypeCV8UC1)
+	defer smaller.Close()
+
+	tests := []struct {
+		name  string
+		after gocv.Mat
+	}{
+		{name: "same size", after: same},
+		{name: "resized", after: smaller},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := SideBySide(before, tt.after)
+			defer out.Close()
+			if out.Rows() != 50 || out.Cols() != 200+CompareSeparatorWidth || out.Channels() != 3 {
+				t.Fatalf("SideBySide() = %dx%d with %d channels, want %dx50 with 3", out.Cols(), out.Rows(), out.Channels(), 200+CompareSeparatorWidth)
+			}
+			if got := out.GetVecbAt(25, 150+CompareSeparatorWidth); got[0] != 90 || got[1] != 90 || got[2] != 90 {
+				t.Errorf("SideBySide() right pixel = %v, want [90 90 90]", got)
+			}
+		})
+	}
+}
+
+func TestConvertTo8Bit(t *testing.T) {
+	// A 16-bit scan using part of the range, 2560 with a 12800 band
+	newScan := func() gocv.Mat {
+		img := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(2560, 0, 0, 0), 20, 20, gocv.MatTypeCV16UC1)
+		band := img.Region(image.Rect(0, 10, 20, 20))
+		band.SetTo(gocv.NewScalar(12800, 0, 0, 0))
+		band.Close()
+		return img
+	}
+
+	tests := []struct {
+		name      string
+		stretch   bool
+		wantLow   float32
+		wantHigh  float32
+		wantDark  uint8
+		wantLight uint8
+	}{
+		{name: "fixed scale", wantLow: 0, wantHigh: 65535, wantDark: 10, wantLight: 50},
+		{name: "stretched", stretch: true, wantLow: 2560, wantHigh: 12800, wantDark: 0, wantLight: 255},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, low, high := ConvertTo8Bit(newScan(), tt.stretch)
+			defer out.Close()
+			if out.Type() != gocv.MatTypeCV8UC1 {
+				t.Fatalf("ConvertTo8Bit() type = %v, want CV8UC1", out.Type())
+			}
+			if low != tt.wantLow || high != tt.wantHigh {
+				t.Errorf("ConvertTo8Bit() range = %g-%g, want %g-%g", low, high, tt.wantLow, tt.wantHigh)
+			}
+			if dark, light := out.GetUCharAt(0, 0), out.GetUCharAt(15, 0); dark != tt.wantDark || light != tt.wantLight {
+				t.Errorf("ConvertTo8Bit() = %d and %d, want %d and %d", dark, light, tt.wantDark, tt.wantLight)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package watermark
+
+import (
+	"fmt"
+	"image"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	// GravityAuto locates the watermark in the image by template matching rather than by gravity
+	GravityAuto = "auto"
+	// GravityFeatures locates the watermark in the image by feature matching, following its rotation and scale
+	GravityFeatures = "features"
+	// DefaultMinMatchScore is the match score below which a watermark is not considered located
+	DefaultMinMatchScore = 0.5
+	// DefaultMinInliers is the number of consistent feature matches below which a watermark is not considered located
+	DefaultMinInliers = 12
+	// MaskNotLocated is the skip reason of masks whose watermark could not be located
+	MaskNotLocated = "notLocated"
+)
+
+// ConfidenceSignals are the detection signals used to decide whether a watermark is present.
+type ConfidenceSignals struct {
+	// MatchScore is the normalized correlation between the template and the image, in [-1, 1]
+	MatchScore float32 `json:"matchScore"`
+	// Coverage is the fraction of the image covered by the mask, in [0, 1]
+	Coverage float64 `json:"coverage"`
+	// Contrast is the absolute mean intensity difference between pixels inside and outside the mask
+	Contrast float32 `json:"contrast"`
+}
+
+// Enabled reports whether any confidence signal threshold is set.
+func (c Confidence) Enabled() bool {
+	return c.MinMatchScore != 0 || c.MinCoverage != 0 || c.MaxCoverage != 0 || c.MinContrast != 0
+}
+
+// Validate checks the signal thresholds are within the ranges of their signals.
+func (c Confidence) Validate() error {
+	if c.MinMatchScore < -1 || c.MinMatchScore > 1 {
+		return fmt.Errorf("invalid confidence minMatchScore %g, expected -1 to 1", c.MinMatchScore)
+	}
+	if c.MinCoverage < 0 || c.MinCoverage > 1 || c.MaxCoverage < 0 || c.MaxCoverage > 1 {
+		return fmt.Errorf("invalid confidence minCoverage %g or maxCoverage %g, expected 0 to 1", c.MinCoverage, c.MaxCoverage)
+	}
+	if c.MaxCoverage != 0 && c.MinCoverage > c.MaxCoverage {
+		return fmt.Errorf("invalid confidence minCoverage %g, above maxCoverage %g", c.MinCoverage, c.MaxCoverage)
+	}
+	if c.MinContrast < 0 || c.MinContrast > 255 {
+		return fmt.Errorf("invalid confidence minContrast %g, expected 0 to 255", c.MinContrast)
+	}
+	return nil
+}
+
+// Check reports whether every enabled signal passes its threshold, and the failing signal otherwise.
+func (c Confidence) Check(s ConfidenceSignals) (bool, string) {
+	switch {
+	case c.MinMatchScore != 0 && s.MatchScore < c.MinMatchScore:
+		return false, "matchScore"
+	case c.MinCoverage != 0 && s.Coverage < c.MinCoverage:
+		return false, "minCoverage"
+	case c.MaxCoverage != 0 && s.Coverage > c.MaxCoverage:
+		return false, "maxCoverage"
+	case c.MinContrast != 0 && s.Contrast < c.MinContrast:
+		return false, "contrast"
+	}
+	return true, ""
+}
+
+// ComputeConfidenceSignals measures how strongly the image supports the presence of the watermark
+// described by the template crop and the resulting mask.
+func ComputeConfidenceSignals(img, crop, mask gocv.Mat) ConfidenceSignals {
+	gray := gocv.NewMat()
+	defer gray.Close()
+	if img.Channels() > 1 {
+		gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
+	} else {
+		img.CopyTo(&gray)
+	}
+
+	var signals ConfidenceSignals
+
+	// Watermark pixels are darker than the paper, correlate the template with the inverted image
+	if crop.Rows() <= gray.Rows() && crop.Cols() <= gray.Cols() {
+		inv := gocv.NewMat()
+		defer inv.Close()
+		gocv.BitwiseNot(gray, &inv)
+
+		res := gocv.NewMat()
+		defer res.Close()
+		none := gocv.NewMat()
+		defer none.Close()
+		gocv.MatchTemplate(inv, crop, &res, gocv.TmCcoeffNormed, none)
+		_, signals.MatchScore, _, _ = gocv.MinMaxLoc(res)
+	}
+
+	// Fraction of the image covered by the mask
+	nonZero := gocv.CountNonZero(mask)
+	signals.Coverage = float64(nonZero) / float64(mask.Rows()*mask.Cols())
+
+	// Intensity contrast between the watermark and the rest of the image
+	if nonZero > 0 && nonZero < mask.Rows()*mask.Cols() {
+		outside := gocv.NewMat()
+		defer outside.Close()
+		gocv.BitwiseNot(mask, &outside)
+
+		in := gray.MeanWithMask(mask).Val1
+		out := gray.MeanWithMask(outside).Val1
+		contrast := in - out
+		if contrast < 0 {
+			contrast = -contrast
+		}
+		signals.Contrast = float32(contrast)
+	}
+
+	return signals
+}
+
+// LocateByTemplate finds where the watermark template best matches the image. The template is first
+// cropped to the bounding rectangle of its non-zero pixels. It returns the rectangle the cropped
+// template covers in the image along with the match score.
+func LocateByTemplate(img, tpl gocv.Mat) (image.Rectangle, float32) {
+	bounds := MaskBoundingRect(tpl)
+	if bounds.Empty() || bounds.Dx() > img.Cols() || bounds.Dy() > img.Rows() {
+		return image.Rectangle{}, 0
+	}
+	crop := tpl.Region(bounds)
+	defer crop.Close()
+
+	gray := gocv.NewMat()
+	defer gray.Close()
+	if img.Channels() > 1 {
+		gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
+	} else {
+		img.CopyTo(&gray)
+	}
+
+	// Watermark pixels are darker than the paper, correlate the template with the inverted image
+	inv := gocv.NewMat()
+	defer inv.Close()
+	gocv.BitwiseNot(gray, &inv)
+
+	res := gocv.NewMat()
+	defer res.Close()
+	none := gocv.NewMat()
+	defer none.Close()
+	gocv.MatchTemplate(inv, crop, &res, gocv.TmCcoeffNormed, none)
+	_, score, _, loc := gocv.MinMaxLoc(res)
+
+	return image.Rect(loc.X, loc.Y, loc.X+bounds.Dx(), loc.Y+bounds.Dy()), score
+}
@@ -0,0 +1,309 @@
+package watermark
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ExifTagNames maps the EXIF tags this tool understands to their names.
+var ExifTagNames = map[uint16]string{
+	0x010E: "ImageDescription",
+	0x010F: "Make",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013B: "Artist",
+	0x8298: "Copyright",
+	0x9003: "DateTimeOriginal",
+	0x9004: "DateTimeDigitized",
+}
+
+const (
+	exifHeader       = "Exif\x00\x00"
+	exifIFDPointer   = 0x8769
+	exifOrientation  = 0x0112
+	exifTypeASCII    = 2
+	exifTypeShort    = 3
+	exifTypeLong     = 4
+	jpegMarkerSOI    = 0xD8
+	jpegMarkerAPP0   = 0xE0
+	jpegMarkerAPP1   = 0xE1
+	jpegMarkerSOS    = 0xDA
+	jpegMarkerPrefix = 0xFF
+)
+
+// ReadExifSegment returns the raw EXIF APP1 segment payload (starting with "Exif\0\0") of a JPEG file.
+// It returns a nil slice and no error when the file is not a JPEG or has no EXIF block.
+func ReadExifSegment(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	// Check JPEG start of image
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil || soi[0] != jpegMarkerPrefix || soi[1] != jpegMarkerSOI {
+		return nil, nil
+	}
+
+	// Walk the segments until the EXIF block or the start of the image data
+	for {
+		marker := make([]byte, 4)
+		if _, err := io.ReadFull(r, marker); err != nil {
+			return nil, nil
+		}
+		if marker[0] != jpegMarkerPrefix || marker[1] == jpegMarkerSOS {
+			return nil, nil
+		}
+
+		size := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if size < 0 {
+			return nil, errors.New("invalid JPEG segment size")
+		}
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+
+		if marker[1] == jpegMarkerAPP1 && bytes.HasPrefix(payload, []byte(exifHeader)) {
+			return payload, nil
+		}
+	}
+}
+
+// ParseExif extracts the known tags (see ExifTagNames) of an EXIF APP1 segment payload.
+// ASCII values are returned trimmed, numeric values as decimal strings.
+func ParseExif(segment []byte) (map[string]string, error) {
+	tags := map[string]string{}
+	if !bytes.HasPrefix(segment, []byte(exifHeader)) {
+		return tags, errors.New("missing EXIF header")
+	}
+
+	tiff := segment[len(exifHeader):]
+	order, err := tiffByteOrder(tiff)
+	if err != nil {
+		return tags, err
+	}
+
+	// Read IFD0, then the EXIF sub-IFD if present
+	exifOffset, err := parseIFD(tiff, order, int(order.Uint32(tiff[4:])), tags)
+	if err != nil {
+		return tags, err
+	}
+	if exifOffset > 0 {
+		if _, err := parseIFD(tiff, order, exifOffset, tags); err != nil {
+			return tags, err
+		}
+	}
+
+	return tags, nil
+}
+
+// tiffByteOrder returns the byte order of the TIFF header.
+func tiffByteOrder(tiff []byte) (binary.ByteOrder, error) {
+	if len(tiff) < 8 {
+		return nil, errors.New("truncated TIFF header")
+	}
+
+	switch string(tiff[:2]) {
+	case "II":
+		return binary.LittleEndian, nil
+	case "MM":
+		return binary.BigEndian, nil
+	default:
+		return nil, errors.New("invalid TIFF byte order")
+	}
+}
+
+// parseIFD reads the known tags of the IFD at offset into tags and returns the EXIF sub-IFD offset if any.
+func parseIFD(tiff []byte, order binary.ByteOrder, offset int, tags map[string]string) (int, error) {
+	if offset < 0 || offset+2 > len(tiff) {
+		return 0, errors.New("IFD offset out of range")
+	}
+
+	exifOffset := 0
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return exifOffset, errors.New("truncated IFD entry")
+		}
+
+		tag := order.Uint16(tiff[entry:])
+		typ := order.Uint16(tiff[entry+2:])
+		n := int(order.Uint32(tiff[entry+4:]))
+		value := tiff[entry+8 : entry+12]
+
+		if tag == exifIFDPointer {
+			exifOffset = int(order.Uint32(value))
+			continue
+		}
+
+		name, ok := ExifTagNames[tag]
+		if !ok {
+			continue
+		}
+
+		switch typ {
+		case exifTypeASCII:
+			// Values longer than 4 bytes are stored at an offset
+			var data []byte
+			if n > 4 {
+				start := int(order.Uint32(value))
+				if start < 0 || start+n > len(tiff) {
+					continue
+				}
+				data = tiff[start : start+n]
+			} else {
+				data = value[:n]
+			}
+			tags[name] = strings.TrimSpace(strings.TrimRight(string(data), "\x00"))
+		case exifTypeShort:
+			tags[name] = strconv.Itoa(int(order.Uint16(value)))
+		case exifTypeLong:
+			tags[name] = strconv.Itoa(int(order.Uint32(value)))
+		}
+	}
+
+	return exifOffset, nil
+}
+
+// ReadExifTags reads the known EXIF tags of a JPEG file.
+// It returns an empty map when the file has no EXIF block.
+func ReadExifTags(path string) (map[string]string, error) {
+	segment, err := ReadExifSegment(path)
+	if err != nil || segment == nil {
+		return map[string]string{}, err
+	}
+
+	return ParseExif(segment)
+}
+
+// ReadExifOrientation returns the EXIF orientation of a JPEG file, 1 (top left) when it has none.
+func ReadExifOrientation(path string) (int, error) {
+	tags, err := ReadExifTags(path)
+	if err != nil {
+		return 1, err
+	}
+	orientation, err := strconv.Atoi(tags["Orientation"])
+	if err != nil {
+		return 1, nil
+	}
+	return orientation, nil
+}
+
+// ResetExifOrientation returns a copy of the EXIF APP1 segment payload with the IFD0 orientation set to 1 (top left),
+// for images whose pixels were already rotated upright when read.
+func ResetExifOrientation(segment []byte) []byte {
+	out := append([]byte(nil), segment...)
+	if !bytes.HasPrefix(out, []byte(exifHeader)) {
+		return out
+	}
+
+	tiff := out[len(exifHeader):]
+	order, err := tiffByteOrder(tiff)
+	if err != nil {
+		return out
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 0 || offset+2 > len(tiff) {
+		return out
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientation && order.Uint16(tiff[entry+2:]) == exifTypeShort {
+			order.PutUint16(tiff[entry+8:], 1)
+		}
+	}
+
+	return out
+}
+
+// InsertExifSegment returns the JPEG data with the EXIF APP1 segment payload inserted right after its start
+// of image or its JFIF APP0 segment.
+func InsertExifSegment(data, segment []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != jpegMarkerPrefix || data[1] != jpegMarkerSOI {
+		return nil, errors.New("not a JPEG file")
+	}
+	if len(segment)+2 > 0xFFFF {
+		return nil, errors.New("EXIF segment too large")
+	}
+
+	// JFIF requires its APP0 segment to immediately follow the start of image
+	pos := 2
+	if len(data) >= 6 && data[2] == jpegMarkerPrefix && data[3] == jpegMarkerAPP0 {
+		if end := 4 + int(binary.BigEndian.Uint16(data[4:])); end <= len(data) {
+			pos = end
+		}
+	}
+
+	size := make([]byte, 2)
+	binary.BigEndian.PutUint16(size, uint16(len(segment)+2))
+
+	out := make([]byte, 0, len(data)+len(segment)+4)
+	out = append(out, data[:pos]...)
+	out = append(out, jpegMarkerPrefix, jpegMarkerAPP1)
+	out = append(out, size...)
+	out = append(out, segment...)
+	out = append(out, data[pos:]...)
+
+	return out, nil
+}
+
+// ExifFilter is a repeatable key=value flag matching files on their EXIF tags.
+type ExifFilter map[string]string
+
+func (f ExifFilter) String() string {
+	pairs := make([]string, 0, len(f))
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set parses a key=value pair.
+func (f ExifFilter) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("invalid EXIF filter %q, expected key=value", s)
+	}
+	f[k] = v
+	return nil
+}
+
+// Match reports whether the file EXIF tags match every filter pair, and the reason when they do not.
+func (f ExifFilter) Match(path string) (bool, string) {
+	tags, err := ReadExifTags(path)
+	if err != nil {
+		return false, "unreadable EXIF: " + err.Error()
+	}
+
+	for k, v := range f {
+		got, ok := tags[k]
+		if !ok {
+			return false, "missing EXIF " + k
+		}
+		if got != v {
+			return false, fmt.Sprintf("EXIF %s is %q, expected %q", k, got, v)
+		}
+	}
+
+	return true, ""
+}
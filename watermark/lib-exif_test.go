@@ -0,0 +1,204 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testExifSegment builds a little-endian EXIF APP1 segment payload whose IFD0 holds the orientation,
+// the make, stored at an offset being longer than 4 bytes, and a model short enough to be stored inline.
+func testExifSegment(orientation uint16, manufacturer, model string) []byte {
+	const entries = 3
+	ifd := 8
+	data := ifd + 2 + entries*12 + 4
+
+	tiff := make([]byte, data, data+len(manufacturer)+1)
+	copy(tiff, "II")
+	binary.LittleEndian.PutUint16(tiff[2:], 42)
+	binary.LittleEndian.PutUint32(tiff[4:], uint32(ifd))
+	binary.LittleEndian.PutUint16(tiff[ifd:], entries)
+
+	entry := func(i int, tag, typ uint16, n uint32) []byte {
+		e := tiff[ifd+2+i*12:]
+		binary.LittleEndian.PutUint16(e, tag)
+		binary.LittleEndian.PutUint16(e[2:], typ)
+		binary.LittleEndian.PutUint32(e[4:], n)
+		return e[8:12]
+	}
+	binary.LittleEndian.PutUint16(entry(0, exifOrientation, exifTypeShort, 1), orientation)
+	binary.LittleEndian.PutUint32(entry(1, 0x010F, exifTypeASCII, uint32(len(manufacturer)+1)), uint32(data))
+	copy(entry(2, 0x0110, exifTypeASCII, uint32(len(model))), model)
+	tiff = append(tiff, manufacturer...)
+	tiff = append(tiff, 0)
+
+	return append([]byte(exifHeader), tiff...)
+}
+
+// testJPEG builds the head of a JPEG file, with a JFIF APP0 segment and the EXIF segment when not nil,
+// up to its start of scan.
+func testJPEG(exif []byte) []byte {
+	data := []byte{jpegMarkerPrefix, jpegMarkerSOI}
+	segment := func(marker byte, payload []byte) {
+		size := make([]byte, 2)
+		binary.BigEndian.PutUint16(size, uint16(len(payload)+2))
+		data = append(data, jpegMarkerPrefix, marker)
+		data = append(data, size...)
+		data = append(data, payload...)
+	}
+	segment(jpegMarkerAPP0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))
+	if exif != nil {
+		segment(jpegMarkerAPP1, exif)
+	}
+	segment(jpegMarkerSOS, []byte{0x01})
+	return append(data, 0x00, 0x3F, 0x00, jpegMarkerPrefix, 0xD9)
+}
+
+func TestReadExifSegment(t *testing.T) {
+	exif := testExifSegment(6, "Scanner Inc", "S1")
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{"exif", testJPEG(exif), exif},
+		{"no exif", testJPEG(nil), nil},
+		{"not a jpeg", []byte("\x89PNG\r\n\x1a\n"), nil},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "scan.jpg")
+			if err := os.WriteFile(path, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadExifSegment(path)
+			if err != nil {
+				t.Fatalf("ReadExifSegment() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("ReadExifSegment() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExif(t *testing.T) {
+	tests := []struct {
+		name    string
+		segment []byte
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "tags",
+			segment: testExifSegment(6, "Scanner Inc", "S1"),
+			want:    map[string]string{"Orientation": "6", "Make": "Scanner Inc", "Model": "S1"},
+		},
+		{name: "missing header", segment: []byte("Exif"), wantErr: true},
+		{name: "truncated header", segment: []byte(exifHeader + "II*"), wantErr: true},
+		{name: "invalid byte order", segment: []byte(exifHeader + "XX*\x00\x08\x00\x00\x00"), wantErr: true},
+		{name: "IFD out of range", segment: []byte(exifHeader + "II*\x00\xff\x00\x00\x00"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseExif(tt.segment)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseExif() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("ParseExif() = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("ParseExif()[%q] = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestInsertExifSegment(t *testing.T) {
+	exif := testExifSegment(1, "Scanner Inc", "S1")
+	// Without its JFIF APP0 segment, the EXIF segment follows the start of image
+	bare := append([]byte{jpegMarkerPrefix, jpegMarkerSOI}, testJPEG(nil)[20:]...)
+	app1 := append([]byte{jpegMarkerPrefix, jpegMarkerAPP1, 0, byte(len(exif) + 2)}, exif...)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		segment []byte
+		want    []byte
+		wantErr bool
+	}{
+		{name: "after APP0", data: testJPEG(nil), segment: exif, want: testJPEG(exif)},
+		{name: "after SOI", data: bare, segment: exif, want: append(append(bare[:2:2], app1...), bare[2:]...)},
+		{name: "not a jpeg", data: []byte("\x89PNG\r\n\x1a\n"), segment: exif, wantErr: true},
+		{name: "segment too large", data: testJPEG(nil), segment: make([]byte, 0xFFFF), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := InsertExifSegment(tt.data, tt.segment)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InsertExifSegment() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("InsertExifSegment() = %q, want %q", got, tt.want)
+			}
+			if !tt.wantErr {
+				path := filepath.Join(t.TempDir(), "out.jpg")
+				if err := os.WriteFile(path, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if read, err := ReadExifSegment(path); err != nil || !bytes.Equal(read, tt.segment) {
+					t.Errorf("ReadExifSegment() = %q, %v, want the inserted segment", read, err)
+				}
+			}
+		})
+	}
+}
+
+func TestResetExifOrientation(t *testing.T) {
+	tests := []struct {
+		name    string
+		segment []byte
+		// want is the expected orientation, malformed segments being returned unchanged when empty
+		want string
+	}{
+		{name: "rotated", segment: testExifSegment(6, "Scanner Inc", "S1"), want: "1"},
+		{name: "mirrored", segment: testExifSegment(8, "Scanner Inc", "S1"), want: "1"},
+		{name: "upright", segment: testExifSegment(1, "Scanner Inc", "S1"), want: "1"},
+		{name: "empty"},
+		{name: "missing header", segment: []byte("Exif")},
+		{name: "invalid byte order", segment: []byte(exifHeader + "XX*\x00\x08\x00\x00\x00")},
+		{name: "IFD out of range", segment: []byte(exifHeader + "II*\x00\xff\x00\x00\x00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := bytes.Clone(tt.segment)
+			got := ResetExifOrientation(tt.segment)
+			if !bytes.Equal(tt.segment, original) {
+				t.Error("ResetExifOrientation() modified its input")
+			}
+			if tt.want == "" {
+				if !bytes.Equal(got, tt.segment) {
+					t.Errorf("ResetExifOrientation() = %q, want it unchanged", got)
+				}
+				return
+			}
+
+			tags, err := ParseExif(got)
+			if err != nil {
+				t.Fatalf("ParseExif() error = %v", err)
+			}
+			if tags["Orientation"] != tt.want || tags["Make"] != "Scanner Inc" || tags["Model"] != "S1" {
+				t.Errorf("ResetExifOrientation() tags = %v, want orientation %s", tags, tt.want)
+			}
+		})
+	}
+}
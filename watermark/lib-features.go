@@ -0,0 +1,97 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	// featureCount is the maximum number of ORB features detected in the template and the image
+	featureCount = 2000
+	// featureRatio is the Lowe ratio test threshold, dropping matches barely better than the second best one
+	featureRatio = 0.75
+	// featureReprojError is the distance in pixels within which a match agrees with the homography
+	featureReprojError = 3
+	// featureMaxScale bounds the scale of the located watermark relative to its template, both ways
+	featureMaxScale = 8
+)
+
+// LocateByFeatures finds the watermark template in the image by matching ORB features, which unlike
+// LocateByTemplate follows a rotated, scaled or slightly skewed watermark. Features are matched against
+// the inverted grayscale image, watermark pixels being darker than the paper, and the homography mapping
+// the template onto the image is fitted to the matches by RANSAC. It returns the homography along with
+// the number of matches agreeing with it, or an empty Mat when no plausible homography is found.
+func LocateByFeatures(img, tpl gocv.Mat) (gocv.Mat, int) {
+	gray := gocv.NewMat()
+	defer gray.Close()
+	if img.Channels() > 1 {
+		gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
+	} else {
+		img.CopyTo(&gray)
+	}
+	gocv.BitwiseNot(gray, &gray)
+
+	orb := gocv.NewORBWithParams(featureCount, 1.2, 8, 31, 0, 2, gocv.ORBScoreTypeHarris, 31, 20)
+	defer orb.Close()
+	none := gocv.NewMat()
+	defer none.Close()
+	tplPoints, tplDesc := orb.DetectAndCompute(tpl, none)
+	defer tplDesc.Close()
+	imgPoints, imgDesc := orb.DetectAndCompute(gray, none)
+	defer imgDesc.Close()
+	if tplDesc.Rows() < 4 || imgDesc.Rows() < 2 {
+		return gocv.NewMat(), 0
+	}
+
+	// Keep the distinctive matches only
+	matcher := gocv.NewBFMatcherWithParams(gocv.NormHamming, false)
+	defer matcher.Close()
+	var good []gocv.DMatch
+	for _, m := range matcher.KnnMatch(tplDesc, imgDesc, 2) {
+		if len(m) == 2 && m[0].Distance < featureRatio*m[1].Distance {
+			good = append(good, m[0])
+		}
+	}
+	if len(good) < 4 {
+		return gocv.NewMat(), len(good)
+	}
+
+	src := gocv.NewMatWithSize(len(good), 2, gocv.MatTypeCV32F)
+	defer src.Close()
+	dst := gocv.NewMatWithSize(len(good), 2, gocv.MatTypeCV32F)
+	defer dst.Close()
+	for i, m := range good {
+		from, to := tplPoints[m.QueryIdx], imgPoints[m.TrainIdx]
+		src.SetFloatAt(i, 0, float32(from.X))
+		src.SetFloatAt(i, 1, float32(from.Y))
+		dst.SetFloatAt(i, 0, float32(to.X))
+		dst.SetFloatAt(i, 1, float32(to.Y))
+	}
+
+	inliers := gocv.NewMat()
+	defer inliers.Close()
+	h := gocv.FindHomography(src, &dst, gocv.HomograpyMethodRANSAC, featureReprojError, &inliers, 2000, 0.995)
+	if h.Empty() {
+		return h, 0
+	}
+	n := gocv.CountNonZero(inliers)
+
+	// Reject mirrored or implausibly scaled placements, RANSAC fitting noise
+	det := h.GetDoubleAt(0, 0)*h.GetDoubleAt(1, 1) - h.GetDoubleAt(0, 1)*h.GetDoubleAt(1, 0)
+	if det <= 0 || math.Sqrt(det) > featureMaxScale || math.Sqrt(det) < 1.0/featureMaxScale {
+		h.Close()
+		return gocv.NewMat(), n
+	}
+	return h, n
+}
+
+// WarpTemplate places the template in an image of the given size through the homography found by LocateByFeatures.
+func WarpTemplate(tpl, h gocv.Mat, width, height int) gocv.Mat {
+	out := gocv.NewMat()
+	gocv.WarpPerspectiveWithParams(tpl, &out, h, image.Point{X: width, Y: height},
+		gocv.InterpolationNearestNeighbor, gocv.BorderConstant, color.RGBA{})
+	return out
+}
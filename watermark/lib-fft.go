@@ -0,0 +1,123 @@
+package watermark
+
+import (
+	"image"
+	"image/color"
+
+	"gocv.io/x/gocv"
+)
+
+// RemovePeriodicPattern removes a watermark tiled across the whole image in the frequency domain. A repeating
+// pattern concentrates its energy in isolated peaks of the spectrum, which are detected as the frequencies
+// whose log magnitude stands out from their neighborhood, and notched out before transforming back. The low
+// frequencies within MinRadius of the spectrum center, carrying the page layout, are never notched.
+// Color images are filtered channel by channel. It returns the filtered image and the number of peaks notched.
+func RemovePeriodicPattern(img gocv.Mat, o FFTOptions) (gocv.Mat, int) {
+	minRadius := o.MinRadius
+	if minRadius <= 0 {
+		minRadius = 8
+	}
+	notchRadius := o.NotchRadius
+	if notchRadius <= 0 {
+		notchRadius = 3
+	}
+	threshold := float32(o.PeakThreshold)
+	if threshold <= 0 {
+		threshold = 2
+	}
+
+	channels := gocv.Split(img)
+	defer func() {
+		for _, c := range channels {
+			c.Close()
+		}
+	}()
+
+	// Transform every channel, the notch filter being computed from the spectrum of the first one
+	spectra := make([]gocv.Mat, len(channels))
+	for i, c := range channels {
+		f := gocv.NewMat()
+		c.ConvertTo(&f, gocv.MatTypeCV32F)
+		spectra[i] = gocv.NewMat()
+		gocv.DFT(f, &spectra[i], gocv.DftComplexOutput)
+		f.Close()
+	}
+	defer func() {
+		for _, s := range spectra {
+			s.Close()
+		}
+	}()
+
+	keep, peaks := notchFilter(spectra[0], minRadius, notchRadius, threshold)
+	defer keep.Close()
+
+	// Notch the peaks out and transform back
+	filtered := make([]gocv.Mat, len(channels))
+	for i, s := range spectra {
+		notched := gocv.NewMat()
+		gocv.Multiply(s, keep, &notched)
+		f := gocv.NewMat()
+		gocv.DFT(notched, &f, gocv.DftInverse|gocv.DftScale|gocv.DftRealOutput)
+		notched.Close()
+		filtered[i] = gocv.NewMat()
+		f.ConvertTo(&filtered[i], gocv.MatTypeCV8U)
+		f.Close()
+	}
+
+	out := gocv.NewMat()
+	gocv.Merge(filtered, &out)
+	for _, f := range filtered {
+		f.Close()
+	}
+
+	return out, peaks
+}
+
+// notchFilter returns the two channel multiplier of the complex spectrum zeroing its periodic peaks,
+// smoothed to limit ringing, and the number of peaks found.
+func notchFilter(spectrum gocv.Mat, minRadius, notchRadius int, threshold float32) (gocv.Mat, int) {
+	// Log magnitude of the spectrum
+	parts := gocv.Split(spectrum)
+	mag := gocv.NewMat()
+	defer mag.Close()
+	gocv.Magnitude(parts[0], parts[1], &mag)
+	parts[0].Close()
+	parts[1].Close()
+	mag.AddFloat(1)
+	gocv.Log(mag, &mag)
+
+	// Peaks stand out from the mean of their neighborhood
+	local := gocv.NewMat()
+	defer local.Close()
+	ksize := 4*notchRadius + 1
+	gocv.Blur(mag, &local, image.Point{X: ksize, Y: ksize})
+	gocv.Subtract(mag, local, &local)
+	gocv.Threshold(local, &local, threshold, 255, gocv.ThresholdBinary)
+	peaks := gocv.NewMat()
+	defer peaks.Close()
+	local.ConvertTo(&peaks, gocv.MatTypeCV8U)
+
+	// Protect the low frequencies, found at the corners of the unshifted spectrum
+	w, h := peaks.Cols(), peaks.Rows()
+	for _, corner := range []image.Point{{0, 0}, {w, 0}, {0, h}, {w, h}} {
+		gocv.Circle(&peaks, corner, minRadius, color.RGBA{}, -1)
+	}
+
+	labels := gocv.NewMat()
+	n := gocv.ConnectedComponents(peaks, &labels) - 1
+	labels.Close()
+
+	// Grow the peaks into notches, and soften their edges
+	kernel := gocv.GetStructuringElement(gocv.MorphEllipse, image.Point{X: 2*notchRadius + 1, Y: 2*notchRadius + 1})
+	defer kernel.Close()
+	gocv.Dilate(peaks, &peaks, kernel)
+	notch := gocv.NewMat()
+	defer notch.Close()
+	peaks.ConvertToWithParams(&notch, gocv.MatTypeCV32F, -1.0/255, 1)
+	gocv.GaussianBlur(notch, &notch, image.Point{X: 3, Y: 3}, 0, 0, gocv.BorderDefault)
+
+	keep := gocv.NewMat()
+	gocv.Merge([]gocv.Mat{notch, notch}, &keep)
+
+	return keep, n
+}
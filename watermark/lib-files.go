@@ -0,0 +1,76 @@
+package watermark
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ImageExtensions are the file extensions processed in directory mode.
+var ImageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".webp": true,
+	".tif":  true,
+	".tiff": true,
+	".bmp":  true,
+}
+
+// IsImageFile reports whether the path has a supported image extension.
+func IsImageFile(path string) bool {
+	return ImageExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// CollectImages walks root recursively and returns the image files and PDF documents found at most maxDepth
+// directories below it. A maxDepth of 0 only lists root itself, a negative maxDepth is unbounded.
+func CollectImages(root string, maxDepth int) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		depth := 0
+		if rel != "." {
+			depth = strings.Count(rel, string(filepath.Separator)) + 1
+		}
+
+		if d.IsDir() {
+			if maxDepth >= 0 && depth > maxDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !IsImageFile(path) && !IsPDFFile(path) {
+			log.Debug().Str("file", path).Msg("not an image, skipped")
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+
+	return files, err
+}
+
+// IsGlobPattern reports whether the path holds glob pattern characters, see filepath.Match.
+func IsGlobPattern(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// GlobRoot returns the deepest directory of the glob pattern without pattern characters,
+// the root the matched files are mirrored from.
+func GlobRoot(pattern string) string {
+	dir := filepath.Dir(pattern)
+	for IsGlobPattern(dir) {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
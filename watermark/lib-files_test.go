@@ -0,0 +1,53 @@
+package watermark
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCollectImages(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.jpg", "notes.txt", "doc.PDF", "sub/b.PNG", "sub/deep/c.tif", "sub/deep/d"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		root     string
+		maxDepth int
+		want     []string
+		wantErr  bool
+	}{
+		{name: "root only", root: root, maxDepth: 0, want: []string{"a.jpg", "doc.PDF"}},
+		{name: "one level", root: root, maxDepth: 1, want: []string{"a.jpg", "doc.PDF", "sub/b.PNG"}},
+		{name: "unbounded", root: root, maxDepth: -1, want: []string{"a.jpg", "doc.PDF", "sub/b.PNG", "sub/deep/c.tif"}},
+		{name: "missing root", root: filepath.Join(root, "missing"), maxDepth: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := CollectImages(tt.root, tt.maxDepth)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CollectImages() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got := make([]string, len(files))
+			for i, f := range files {
+				rel, err := filepath.Rel(root, f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[i] = filepath.ToSlash(rel)
+			}
+			if !tt.wantErr && !slices.Equal(got, tt.want) {
+				t.Errorf("CollectImages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package watermark
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+
+	"gocv.io/x/gocv"
+)
+
+// Filter is an image filter applied by name with its parameters, as listed in config.
+type Filter struct {
+	Name   string       `yaml:"name"`
+	Params FilterParams `yaml:"params"`
+}
+
+// FilterParams are the numeric parameters of a filter.
+type FilterParams map[string]float64
+
+// Get returns the parameter value, or def when the parameter is not set.
+func (fp FilterParams) Get(key string, def float64) float64 {
+	if v, ok := fp[key]; ok {
+		return v
+	}
+	return def
+}
+
+// FilterFunc returns the filtered copy of the image.
+type FilterFunc func(img gocv.Mat, params FilterParams) gocv.Mat
+
+// Filters is the registry of the filters accepted in config filter lists.
+var Filters = map[string]FilterFunc{
+	// blur applies a Gaussian blur of ksize (default 3)
+	"blur": func(img gocv.Mat, params FilterParams) gocv.Mat {
+		return BlurImage(img, oddKernel(params.Get("ksize", 3)))
+	},
+	// median applies a median blur of ksize (default 3), removing salt and pepper noise
+	"median": func(img gocv.Mat, params FilterParams) gocv.Mat {
+		out := gocv.NewMat()
+		gocv.MedianBlur(img, &out, oddKernel(params.Get("ksize", 3)))
+		return out
+	},
+	// bilateral smooths while keeping edges, see diameter (default 9), sigmaColor and sigmaSpace (default 75)
+	"bilateral": func(img gocv.Mat, params FilterParams) gocv.Mat {
+		out := gocv.NewMat()
+		gocv.BilateralFilter(img, &out, int(params.Get("diameter", 9)), params.Get("sigmaColor", 75), params.Get("sigmaSpace", 75))
+		return out
+	},
+	// denoise applies non-local means denoising of strength h (default 3)
+	"denoise": func(img gocv.Mat, params FilterParams) gocv.Mat {
+		out := gocv.NewMat()
+		h := float32(params.Get("h", 3))
+		if img.Channels() > 1 {
+			gocv.FastNlMeansDenoisingColoredWithParams(img, &out, h, h, 7, 21)
+		} else {
+			gocv.FastNlMeansDenoisingWithParams(img, &out, h, 7, 21)
+		}
+		return out
+	},
+	// sharpen applies an unsharp mask of amount (default 1) and Gaussian ksize (default 3)
+	"sharpen": func(img gocv.Mat, params FilterParams) gocv.Mat {
+		amount := params.Get("amount", 1)
+		blurred := BlurImage(img, oddKernel(params.Get("ksize", 3)))
+		defer blurred.Close()
+		out := gocv.NewMat()
+		gocv.AddWeighted(img, 1+amount, blurred, -amount, 0, &out)
+		return out
+	},
+	// gamma applies a gamma correction of value (default 1), values < 1 brighten midtones
+	"gamma": func(img gocv.Mat, params FilterParams) gocv.Mat {
+		return ApplyLUT(img, LevelsLUT(0, 255, params.Get("value", 1)))
+	},
+	// levels stretches the black (default 0) and white (default 255) input levels with gamma (default 1)
+	"levels": func(img gocv.Mat, params FilterParams) gocv.Mat {
+		return ApplyLUT(img, LevelsLUT(int(params.Get("black", 0)), int(params.Get("white", 255)), params.Get("gamma", 1)))
+	},
+	// clahe equalizes the local contrast of the luminance, see clipLimit (default 2) and tileSize (default 8)
+	"clahe": func(img gocv.Mat, params FilterParams) gocv.Mat {
+		tile := int(params.Get("tileSize", 8))
+		clahe := gocv.NewCLAHEWithParams(params.Get("clipLimit", 2), image.Point{X: tile, Y: tile})
+		defer clahe.Close()
+		return applyToLuminance(img, clahe.Apply)
+	},
+	// equalize equalizes the histogram of the luminance
+	"equalize": func(img gocv.Mat, params FilterParams) gocv.Mat {
+		return applyToLuminance(img, gocv.EqualizeHist)
+	},
+	// normalize stretches the pixel values to the min (default 0) and max (default 255) range
+	"normalize": func(img gocv.Mat, params FilterParams) gocv.Mat {
+		out := gocv.NewMat()
+		gocv.Normalize(img, &out, params.Get("min", 0), params.Get("max", 255), gocv.NormMinMax)
+		return out
+	},
+}
+
+// applyToLuminance applies the single channel operation to grayscale images, or to the lightness of color images.
+func applyToLuminance(img gocv.Mat, apply func(src gocv.Mat, dst *gocv.Mat)) gocv.Mat {
+	out := gocv.NewMat()
+	if img.Channels() == 1 {
+		apply(img, &out)
+		return out
+	}
+
+	lab := gocv.NewMat()
+	defer lab.Close()
+	gocv.CvtColor(img, &lab, gocv.ColorBGRToLab)
+	channels := gocv.Split(lab)
+	for _, c := range channels {
+		defer c.Close()
+	}
+
+	l := gocv.NewMat()
+	defer l.Close()
+	apply(channels[0], &l)
+	l.CopyTo(&channels[0])
+	gocv.Merge(channels, &lab)
+	gocv.CvtColor(lab, &out, gocv.ColorLabToBGR)
+
+	return out
+}
+
+// oddKernel rounds the kernel size up to the nearest odd size of at least 1.
+func oddKernel(v float64) int {
+	k := int(v)
+	if k < 1 {
+		return 1
+	}
+	if k%2 == 0 {
+		k++
+	}
+	return k
+}
+
+// FilterNames returns the sorted names of the registered filters.
+func FilterNames() []string {
+	names := make([]string, 0, len(Filters))
+	for name := range Filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// filterChecks validate the parameters of the registered filters taking any, rejecting the values the
+// filters would fail or panic on.
+var filterChecks = map[string]func(params FilterParams) error{
+	"blur":   checkKernel,
+	"median": checkKernel,
+	"denoise": func(params FilterParams) error {
+		if h := params.Get("h", 3); h < 0 {
+			return fmt.Errorf("invalid h %g, must not be negative", h)
+		}
+		return nil
+	},
+	"sharpen": func(params FilterParams) error {
+		if amount := params.Get("amount", 1); amount < 0 {
+			return fmt.Errorf("invalid amount %g, must not be negative", amount)
+		}
+		return checkKernel(params)
+	},
+	"gamma": func(params FilterParams) error {
+		if v := params.Get("value", 1); v <= 0 {
+			return fmt.Errorf("invalid value %g, must be positive", v)
+		}
+		return nil
+	},
+	"levels": func(params FilterParams) error {
+		black, white := params.Get("black", 0), params.Get("white", 255)
+		if black < 0 || white > 255 || black >= white {
+			return fmt.Errorf("invalid black %g and white %g, expected 0 <= black < white <= 255", black, white)
+		}
+		if g := params.Get("gamma", 1); g <= 0 {
+			return fmt.Errorf("invalid gamma %g, must be positive", g)
+		}
+		return nil
+	},
+	"clahe": func(params FilterParams) error {
+		if limit := params.Get("clipLimit", 2); limit <= 0 {
+			return fmt.Errorf("invalid clipLimit %g, must be positive", limit)
+		}
+		if tile := params.Get("tileSize", 8); tile < 1 {
+			return fmt.Errorf("invalid tileSize %g, must be at least 1", tile)
+		}
+		return nil
+	},
+	"normalize": func(params FilterParams) error {
+		lo, hi := params.Get("min", 0), params.Get("max", 255)
+		if lo < 0 || hi > 255 || lo >= hi {
+			return fmt.Errorf("invalid min %g and max %g, expected 0 <= min < max <= 255", lo, hi)
+		}
+		return nil
+	},
+}
+
+// checkKernel checks the ksize parameter of the blurring filters.
+func checkKernel(params FilterParams) error {
+	if k := params.Get("ksize", 3); k < 1 {
+		return fmt.Errorf("invalid ksize %g, must be at least 1", k)
+	}
+	return nil
+}
+
+// ValidateFilters checks that every filter of the list is registered and that its parameters are valid.
+func ValidateFilters(filters []Filter) error {
+	for i, f := range filters {
+		if _, ok := Filters[f.Name]; !ok {
+			return fmt.Errorf("filter %d: unknown filter %q, expected one of %s", i, f.Name, strings.Join(FilterNames(), ", "))
+		}
+		if check, ok := filterChecks[f.Name]; ok {
+			if err := check(f.Params); err != nil {
+				return fmt.Errorf("filter %d: %s: %w", i, f.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyFilters returns a copy of the image with the filters applied in order.
+func ApplyFilters(img gocv.Mat, filters []Filter) gocv.Mat {
+	out := img.Clone()
+	for _, f := range filters {
+		filtered := Filters[f.Name](out, f.Params)
+		out.Close()
+		out = filtered
+	}
+	return out
+}
+
+// FiltersString describes the filter list for logging, eg. "denoise(h=5) > sharpen".
+func FiltersString(filters []Filter) string {
+	parts := make([]string, 0, len(filters))
+	for _, f := range filters {
+		keys := make([]string, 0, len(f.Params))
+		for k := range f.Params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		params := make([]string, 0, len(keys))
+		for _, k := range keys {
+			params = append(params, fmt.Sprintf("%s=%g", k, f.Params[k]))
+		}
+		if len(params) > 0 {
+			parts = append(parts, f.Name+"("+strings.Join(params, ",")+")")
+		} else {
+			parts = append(parts, f.Name)
+		}
+	}
+	return strings.Join(parts, " > ")
+}
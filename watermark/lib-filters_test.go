@@ -0,0 +1,42 @@
+package watermark
+
+import "testing"
+
+func TestValidateFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []Filter
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "defaults", filters: []Filter{{Name: "blur"}, {Name: "sharpen"}, {Name: "levels"}, {Name: "clahe"}, {Name: "normalize"}}},
+		{name: "valid params", filters: []Filter{
+			{Name: "median", Params: FilterParams{"ksize": 5}},
+			{Name: "denoise", Params: FilterParams{"h": 0}},
+			{Name: "gamma", Params: FilterParams{"value": 0.8}},
+			{Name: "levels", Params: FilterParams{"black": 10, "white": 240, "gamma": 1.2}},
+		}},
+		{name: "unknown", filters: []Filter{{Name: "emboss"}}, wantErr: true},
+		{name: "blur ksize", filters: []Filter{{Name: "blur", Params: FilterParams{"ksize": 0}}}, wantErr: true},
+		{name: "median ksize", filters: []Filter{{Name: "median", Params: FilterParams{"ksize": -3}}}, wantErr: true},
+		{name: "denoise h", filters: []Filter{{Name: "denoise", Params: FilterParams{"h": -1}}}, wantErr: true},
+		{name: "sharpen amount", filters: []Filter{{Name: "sharpen", Params: FilterParams{"amount": -0.5}}}, wantErr: true},
+		{name: "sharpen ksize", filters: []Filter{{Name: "sharpen", Params: FilterParams{"ksize": 0}}}, wantErr: true},
+		{name: "gamma value", filters: []Filter{{Name: "gamma", Params: FilterParams{"value": 0}}}, wantErr: true},
+		{name: "levels reversed", filters: []Filter{{Name: "levels", Params: FilterParams{"black": 200, "white": 100}}}, wantErr: true},
+		{name: "levels white", filters: []Filter{{Name: "levels", Params: FilterParams{"white": 300}}}, wantErr: true},
+		{name: "levels gamma", filters: []Filter{{Name: "levels", Params: FilterParams{"gamma": -1}}}, wantErr: true},
+		{name: "clahe clipLimit", filters: []Filter{{Name: "clahe", Params: FilterParams{"clipLimit": 0}}}, wantErr: true},
+		{name: "clahe tileSize", filters: []Filter{{Name: "clahe", Params: FilterParams{"tileSize": 0}}}, wantErr: true},
+		{name: "normalize equal", filters: []Filter{{Name: "normalize", Params: FilterParams{"min": 128, "max": 128}}}, wantErr: true},
+		{name: "normalize min", filters: []Filter{{Name: "normalize", Params: FilterParams{"min": -1}}}, wantErr: true},
+		{name: "second filter", filters: []Filter{{Name: "blur"}, {Name: "gamma", Params: FilterParams{"value": -1}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateFilters(tt.filters); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateFilters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
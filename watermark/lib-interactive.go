@@ -0,0 +1,134 @@
+package watermark
+
+import (
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/rs/zerolog/log"
+	"gocv.io/x/gocv"
+)
+
+// Interactive mode keys
+const (
+	keyAdd     = 'a'
+	keyErase   = 'e'
+	keyPreview = 'p'
+	keySave    = 's'
+	keyQuit    = 'q'
+	keyEscape  = 27
+)
+
+// HasDisplay reports whether windows can be opened, false in headless runs.
+func HasDisplay() bool {
+	if runtime.GOOS != "linux" {
+		return true
+	}
+	return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+}
+
+// Interactive lets the user correct the mask computed for the source image and saves it to maskPath,
+// as an image sized template usable with the north-west gravity. GoCV does not expose mouse callbacks,
+// so regions are drawn as rectangles:
+//
+//	a  add rectangles to the mask (select with the mouse, space or enter confirms each, esc ends)
+//	e  erase rectangles from the mask
+//	p  preview the inpainting of the current mask, also refreshed after every edit
+//	s  save the mask and quit
+//	q  quit without saving
+func (p *Pipeline) Interactive(srcPath, maskPath string) error {
+	p = p.forFile(srcPath)
+	var res Result
+	src, err := p.readSource(srcPath, &res)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Start from the mask computed by the configuration
+	base := filepath.Base(srcPath)
+	b, m, s := ComputeImageChannelMetrics(src)
+	_, inverted := p.carbonCopy(b, base)
+	full := image.Rect(0, 0, src.Cols(), src.Rows())
+	img, thresh, _ := p.prepareRegion(src, full, m, s, inverted)
+	defer img.Close()
+	placed, err := p.placeMasks(src, inverted, base)
+	if err != nil {
+		return err
+	}
+	for _, pm := range placed {
+		defer pm.Close()
+	}
+	mask, err := p.computeMask(img, placed, full, thresh, base)
+	if err != nil {
+		return err
+	}
+	defer mask.Close()
+
+	window := gocv.NewWindow("interactive: a add, e erase, p preview, s save, q quit")
+	defer window.Close()
+	preview := gocv.NewWindow("preview")
+	defer preview.Close()
+
+	for {
+		overlay := MaskOverlay(src, mask)
+		window.IMShow(overlay)
+		key := window.WaitKey(0)
+
+		switch key {
+		case keyAdd, keyErase:
+			value := gocv.Scalar{Val1: 255}
+			if key == keyErase {
+				value = gocv.Scalar{}
+			}
+			for _, rect := range window.SelectROIs(overlay) {
+				region := mask.Region(rect.Intersect(full))
+				region.SetTo(value)
+				region.Close()
+			}
+			p.previewInpaint(preview, img, mask)
+		case keyPreview:
+			p.previewInpaint(preview, img, mask)
+		case keySave:
+			overlay.Close()
+			if ok := gocv.IMWrite(maskPath, mask); !ok {
+				return errors.New("error writing mask to disk")
+			}
+			log.Info().Str("mask", maskPath).Msg(base + ": interactive mask saved")
+			return nil
+		case keyQuit, keyEscape:
+			overlay.Close()
+			log.Info().Msg(base + ": interactive mask discarded")
+			return nil
+		}
+		overlay.Close()
+	}
+}
+
+// previewInpaint shows the inpainting of the image with the mask in the window.
+func (p *Pipeline) previewInpaint(window *gocv.Window, img, mask gocv.Mat) {
+	out := p.inpaint(img, mask, nil)
+	defer out.Close()
+	window.IMShow(out)
+}
+
+// MaskOverlay returns the color image with the mask highlighted in red.
+func MaskOverlay(img, mask gocv.Mat) gocv.Mat {
+	overlay := img.Clone()
+	if overlay.Channels() == 1 {
+		gocv.CvtColor(img, &overlay, gocv.ColorGrayToBGR)
+	}
+
+	red := gocv.NewMatWithSize(overlay.Rows(), overlay.Cols(), overlay.Type())
+	defer red.Close()
+	red.SetTo(gocv.Scalar{Val1: 0, Val2: 0, Val3: 255, Val4: 255})
+
+	highlighted := overlay.Clone()
+	defer highlighted.Close()
+	red.CopyToWithMask(&highlighted, mask)
+
+	gocv.AddWeighted(overlay, 0.5, highlighted, 0.5, 0, &overlay)
+	return overlay
+}
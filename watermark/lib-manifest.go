@@ -0,0 +1,122 @@
+package watermark
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Manifest is a provenance record of a run, listing every output with its checksum. It is not signed:
+// its own checksum detects accidental corruption, while anyone editing it can recompute the checksum.
+type Manifest struct {
+	Version string    `json:"version"`
+	Created time.Time `json:"created"`
+	// ConfigSHA256 is the checksum of the fully-resolved config the outputs were produced with
+	ConfigSHA256 string         `json:"configSha256"`
+	Files        []ManifestFile `json:"files"`
+	// SHA256 is the checksum of the manifest serialized with this field empty, an integrity check rather than a signature
+	SHA256 string `json:"sha256"`
+}
+
+// ManifestFile records the checksums of a source image and of an output written from it.
+type ManifestFile struct {
+	Src       string `json:"src"`
+	SrcSHA256 string `json:"srcSha256"`
+	Dst       string `json:"dst"`
+	DstSHA256 string `json:"dstSha256"`
+}
+
+// NewManifest starts the manifest of a run using the config.
+func NewManifest(cfg Config, now time.Time) (*Manifest, error) {
+	body, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+
+	return &Manifest{
+		Version:      Version,
+		Created:      now.UTC(),
+		ConfigSHA256: hex.EncodeToString(sum[:]),
+		Files:        []ManifestFile{},
+	}, nil
+}
+
+// Add records every output of the result. Failed, skipped and unwritten results are ignored, and results
+// read from stdin or written to stdout are an error, their bytes being gone.
+func (m *Manifest) Add(res Result) error {
+	if res.Error != "" || res.Skipped != "" || res.Dst == "" {
+		return nil
+	}
+	if res.Src == StdioPath {
+		return errors.New("manifest: stdin source cannot be checksummed")
+	}
+
+	srcSum, err := FileSHA256(res.Src)
+	if err != nil {
+		return err
+	}
+	for _, dst := range SplitDst(res.Dst) {
+		if dst == StdioPath {
+			return errors.New("manifest: stdout output cannot be checksummed")
+		}
+		dstSum, err := FileSHA256(dst)
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, ManifestFile{Src: res.Src, SrcSHA256: srcSum, Dst: dst, DstSHA256: dstSum})
+	}
+	return nil
+}
+
+// Write sets the checksum of the manifest and writes it as JSON to path.
+func (m *Manifest) Write(path string) error {
+	m.SHA256 = ""
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	m.SHA256 = hex.EncodeToString(sum[:])
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// WriteManifest writes the manifest of the run results to path.
+func WriteManifest(path string, cfg Config, now time.Time, results []Result) error {
+	m, err := NewManifest(cfg, now)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		if err := m.Add(res); err != nil {
+			return err
+		}
+	}
+	return m.Write(path)
+}
+
+// FileSHA256 returns the hex encoded sha256 of the file content.
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,98 @@
+package watermark
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteManifest(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	src := file("scan.jpg", "source")
+	out := file("out.jpg", "output")
+	png := file("out.png", "png output")
+	sum := func(content string) string {
+		s := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(s[:])
+	}
+
+	tests := []struct {
+		name    string
+		results []Result
+		want    []ManifestFile
+		wantErr bool
+	}{
+		{name: "no results", want: []ManifestFile{}},
+		{
+			name:    "every output",
+			results: []Result{{Src: src, Dst: out + "," + png}},
+			want: []ManifestFile{
+				{Src: src, SrcSHA256: sum("source"), Dst: out, DstSHA256: sum("output")},
+				{Src: src, SrcSHA256: sum("source"), Dst: png, DstSHA256: sum("png output")},
+			},
+		},
+		{
+			name: "failed, skipped and unwritten ignored",
+			results: []Result{
+				{Src: src, Dst: out, Error: "failed"},
+				{Src: src, Dst: out, Skipped: "exists"},
+				{Src: src},
+			},
+			want: []ManifestFile{},
+		},
+		{name: "stdin source", results: []Result{{Src: StdioPath, Dst: out}}, wantErr: true},
+		{name: "stdout output", results: []Result{{Src: src, Dst: StdioPath}}, wantErr: true},
+		{name: "missing output", results: []Result{{Src: src, Dst: filepath.Join(dir, "missing.jpg")}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "manifest.json")
+			err := WriteManifest(path, DefaultConfig(), time.Unix(0, 0), tt.results)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WriteManifest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m Manifest
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatal(err)
+			}
+			if len(m.Files) != len(tt.want) {
+				t.Fatalf("WriteManifest() files = %v, want %v", m.Files, tt.want)
+			}
+			for i, f := range m.Files {
+				if f != tt.want[i] {
+					t.Errorf("WriteManifest() file %d = %v, want %v", i, f, tt.want[i])
+				}
+			}
+
+			// The checksum covers the manifest serialized with it empty
+			got := m.SHA256
+			m.SHA256 = ""
+			body, err := json.Marshal(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := sum(string(body)); got != want {
+				t.Errorf("WriteManifest() sha256 = %s, want %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package watermark
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Metrics are the image metrics of a processed image, appended as a JSON line to the -metrics-out file
+// for the analysis of batch runs, eg. spotting documents with anomalous thresholds.
+type Metrics struct {
+	Src        string  `json:"src"`
+	Page       int     `json:"page,omitempty"`
+	Dst        string  `json:"dst"`
+	DurationMs int64   `json:"durationMs"`
+	Brightness float32 `json:"brightness"`
+	Mean       float32 `json:"mean"`
+	StdDev     float32 `json:"stdDev"`
+	Threshold  float32 `json:"threshold"`
+	Color      bool    `json:"color"`
+}
+
+// AppendMetrics appends the metrics of every processed result to path, one JSON object per line, and
+// of every page of multi-page documents. Failed and skipped results are ignored.
+func AppendMetrics(path string, results []Result) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	for _, res := range results {
+		if err := encodeMetrics(enc, res); err != nil {
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+// encodeMetrics encodes the metrics of the result, or of its pages for a multi-page document.
+func encodeMetrics(enc *json.Encoder, res Result) error {
+	if res.Error != "" || res.Skipped != "" {
+		return nil
+	}
+	if len(res.Pages) > 0 {
+		for _, page := range res.Pages {
+			if err := encodeMetrics(enc, page); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return enc.Encode(Metrics{
+		Src:        res.Src,
+		Page:       res.Page,
+		Dst:        res.Dst,
+		DurationMs: res.DurationMs,
+		Brightness: res.Brightness,
+		Mean:       res.Mean,
+		StdDev:     res.StdDev,
+		Threshold:  res.Threshold,
+		Color:      res.Color,
+	})
+}
@@ -0,0 +1,74 @@
+package watermark
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestAppendMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []Result
+		want    []Metrics
+	}{
+		{name: "none"},
+		{
+			name:    "processed",
+			results: []Result{{Src: "a.jpg", Dst: "out/a.jpg", Threshold: 120, Color: true}},
+			want:    []Metrics{{Src: "a.jpg", Dst: "out/a.jpg", Threshold: 120, Color: true}},
+		},
+		{
+			name: "failed and skipped ignored",
+			results: []Result{
+				{Src: "a.jpg", Error: "failed"},
+				{Src: "b.jpg", Skipped: "exists"},
+				{Src: "c.jpg", Dst: "out/c.jpg"},
+			},
+			want: []Metrics{{Src: "c.jpg", Dst: "out/c.jpg"}},
+		},
+		{
+			name: "pages",
+			results: []Result{{Src: "doc.tif", Pages: []Result{
+				{Src: "doc.tif", Page: 1, Dst: "out/doc-1.tif", Threshold: 100},
+				{Src: "doc.tif", Page: 2, Skipped: "not located"},
+				{Src: "doc.tif", Page: 3, Dst: "out/doc-3.tif", Threshold: 110},
+			}}},
+			want: []Metrics{
+				{Src: "doc.tif", Page: 1, Dst: "out/doc-1.tif", Threshold: 100},
+				{Src: "doc.tif", Page: 3, Dst: "out/doc-3.tif", Threshold: 110},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "metrics.jsonl")
+			// Successive runs append to the file
+			for i := 0; i < 2; i++ {
+				if err := AppendMetrics(path, tt.results); err != nil {
+					t.Fatalf("AppendMetrics() error = %v", err)
+				}
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var got []Metrics
+			for scanner := bufio.NewScanner(f); scanner.Scan(); {
+				var m Metrics
+				if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, m)
+			}
+			if want := append(slices.Clone(tt.want), tt.want...); !slices.Equal(got, want) {
+				t.Errorf("AppendMetrics() = %v, want %v", got, want)
+			}
+		})
+	}
+}
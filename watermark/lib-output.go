@@ -0,0 +1,295 @@
+package watermark
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gocv.io/x/gocv"
+)
+
+const (
+	// HashPlaceholder is replaced by the truncated sha256 of the output bytes as written, EXIF included, in -dst-pattern
+	HashPlaceholder = "{hash}"
+	// NamePlaceholder is replaced by the source file name without extension in -dst-pattern
+	NamePlaceholder = "{name}"
+
+	// StdioPath reads the source from stdin as a source path and writes the output to stdout as a destination path
+	StdioPath = "-"
+
+	// hashLength is the number of hex characters of the sha256 kept in output names
+	hashLength = 16
+
+	// unsafeFilenameChars are rejected in output file names
+	unsafeFilenameChars = `/\:*?"<>|`
+)
+
+// alphaExtensions are the output formats supporting an alpha channel
+var alphaExtensions = map[string]bool{
+	".png":  true,
+	".webp": true,
+	".tif":  true,
+	".tiff": true,
+}
+
+// imwriteJpegSamplingFactor is OpenCV's IMWRITE_JPEG_SAMPLING_FACTOR, not exposed by GoCV
+const imwriteJpegSamplingFactor = 7
+
+// JpegSamplingFactors maps the chroma subsampling values accepted in config to OpenCV sampling factors.
+// OpenCV defaults to 4:2:0.
+var JpegSamplingFactors = map[string]int{
+	"444": 0x111111,
+	"422": 0x211111,
+	"420": 0x221111,
+	"411": 0x411111,
+}
+
+// ValidateChromaSubsampling checks the chroma subsampling is supported, empty keeping the OpenCV default.
+func ValidateChromaSubsampling(s string) error {
+	if _, ok := JpegSamplingFactors[s]; s != "" && !ok {
+		return fmt.Errorf("invalid chroma subsampling %q: expected 444, 422, 420 or 411", s)
+	}
+	return nil
+}
+
+// EncodeOptions controls the output encoding parameters. Levels of -1 keep the OpenCV defaults.
+type EncodeOptions struct {
+	// JpegQuality is the JPEG quality from 0 to 100, OpenCV defaults to 95
+	JpegQuality int
+	// PngCompression is the PNG compression level from 0 to 9, OpenCV defaults to 1
+	PngCompression int
+	// ChromaSubsampling of JPEG outputs, see JpegSamplingFactors
+	ChromaSubsampling string
+}
+
+// Validate checks the encoding parameters are within the ranges supported by OpenCV, or -1.
+func (o EncodeOptions) Validate() error {
+	if o.JpegQuality < -1 || o.JpegQuality > 100 {
+		return fmt.Errorf("invalid jpeg quality %d: expected 0 to 100, or -1 for the default", o.JpegQuality)
+	}
+	if o.PngCompression < -1 || o.PngCompression > 9 {
+		return fmt.Errorf("invalid png compression %d: expected 0 to 9, or -1 for the default", o.PngCompression)
+	}
+	return ValidateChromaSubsampling(o.ChromaSubsampling)
+}
+
+// WriteParams returns the encoding parameters of the output format of the extension (eg. ".jpg").
+func WriteParams(ext string, opts EncodeOptions) []int {
+	var params []int
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg":
+		if opts.JpegQuality >= 0 {
+			params = append(params, gocv.IMWriteJpegQuality, opts.JpegQuality)
+		}
+		if factor, ok := JpegSamplingFactors[opts.ChromaSubsampling]; ok {
+			params = append(params, imwriteJpegSamplingFactor, factor)
+		}
+	case ".png":
+		if opts.PngCompression >= 0 {
+			params = append(params, gocv.IMWritePngCompression, opts.PngCompression)
+		}
+	}
+	return params
+}
+
+// SupportsAlpha reports whether the output format of path supports an alpha channel.
+func SupportsAlpha(path string) bool {
+	return alphaExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// SplitDst splits a comma separated list of destination paths, each written with the format of its extension.
+func SplitDst(dst string) []string {
+	var paths []string
+	for _, path := range strings.Split(dst, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// ValidateDstPaths checks that every destination path, stdout aside, has a supported image extension and is only listed once.
+func ValidateDstPaths(paths []string) error {
+	seen := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		if path != StdioPath && !IsImageFile(path) {
+			return fmt.Errorf("dst %q: unsupported output extension %q", path, filepath.Ext(path))
+		}
+		if seen[path] {
+			return fmt.Errorf("dst %q: listed more than once", path)
+		}
+		seen[path] = true
+	}
+	return nil
+}
+
+// ParseSize parses a WIDTHxHEIGHT size such as 320x240, both sides being positive.
+func ParseSize(s string) (image.Point, error) {
+	w, h, ok := strings.Cut(strings.ToLower(s), "x")
+	width, werr := strconv.Atoi(w)
+	height, herr := strconv.Atoi(h)
+	if !ok || werr != nil || herr != nil || width <= 0 || height <= 0 {
+		return image.Point{}, fmt.Errorf("invalid size %q, expected WIDTHxHEIGHT (eg. 320x240)", s)
+	}
+	return image.Point{X: width, Y: height}, nil
+}
+
+// ThumbnailPath returns the path of the thumbnail written alongside dst, suffixed with -thumb (eg. out-thumb.jpg).
+func ThumbnailPath(dst string) string {
+	ext := filepath.Ext(dst)
+	return strings.TrimSuffix(dst, ext) + "-thumb" + ext
+}
+
+// EncodeImage encodes the image in memory using the format matching the file extension (eg. ".png")
+// and the optional encoding parameters.
+func EncodeImage(ext string, img gocv.Mat, params []int) ([]byte, error) {
+	var buf *gocv.NativeByteBuffer
+	var err error
+	if len(params) > 0 {
+		buf, err = gocv.IMEncodeWithParams(gocv.FileExt(ext), img, params)
+	} else {
+		buf, err = gocv.IMEncode(gocv.FileExt(ext), img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Close()
+
+	if buf.Len() == 0 {
+		return nil, fmt.Errorf("error encoding image as %s", ext)
+	}
+
+	// Copy the native buffer before it gets released
+	data := make([]byte, buf.Len())
+	copy(data, buf.GetBytes())
+
+	return data, nil
+}
+
+// DetectImageFormat returns the file extension (eg. ".png") of the image format of the encoded data,
+// identified by its signature, or an empty string when unknown.
+func DetectImageFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return ".jpg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return ".png"
+	case len(data) >= 12 && bytes.Equal(data[:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return ".webp"
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return ".tif"
+	case bytes.HasPrefix(data, []byte("BM")):
+		return ".bmp"
+	}
+	return ""
+}
+
+// ValidateDstPattern checks that the destination pattern yields unique and filesystem-safe names.
+func ValidateDstPattern(pattern string) error {
+	name := filepath.Base(pattern)
+	if !strings.Contains(name, HashPlaceholder) {
+		return fmt.Errorf("dst pattern %q: file name must contain %s to be unique", pattern, HashPlaceholder)
+	}
+	if filepath.Ext(name) == "" {
+		return fmt.Errorf("dst pattern %q: file name must have an extension", pattern)
+	}
+	if !IsImageFile(name) {
+		return fmt.Errorf("dst pattern %q: unsupported output extension %q", pattern, filepath.Ext(name))
+	}
+
+	literal := strings.NewReplacer(HashPlaceholder, "", NamePlaceholder, "").Replace(name)
+	return validateFilename(literal)
+}
+
+// ResolveDstPattern computes the destination path for the encoded output of src.
+func ResolveDstPattern(pattern, src string, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])[:hashLength]
+
+	name := strings.TrimSuffix(filepath.Base(src), filepath.Ext(src))
+	path := strings.NewReplacer(HashPlaceholder, hash, NamePlaceholder, name).Replace(pattern)
+
+	if err := validateFilename(filepath.Base(path)); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// validateFilename rejects names containing path separators, reserved or control characters.
+func validateFilename(name string) error {
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(unsafeFilenameChars, r) {
+			return fmt.Errorf("file name %q contains unsafe character %q", name, r)
+		}
+	}
+	if name == "." || name == ".." {
+		return errors.New("file name must not be a relative path element")
+	}
+	return nil
+}
+
+// WriteOptions controls how failed output writes are retried.
+type WriteOptions struct {
+	// Retries is the number of times a failed write is retried
+	Retries int
+	// Backoff is the delay before the first retry, doubled on each retry
+	Backoff time.Duration
+	// FallbackDir receives the output as a last resort when all retries failed
+	FallbackDir string
+	// Root is the destination directory outputs are mirrored into, their path relative to it being kept
+	// within FallbackDir so that same-named files of different subdirectories do not overwrite each other
+	Root string
+}
+
+// WriteWithRetry writes path using write, retrying with exponential backoff and finally
+// writing into the fallback directory. It returns the path the output was written to.
+func WriteWithRetry(path string, opts WriteOptions, write func(string) error) (string, error) {
+	backoff := opts.Backoff
+	err := write(path)
+	for i := 1; err != nil && i <= opts.Retries; i++ {
+		log.Warn().Err(err).Int("retry", i).Dur("backoff", backoff).Str("dst", path).Msg("write failed, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+		err = write(path)
+	}
+	if err == nil {
+		return path, nil
+	}
+
+	if opts.FallbackDir == "" {
+		return path, fmt.Errorf("write %s: %w", path, err)
+	}
+
+	fallback := opts.fallbackPath(path)
+	if merr := os.MkdirAll(filepath.Dir(fallback), 0o755); merr != nil {
+		return fallback, fmt.Errorf("write %s: %w (fallback %s: %v)", path, err, fallback, merr)
+	}
+	log.Warn().Err(err).Str("dst", path).Str("fallback", fallback).Msg("write failed, using fallback dir")
+	if ferr := write(fallback); ferr != nil {
+		return fallback, fmt.Errorf("write %s: %w (fallback %s: %v)", path, err, fallback, ferr)
+	}
+
+	return fallback, nil
+}
+
+// fallbackPath returns the path within FallbackDir the output written to path falls back to: its path
+// relative to Root when under it, its base name otherwise.
+func (opts WriteOptions) fallbackPath(path string) string {
+	name := filepath.Base(path)
+	if opts.Root != "" {
+		if rel, err := filepath.Rel(opts.Root, path); err == nil && filepath.IsLocal(rel) {
+			name = rel
+		}
+	}
+	return filepath.Join(opts.FallbackDir, name)
+}
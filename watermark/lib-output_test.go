@@ -0,0 +1,78 @@
+package watermark
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncodeOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    EncodeOptions
+		wantErr bool
+	}{
+		{name: "defaults", opts: EncodeOptions{JpegQuality: -1, PngCompression: -1}},
+		{name: "zero", opts: EncodeOptions{}},
+		{name: "bounds", opts: EncodeOptions{JpegQuality: 100, PngCompression: 9, ChromaSubsampling: "420"}},
+		{name: "jpeg quality below -1", opts: EncodeOptions{JpegQuality: -2}, wantErr: true},
+		{name: "jpeg quality above 100", opts: EncodeOptions{JpegQuality: 101}, wantErr: true},
+		{name: "png compression below -1", opts: EncodeOptions{PngCompression: -5}, wantErr: true},
+		{name: "png compression above 9", opts: EncodeOptions{PngCompression: 10}, wantErr: true},
+		{name: "chroma subsampling", opts: EncodeOptions{ChromaSubsampling: "440"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWriteWithRetry(t *testing.T) {
+	root := "out"
+	tests := []struct {
+		name string
+		path string
+		root string
+		want string
+	}{
+		{name: "no root", path: filepath.Join(root, "a", "scan.jpg"), want: "scan.jpg"},
+		{name: "mirrored", path: filepath.Join(root, "a", "scan.jpg"), root: root, want: filepath.Join("a", "scan.jpg")},
+		{name: "other mirrored", path: filepath.Join(root, "b", "scan.jpg"), root: root, want: filepath.Join("b", "scan.jpg")},
+		{name: "outside the root", path: filepath.Join("elsewhere", "scan.jpg"), root: root, want: "scan.jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fallbackDir := t.TempDir()
+			opts := WriteOptions{Retries: 1, FallbackDir: fallbackDir, Root: tt.root}
+			var attempts int
+			got, err := WriteWithRetry(tt.path, opts, func(path string) error {
+				attempts++
+				if path == tt.path {
+					return errors.New("disk full")
+				}
+				return os.WriteFile(path, []byte("out"), 0o644)
+			})
+			if err != nil {
+				t.Fatalf("WriteWithRetry() error = %v", err)
+			}
+			if want := filepath.Join(fallbackDir, tt.want); got != want {
+				t.Errorf("WriteWithRetry() = %q, want %q", got, want)
+			}
+			if _, err := os.Stat(got); err != nil {
+				t.Errorf("WriteWithRetry() fallback not written: %v", err)
+			}
+			if attempts != 3 {
+				t.Errorf("WriteWithRetry() attempts = %d, want 3", attempts)
+			}
+		})
+	}
+
+	// Without fallback directory, the error of the last retry is returned
+	if _, err := WriteWithRetry("scan.jpg", WriteOptions{}, func(string) error { return errors.New("disk full") }); err == nil {
+		t.Error("WriteWithRetry() error = nil, want the write error")
+	}
+}
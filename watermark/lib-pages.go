@@ -0,0 +1,352 @@
+package watermark
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// PDFExtension is the extension of PDF documents, whose pages are rasterized and processed one by one
+	PDFExtension = ".pdf"
+	// DefaultPDFResolution is the resolution in DPI PDF pages are rasterized at
+	DefaultPDFResolution = 300
+	// maxTIFFPages bounds the image file directories followed, guarding against corrupt files
+	maxTIFFPages = 10000
+)
+
+// IsPDFFile reports whether the path has the PDF extension.
+func IsPDFFile(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == PDFExtension
+}
+
+// IsMultiPage reports whether the source is a document processed page by page: a PDF, or a TIFF
+// holding several pages. Unreadable TIFFs are left to the image read to report.
+func IsMultiPage(srcPath string) bool {
+	if IsPDFFile(srcPath) {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(srcPath))
+	if ext != ".tif" && ext != ".tiff" {
+		return false
+	}
+	n, err := TIFFPageCount(srcPath)
+	return err == nil && n > 1
+}
+
+// PagePath returns the path the given page of a document of pages pages is written to, numbered from 1
+// and zero padded to sort in order (eg. out-01.png to out-12.png). Paths without an image extension, eg.
+// mirroring a PDF in directory mode, are written as PNG.
+func PagePath(dst string, page, pages int) string {
+	ext := filepath.Ext(dst)
+	stem := strings.TrimSuffix(dst, ext)
+	if !IsImageFile(dst) {
+		ext = ".png"
+	}
+	return fmt.Sprintf("%s-%0*d%s", stem, len(strconv.Itoa(pages)), page, ext)
+}
+
+// FirstPageExists reports whether the first page of a multi-page document written to dst exists, under
+// any of the paddings PagePath numbers it with, the page count being unknown until the document is read.
+func FirstPageExists(dst string) bool {
+	for pages := 1; pages <= maxTIFFPages; pages *= 10 {
+		if _, err := os.Stat(PagePath(dst, 1, pages)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// TIFFPageCount returns the number of pages of the TIFF file.
+func TIFFPageCount(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	ifds, _, err := tiffDirectories(f)
+	return len(ifds), err
+}
+
+// tiffDirectory is an image file directory of a TIFF file, describing a page.
+type tiffDirectory struct {
+	// offset is where the directory starts, next where the offset of the following directory is stored
+	offset uint64
+	next   uint64
+}
+
+// tiffDirectories returns the image file directories of the TIFF or BigTIFF data, one per page, and the
+// position of the header field pointing to the first one, where OpenCV starts reading.
+func tiffDirectories(r io.ReaderAt) ([]tiffDirectory, int64, error) {
+	header := make([]byte, 16)
+	if n, _ := r.ReadAt(header, 0); n < 8 {
+		return nil, 0, errors.New("not a TIFF file")
+	}
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, errors.New("not a TIFF file")
+	}
+
+	// Classic TIFF has 2 byte entry counts, 12 byte entries and 4 byte offsets, BigTIFF 8, 20 and 8
+	big := false
+	var first int64 = 4
+	off := uint64(order.Uint32(header[4:]))
+	switch order.Uint16(header[2:]) {
+	case 42:
+	case 43:
+		big, first = true, 8
+		off = order.Uint64(header[8:])
+	default:
+		return nil, 0, errors.New("not a TIFF file")
+	}
+
+	var ifds []tiffDirectory
+	seen := map[uint64]bool{}
+	buf := make([]byte, 8)
+	for off != 0 {
+		if seen[off] || len(ifds) == maxTIFFPages {
+			return nil, 0, errors.New("corrupt TIFF file: directory loop")
+		}
+		seen[off] = true
+
+		var count, next uint64
+		if big {
+			if _, err := r.ReadAt(buf, int64(off)); err != nil {
+				return nil, 0, fmt.Errorf("corrupt TIFF file: %w", err)
+			}
+			count = order.Uint64(buf)
+			next = off + 8 + count*20
+		} else {
+			if _, err := r.ReadAt(buf[:2], int64(off)); err != nil {
+				return nil, 0, fmt.Errorf("corrupt TIFF file: %w", err)
+			}
+			count = uint64(order.Uint16(buf))
+			next = off + 2 + count*12
+		}
+		if count > 1<<32 {
+			return nil, 0, errors.New("corrupt TIFF file: directory too large")
+		}
+		ifds = append(ifds, tiffDirectory{offset: off, next: next})
+
+		if big {
+			if _, err := r.ReadAt(buf, int64(next)); err != nil {
+				return nil, 0, fmt.Errorf("corrupt TIFF file: %w", err)
+			}
+			off = order.Uint64(buf)
+		} else {
+			if _, err := r.ReadAt(buf[:4], int64(next)); err != nil {
+				return nil, 0, fmt.Errorf("corrupt TIFF file: %w", err)
+			}
+			off = uint64(order.Uint32(buf))
+		}
+	}
+	return ifds, first, nil
+}
+
+// tiffPages extracts the pages of a TIFF file one at a time, each into a TIFF file of its own. A page file
+// is a copy of the source pointing to the page as its only directory, so that the page data is left untouched.
+type tiffPages struct {
+	f     *os.File
+	size  int64
+	order binary.ByteOrder
+	ifds  []tiffDirectory
+	// first is the position of the header field pointing to the first directory
+	first int64
+}
+
+// openTIFFPages opens the TIFF file and reads its directories. The caller must close it.
+func openTIFFPages(path string) (*tiffPages, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ifds, first, err := tiffDirectories(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	t := &tiffPages{f: f, size: info.Size(), order: binary.LittleEndian, ifds: ifds, first: first}
+	magic := make([]byte, 2)
+	if _, err := f.ReadAt(magic, 0); err == nil && string(magic) == "MM" {
+		t.order = binary.BigEndian
+	}
+	return t, nil
+}
+
+// Close closes the TIFF file.
+func (t *tiffPages) Close() error {
+	return t.f.Close()
+}
+
+// write writes the page i, counted from 0, as a TIFF file to path.
+func (t *tiffPages) write(i int, path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(t.f, 0, t.size))
+
+	// Point the header to the page, and end the directory chain after it
+	if err == nil {
+		ifd := t.ifds[i]
+		header, next := make([]byte, 4), make([]byte, 4)
+		if t.first == 8 {
+			header, next = make([]byte, 8), make([]byte, 8)
+			t.order.PutUint64(header, ifd.offset)
+		} else {
+			t.order.PutUint32(header, uint32(ifd.offset))
+		}
+		if _, err = out.WriteAt(header, t.first); err == nil {
+			_, err = out.WriteAt(next, int64(ifd.next))
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// RasterizePDF renders every page of the PDF file as a PNG file into dir at the given resolution in DPI,
+// and returns their paths in page order. It runs pdftoppm, from poppler-utils, which must be installed.
+func RasterizePDF(path, dir string, dpi int) ([]string, error) {
+	bin, err := exec.LookPath("pdftoppm")
+	if err != nil {
+		return nil, fmt.Errorf("PDF input requires pdftoppm (poppler-utils): %w", err)
+	}
+	stem := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	out, err := exec.Command(bin, "-r", strconv.Itoa(dpi), "-png", path, filepath.Join(dir, stem)).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("pdftoppm: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	// Pages are numbered zero padded to the page count, sorting in order
+	pages, err := filepath.Glob(filepath.Join(dir, "*.png"))
+	if err != nil {
+		return nil, err
+	}
+	if len(pages) == 0 {
+		return nil, errors.New("pdftoppm: no page rendered")
+	}
+	sort.Strings(pages)
+	return pages, nil
+}
+
+// processPages processes every page of a multi-page document like an image of its own, written to the
+// destination paths numbered with PagePath. The config rules and EXIF filter apply to the document.
+// The returned result holds the result of every page processed so far, even when an error occurred.
+func (p *Pipeline) processPages(srcPath, dstPath string) (Result, error) {
+	start := time.Now()
+	res := Result{Src: srcPath}
+	base := filepath.Base(srcPath)
+	p = p.forFile(srcPath)
+
+	outputs := SplitDst(dstPath)
+	for _, dst := range outputs {
+		if dst == StdioPath {
+			return res, fmt.Errorf("%s: multi-page documents cannot be written to stdout", base)
+		}
+	}
+
+	// Skip documents not matching the EXIF filter
+	if len(p.ExifFilter) > 0 {
+		if ok, reason := p.ExifFilter.Match(srcPath); !ok {
+			log.Debug().Str("reason", reason).Msg(base + ": skipped")
+			res.Skipped = reason
+			return res, nil
+		}
+	}
+
+	// Extract the pages one at a time, TIFF pages being written just before they are processed. Every page
+	// file is removed once processed
+	dir, err := os.MkdirTemp("", "rm-watermarks-pages-")
+	if err != nil {
+		return res, err
+	}
+	defer os.RemoveAll(dir)
+	var count int
+	var extract func(i int) (string, error)
+	if IsPDFFile(srcPath) {
+		dpi := p.PDFResolution
+		if dpi <= 0 {
+			dpi = DefaultPDFResolution
+		}
+		pages, err := RasterizePDF(srcPath, dir, dpi)
+		if err != nil {
+			return res, fmt.Errorf("%s: %w", base, err)
+		}
+		count = len(pages)
+		extract = func(i int) (string, error) { return pages[i], nil }
+	} else {
+		tiff, err := openTIFFPages(srcPath)
+		if err != nil {
+			return res, fmt.Errorf("%s: %w", base, err)
+		}
+		defer tiff.Close()
+		stem := strings.TrimSuffix(base, filepath.Ext(base))
+		count = len(tiff.ifds)
+		extract = func(i int) (string, error) {
+			path := PagePath(filepath.Join(dir, stem+".tif"), i+1, count)
+			return path, tiff.write(i, path)
+		}
+	}
+	log.Info().Int("pages", count).Msg(base + ": multi-page document")
+
+	// Pages are processed with the rules of the document already applied
+	page := *p
+	page.Config.Rules = nil
+	page.ExifFilter = nil
+	var written []string
+	for i := 0; i < count; i++ {
+		q := page
+		dsts := make([]string, len(outputs))
+		for j, dst := range outputs {
+			dsts[j] = PagePath(dst, i+1, count)
+		}
+		if q.Compare != "" && !strings.Contains(q.Compare, NamePlaceholder) {
+			q.Compare = PagePath(q.Compare, i+1, count)
+		}
+
+		pagePath, err := extract(i)
+		if err != nil {
+			res.Dst = strings.Join(written, ",")
+			return res, fmt.Errorf("%s: page %d: %w", base, i+1, err)
+		}
+		pr, err := q.Process(pagePath, strings.Join(dsts, ","))
+		os.Remove(pagePath)
+		pr.Src = srcPath
+		pr.Page = i + 1
+		res.Pages = append(res.Pages, pr)
+		if pr.Dst != "" {
+			written = append(written, pr.Dst)
+		}
+		if err != nil {
+			res.Dst = strings.Join(written, ",")
+			return res, fmt.Errorf("%s: page %d: %w", base, i+1, err)
+		}
+	}
+
+	res.Dst = strings.Join(written, ",")
+	res.DurationMs = time.Since(start).Milliseconds()
+	return res, nil
+}
@@ -0,0 +1,226 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// testTIFF builds a TIFF, or BigTIFF when big, of the given number of pages, each directory holding an
+// image width entry set to its page number. The last directory points back to the first when loop is set.
+func testTIFF(order binary.ByteOrder, big bool, pages int, loop bool) []byte {
+	header, count, entry, offset := 8, 2, 12, 4
+	if big {
+		header, count, entry, offset = 16, 8, 20, 8
+	}
+	size := count + entry + offset
+	data := make([]byte, header+pages*size)
+
+	copy(data, "II")
+	if order == binary.BigEndian {
+		copy(data, "MM")
+	}
+	putOffset := func(b []byte, v int) {
+		if big {
+			order.PutUint64(b, uint64(v))
+		} else {
+			order.PutUint32(b, uint32(v))
+		}
+	}
+	if big {
+		order.PutUint16(data[2:], 43)
+		order.PutUint16(data[4:], 8)
+		putOffset(data[8:], header)
+	} else {
+		order.PutUint16(data[2:], 42)
+		putOffset(data[4:], header)
+	}
+
+	for i := 0; i < pages; i++ {
+		ifd := data[header+i*size:]
+		if big {
+			order.PutUint64(ifd, 1)
+		} else {
+			order.PutUint16(ifd, 1)
+		}
+		order.PutUint16(ifd[count:], 256)
+		order.PutUint16(ifd[count+2:], 4)
+		if big {
+			order.PutUint64(ifd[count+4:], 1)
+		} else {
+			order.PutUint32(ifd[count+4:], 1)
+		}
+		order.PutUint32(ifd[count+entry-offset:], uint32(i+1))
+
+		switch {
+		case i < pages-1:
+			putOffset(ifd[count+entry:], header+(i+1)*size)
+		case loop:
+			putOffset(ifd[count+entry:], header)
+		}
+	}
+	return data
+}
+
+func TestPagePath(t *testing.T) {
+	tests := []struct {
+		dst   string
+		page  int
+		pages int
+		want  string
+	}{
+		{"out.png", 1, 1, "out-1.png"},
+		{"out.png", 1, 12, "out-01.png"},
+		{"out.png", 12, 12, "out-12.png"},
+		{"scans/doc.tif", 7, 100, "scans/doc-007.tif"},
+		{"scans/doc.pdf", 2, 3, "scans/doc-2.png"},
+		{"out", 1, 2, "out-1.png"},
+	}
+	for _, tt := range tests {
+		if got := PagePath(tt.dst, tt.page, tt.pages); got != tt.want {
+			t.Errorf("PagePath(%q, %d, %d) = %q, want %q", tt.dst, tt.page, tt.pages, got, tt.want)
+		}
+	}
+}
+
+func TestFirstPageExists(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  bool
+	}{
+		{name: "none"},
+		{name: "single digit", files: []string{"out-1.png"}, want: true},
+		{name: "padded", files: []string{"out-01.png", "out-02.png"}, want: true},
+		{name: "padded to the page bound", files: []string{"out-00001.png"}, want: true},
+		{name: "other page only", files: []string{"out-2.png"}},
+		{name: "unnumbered", files: []string{"out.png"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := FirstPageExists(filepath.Join(dir, "out.png")); got != tt.want {
+				t.Errorf("FirstPageExists() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTIFFDirectories(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		want      []tiffDirectory
+		wantFirst int64
+		wantErr   bool
+	}{
+		{
+			name:      "single page",
+			data:      testTIFF(binary.LittleEndian, false, 1, false),
+			want:      []tiffDirectory{{offset: 8, next: 22}},
+			wantFirst: 4,
+		},
+		{
+			name:      "classic",
+			data:      testTIFF(binary.LittleEndian, false, 3, false),
+			want:      []tiffDirectory{{offset: 8, next: 22}, {offset: 26, next: 40}, {offset: 44, next: 58}},
+			wantFirst: 4,
+		},
+		{
+			name:      "classic big endian",
+			data:      testTIFF(binary.BigEndian, false, 2, false),
+			want:      []tiffDirectory{{offset: 8, next: 22}, {offset: 26, next: 40}},
+			wantFirst: 4,
+		},
+		{
+			name:      "BigTIFF",
+			data:      testTIFF(binary.BigEndian, true, 2, false),
+			want:      []tiffDirectory{{offset: 16, next: 44}, {offset: 52, next: 80}},
+			wantFirst: 8,
+		},
+		{name: "directory loop", data: testTIFF(binary.LittleEndian, false, 3, true), wantErr: true},
+		{name: "truncated", data: testTIFF(binary.LittleEndian, false, 2, false)[:30], wantErr: true},
+		{name: "invalid version", data: []byte("II\x2b\x01\x08\x00\x00\x00"), wantErr: true},
+		{name: "not a TIFF", data: []byte("\x89PNG\r\n\x1a\n"), wantErr: true},
+		{name: "empty", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, first, err := tiffDirectories(bytes.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tiffDirectories() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (!slices.Equal(got, tt.want) || first != tt.wantFirst) {
+				t.Errorf("tiffDirectories() = %v, %d, want %v, %d", got, first, tt.want, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestTIFFPages(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		pages   int
+		wantErr bool
+	}{
+		{name: "single page", data: testTIFF(binary.LittleEndian, false, 1, false), pages: 1},
+		{name: "classic", data: testTIFF(binary.LittleEndian, false, 3, false), pages: 3},
+		{name: "BigTIFF", data: testTIFF(binary.BigEndian, true, 2, false), pages: 2},
+		{name: "directory loop", data: testTIFF(binary.LittleEndian, false, 2, true), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := filepath.Join(t.TempDir(), "scan.tiff")
+			if err := os.WriteFile(src, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			tiff, err := openTIFFPages(src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("openTIFFPages() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer tiff.Close()
+			if len(tiff.ifds) != tt.pages {
+				t.Fatalf("openTIFFPages() pages = %d, want %d", len(tiff.ifds), tt.pages)
+			}
+
+			// Every page file holds the page directory of the source as its only directory, the source
+			// data being otherwise copied as is
+			ifds, first, err := tiffDirectories(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "page.tif")
+			for i := range ifds {
+				if err := tiff.write(i, path); err != nil {
+					t.Fatalf("write(%d) error = %v", i, err)
+				}
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pages, _, err := tiffDirectories(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("page %d: %v", i+1, err)
+				}
+				if len(pages) != 1 || pages[0] != ifds[i] {
+					t.Errorf("page %d directories = %v, want %v", i+1, pages, ifds[i:i+1])
+				}
+				if len(data) != len(tt.data) || !bytes.Equal(data[:first], tt.data[:first]) {
+					t.Errorf("page %d is not a copy of the source", i+1)
+				}
+			}
+		})
+	}
+}
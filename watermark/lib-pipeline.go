@@ -0,0 +1,1494 @@
+package watermark
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gocv.io/x/gocv"
+)
+
+// Pipeline holds the settings resolved once per run and shared by every processed image.
+type Pipeline struct {
+	Config          Config
+	Method          gocv.InpaintMethods
+	XPhotoMethod    XPhotoMethod
+	UseXPhoto       bool
+	LUT             []byte
+	Combine         string
+	MaxPixels       int
+	MaxPixelsAction string
+	ExifFilter      ExifFilter
+	DstPattern      string
+	Write           WriteOptions
+	Encode          EncodeOptions
+	Annotate        string
+	Mode            string
+	CropProcess     bool
+	ReportQuality   bool
+	PreserveExif    bool
+	// Gamma is the gamma curve applied to the source image when read, values < 1 brightening it and
+	// values > 1 darkening it. 0 and 1 leave it as is
+	Gamma float64
+	// Stretch16Bit converts 16-bit sources to 8-bit by stretching the value range of every image over 0-255,
+	// rather than by the fixed division by 256 giving every image the same tone curve
+	Stretch16Bit bool
+	// PreserveColor only replaces the masked pixels of the source with the inpainted grayscale ones, keeping
+	// its colors everywhere else, as crop process and tiles do
+	PreserveColor bool
+	// GrayscaleOutput writes the result as a single channel image, except for color images whose colors
+	// the result kept, eg. outside the crop process regions
+	GrayscaleOutput bool
+	// Equalize equalizes the histogram of the image masks are computed on, exclusive with the config CLAHE
+	Equalize bool
+	// Denoise is the strength of the denoising of the inpainted image, 0 disables it
+	Denoise float64
+	// IgnoreOrientation keeps the source pixels as stored rather than turning them upright
+	IgnoreOrientation bool
+	// MaxDimension is the largest side in pixels images are processed at, larger images being downscaled
+	// and their result upscaled back. 0 processes images at full resolution
+	MaxDimension int
+	// TileSize is the side in pixels of the tiles larger images are processed in, 0 processes them whole
+	TileSize int
+	// TileOverlap is the overlap in pixels between neighboring tiles, blended to avoid seams
+	TileOverlap int
+	// GPU runs the Gaussian blurs on a CUDA device, see CudaAvailable. Inpainting always runs on the CPU
+	GPU bool
+	// AutoThreshold replaces the computed threshold with the best of a sweep on a downscaled proxy
+	AutoThreshold bool
+	// Threshold fixes the mean threshold (0-255) of every image, 0 included, prevailing over the config and its
+	// rules. nil leaves the threshold to them
+	Threshold *float32
+	// Format is the extension of the format written to stdout (eg. "png"), which has no extension to infer it from
+	Format string
+	// Thumbnail is the size the thumbnail written alongside every output fits in, none when zero
+	Thumbnail image.Point
+	// Letterbox pads thumbnails to exactly the Thumbnail size
+	Letterbox bool
+	// Compare is the path the source and result are written to side by side, NamePlaceholder being replaced
+	// by the source name, none when empty
+	Compare string
+	// MaskFile is a precomputed mask used for every image in place of the masks computed from the config,
+	// none when empty
+	MaskFile string
+	// MaskResize resizes a MaskFile of another size than the image rather than failing
+	MaskResize bool
+	// Profile logs the time spent in each processing stage of every image, and of every mask
+	Profile bool
+	// PDFResolution is the resolution in DPI PDF pages are rasterized at, 0 uses DefaultPDFResolution
+	PDFResolution int
+	// DebugDir is the directory the intermediate Mats of every image are written to as PNG files, "" disables it
+	DebugDir string
+}
+
+// CropProcessPadding is the margin in pixels kept around mask regions in crop process mode,
+// giving the inpainting surrounding pixels to work from.
+const CropProcessPadding = 32
+
+// Validate checks the processing fields set on the pipeline are consistent with each other and with its
+// config, and reports every inconsistency at once. Process and Remove fail on an invalid pipeline.
+func (p *Pipeline) Validate() error {
+	var errs []error
+	switch p.Mode {
+	case ModeInpaint, ModeUnblend:
+	case ModeFFT:
+		if p.CropProcess || p.TileSize > 0 || p.AutoThreshold || p.PreserveColor {
+			errs = append(errs, errors.New("fft mode processes whole images, it cannot be combined with crop process, tiles, auto threshold or preserve color"))
+		}
+	case ModeClone:
+		if p.Config.Clone.OffsetX == 0 && p.Config.Clone.OffsetY == 0 {
+			errs = append(errs, errors.New("clone mode requires a clone offsetX or offsetY in the config"))
+		}
+	case ModeCutout:
+		if p.GrayscaleOutput {
+			errs = append(errs, errors.New("cutout mode writes transparency, it cannot be combined with grayscale output"))
+		}
+	default:
+		errs = append(errs, errors.New("invalid mode: "+p.Mode))
+	}
+	if err := ValidateTiling(p.TileSize, p.TileOverlap, p.Config); err != nil {
+		errs = append(errs, err)
+	}
+	if p.TileSize > 0 && p.CropProcess {
+		errs = append(errs, errors.New("tiles cannot be combined with crop process"))
+	}
+	if p.MaskFile != "" && (p.Mode == ModeFFT || p.CropProcess || p.TileSize > 0 || p.AutoThreshold || p.MaxDimension > 0) {
+		errs = append(errs, errors.New("mask file applies to whole images, it cannot be combined with fft mode, crop process, tiles, auto threshold or max dimension"))
+	}
+	if p.AutoThreshold && p.Config.Threshold.Method == ThresholdAdaptive {
+		errs = append(errs, errors.New("auto threshold requires the mean threshold method"))
+	}
+	if p.Threshold != nil {
+		if p.AutoThreshold {
+			errs = append(errs, errors.New("auto threshold cannot be combined with a fixed threshold"))
+		}
+		if *p.Threshold < 0 || *p.Threshold > 255 {
+			errs = append(errs, fmt.Errorf("invalid threshold %g, must be within 0-255", *p.Threshold))
+		}
+	}
+	if p.MaxDimension < 0 {
+		errs = append(errs, fmt.Errorf("invalid max dimension %d, must be a positive size", p.MaxDimension))
+	}
+	if p.Equalize && p.Config.CLAHE.ClipLimit > 0 {
+		errs = append(errs, errors.New("equalize cannot be combined with the config clahe, pick one"))
+	}
+	return errors.Join(errs...)
+}
+
+// Process removes the watermarks from the source image and writes the result to dstPath,
+// a comma separated list of paths when the result is written in several formats.
+// The returned result holds the metrics computed so far, even when an error occurred.
+func (p *Pipeline) Process(srcPath, dstPath string) (Result, error) {
+	if err := p.Validate(); err != nil {
+		return Result{Src: srcPath}, err
+	}
+
+	// Process the pages of multi-page documents one by one
+	if srcPath != StdioPath && IsMultiPage(srcPath) {
+		return p.processPages(srcPath, dstPath)
+	}
+
+	start := time.Now()
+	res := Result{Src: srcPath}
+	base := filepath.Base(srcPath)
+	log.Debug().Str("image", srcPath).Msg(base)
+	p = p.forFile(srcPath)
+
+	outputs := SplitDst(dstPath)
+	if p.DstPattern != "" {
+		outputs = []string{p.DstPattern}
+	}
+	for _, dst := range outputs {
+		if p.Mode == ModeCutout && !SupportsAlpha(p.outputExt(dst)) {
+			return res, fmt.Errorf("%s: cutout mode requires an output format supporting alpha", dst)
+		}
+	}
+
+	// Skip images not matching the EXIF filter
+	if len(p.ExifFilter) > 0 {
+		if ok, reason := p.ExifFilter.Match(srcPath); !ok {
+			log.Debug().Str("reason", reason).Msg(base + ": skipped")
+			res.Skipped = reason
+			return res, nil
+		}
+	}
+
+	// Read image
+	perf := time.Now()
+	src, err := p.readSource(srcPath, &res)
+	if err != nil {
+		return res, err
+	}
+	defer src.Close()
+	res.timeStage("read", perf)
+
+	out, mask, err := p.remove(src, base, &res)
+	defer out.Close()
+	defer mask.Close()
+	if err != nil {
+		return res, err
+	}
+
+	p.writeDebug(base, "mask", mask)
+	p.writeDebug(base, "result", out)
+
+	if p.Config.Visual {
+		gocv.NewWindow("src").IMShow(src)
+		// gocv.NewWindow("gray").IMShow(img)
+		gocv.NewWindow("mask").IMShow(mask)
+		gocv.NewWindow("Result").IMShow(out)
+		gocv.WaitKey(0)
+		return res, nil
+	}
+
+	// Stamp provenance text on review copies
+	if p.Annotate != "" {
+		text := strings.NewReplacer("{date}", start.Format("2006-01-02"), "{version}", Version).Replace(p.Annotate)
+		if err := Annotate(&out, text, p.Config.Annotation); err != nil {
+			return res, err
+		}
+	}
+
+	// Write a single channel image, unless it kept the colors of a color source
+	if p.GrayscaleOutput {
+		if res.Color && IsColor(out, p.Config.ColorSaturationThreshold, p.Config.ColorMinFraction, p.Config.ColorAllHues) {
+			log.Warn().Msg(base + ": color preserved, grayscale output skipped")
+		} else {
+			gray := gocv.NewMat()
+			gocv.CvtColor(out, &gray, gocv.ColorBGRToGray)
+			out.Close()
+			out = gray
+		}
+	}
+
+	// Carry the source EXIF over to JPEG outputs, OpenCV strips it
+	var exif []byte
+	if p.PreserveExif && srcPath != StdioPath {
+		if exif, err = sourceExif(srcPath, !p.IgnoreOrientation); err != nil {
+			return res, err
+		}
+	}
+
+	// Write the single result to every output
+	perf = time.Now()
+	written := make([]string, 0, len(outputs))
+	for _, dst := range outputs {
+		dst, err := p.writeOutput(out, srcPath, dst, exif)
+		if err != nil {
+			res.Dst = strings.Join(written, ",")
+			return res, err
+		}
+		written = append(written, dst)
+	}
+	res.timeStage("write", perf)
+
+	// Write a thumbnail alongside every output, from the final result
+	if p.Thumbnail != (image.Point{}) {
+		thumb := Thumbnail(out, p.Thumbnail, p.Letterbox)
+		defer thumb.Close()
+		for _, dst := range written {
+			path, err := WriteWithRetry(ThumbnailPath(dst), p.Write, func(path string) error {
+				return writeImage(path, thumb, WriteParams(filepath.Ext(path), p.Encode))
+			})
+			if err != nil {
+				res.Dst = strings.Join(written, ",")
+				return res, err
+			}
+			res.Thumbnails = append(res.Thumbnails, path)
+		}
+	}
+
+	// Write the source and result side by side for review
+	if p.Compare != "" {
+		cmp := SideBySide(src, out)
+		defer cmp.Close()
+		name := strings.TrimSuffix(base, filepath.Ext(base))
+		path, err := WriteWithRetry(strings.ReplaceAll(p.Compare, NamePlaceholder, name), p.Write, func(path string) error {
+			return writeImage(path, cmp, WriteParams(filepath.Ext(path), p.Encode))
+		})
+		if err != nil {
+			res.Dst = strings.Join(written, ",")
+			return res, err
+		}
+		res.Compare = path
+	}
+
+	// Done
+	res.Dst = strings.Join(written, ",")
+	res.DurationMs = time.Since(start).Milliseconds()
+	event := log.Info().
+		Int64("duration(ms)", (time.Since(start)).Milliseconds()).
+		Float32("brightness", res.Brightness).
+		Float32("mean", res.Mean).
+		Float32("stdDev", res.StdDev).
+		Float32("threshold", res.Threshold).
+		Bool("color", res.Color).
+		Bool("carbonCopy", res.CarbonCopy).
+		Bool("inverted", res.Inverted).
+		Str("dst", res.Dst)
+	if res.ComputedThreshold > 0 {
+		event = event.Float32("computedThreshold", res.ComputedThreshold)
+	}
+	if p.ReportQuality {
+		event = event.Float64("psnr", res.psnr).Float64("ssim", res.ssim)
+	}
+	event.Msg(base)
+
+	// Break the duration down by stage
+	if p.Profile {
+		event := log.Info()
+		for _, s := range res.stages {
+			event = event.Int64(s.name+"(ms)", s.duration.Milliseconds())
+		}
+		event.Msg(base + ": profile")
+	}
+
+	return res, nil
+}
+
+// forFile returns the pipeline processing the image file with the config rule matching it applied,
+// p itself when no rule applies.
+func (p *Pipeline) forFile(srcPath string) *Pipeline {
+	cfg, rule := p.Config.ForFile(srcPath)
+	if rule < 0 {
+		return p
+	}
+	log.Debug().Int("rule", rule).Str("pattern", p.Config.Rules[rule].Pattern).Msg(filepath.Base(srcPath) + ": config rule")
+
+	q := *p
+	q.Config = cfg
+	return &q
+}
+
+// remove removes the watermarks from the prepared source image, recording the metrics in res.
+// It returns the result and the mask of the processed pixels, which the caller must close, also on error.
+func (p *Pipeline) remove(src gocv.Mat, base string, res *Result) (gocv.Mat, gocv.Mat, error) {
+	// Trade resolution for speed on large images
+	if p.MaxDimension > 0 && max(src.Cols(), src.Rows()) > p.MaxDimension {
+		return p.removeDownscaled(src, base, res)
+	}
+	return p.removePlaced(src, nil, base, res)
+}
+
+// tiled returns whether an image of the given size is processed tile by tile.
+func (p *Pipeline) tiled(size image.Point) bool {
+	return p.TileSize > 0 && (size.X > p.TileSize || size.Y > p.TileSize)
+}
+
+// removePlaced removes the watermarks like remove, from the masks placed over the image, placing them
+// when placed is nil. The caller keeps the ownership of the given placed masks.
+func (p *Pipeline) removePlaced(src gocv.Mat, placed []gocv.Mat, base string, res *Result) (gocv.Mat, gocv.Mat, error) {
+	// Compute image metrics
+	// b captures the overall average brightness of the image
+	// m represents the average of the channel-wise means, indicating the image's overall color balance
+	// s measures the average spread of pixel values across channels, reflecting the image's overall contrast or detail level
+	perf := time.Now()
+	b, m, s := ComputeImageChannelMetrics(src)
+	res.timeStage("metrics", perf)
+
+	carbonCopy, inverted := p.carbonCopy(b, base)
+
+	size := image.Point{X: src.Cols(), Y: src.Rows()}
+	full := image.Rect(0, 0, size.X, size.Y)
+
+	// Place every mask template over the image, fft mode and mask files need none
+	if placed == nil && p.Mode != ModeFFT && p.MaskFile == "" {
+		perf := time.Now()
+		var err error
+		placed, err = p.placeMasks(src, inverted, base)
+		if err != nil {
+			return gocv.NewMat(), gocv.NewMat(), err
+		}
+		for _, pm := range placed {
+			defer pm.Close()
+		}
+		res.timeStage("place", perf)
+	}
+
+	// Process large images tile by tile, like crop process regions
+	tiled := p.tiled(size)
+
+	// ref is the image the output is produced from as the source looks, carbon copies not inverted,
+	// compared with the output when reporting quality
+	ref := src
+	var out, mask gocv.Mat
+	var thresh float32
+	var color bool
+
+	if !p.CropProcess && !tiled {
+		// Process the whole image
+		var img gocv.Mat
+		perf := time.Now()
+		img, thresh, color = p.prepareRegion(src, full, m, s, inverted)
+		defer img.Close()
+		if !p.PreserveColor {
+			ref = img
+			if inverted {
+				ref = InvertColors(img)
+				defer ref.Close()
+			}
+		}
+		res.timeStage("prepare", perf)
+
+		if p.Mode == ModeFFT {
+			// Filter the tiled watermark out of the whole image, the mask being the pixels it changed
+			perf = time.Now()
+			var peaks int
+			out, peaks = RemovePeriodicPattern(img, p.Config.FFT)
+			mask = DiffMask(img, out, ChangedPixelsThreshold)
+			log.Debug().Int("peaks", peaks).Msg(base + ": fft notch filter")
+		} else {
+			var passes []inpaintPass
+			var err error
+			mask, passes, thresh, err = p.wholeImageMask(img, placed, thresh, base, res)
+			if err != nil {
+				return gocv.NewMat(), mask, err
+			}
+			perf = time.Now()
+			if p.Mode == ModeCutout {
+				// Make the watermark transparent rather than removing it
+				out = Cutout(ref, mask)
+			} else if p.PreserveColor {
+				// Only replace the masked pixels, keeping the source colors everywhere else
+				out = src.Clone()
+				p.compositeRegion(&out, img, mask, passes, full, inverted, image.Point{})
+			} else {
+				out = p.inpaint(img, mask, passes)
+			}
+			closePasses(passes)
+		}
+		res.timeStage("fill", perf)
+
+		// Undo the carbon copy inversion, as compositeRegion does for regions and tiles
+		if inverted && p.Mode != ModeCutout && !p.PreserveColor {
+			restored := InvertColors(out)
+			out.Close()
+			out = restored
+		}
+
+		// Keep processed pages visually consistent with unprocessed ones, which preserved colors already are
+		if p.Mode != ModeCutout && p.Config.MatchBrightness && !p.PreserveColor {
+			matched := MatchBrightness(out, b)
+			out.Close()
+			out = matched
+		}
+
+		// Describe where the image changed
+		changed := mask.Clone()
+		if p.Mode != ModeCutout {
+			changed.Close()
+			changed = DiffMask(ref, out, ChangedPixelsThreshold)
+		}
+		res.ChangedPixels, res.ChangedBoxes = ChangedRegions(changed)
+		changed.Close()
+	} else {
+		// Only process the regions around the masks, or the tiles, and composite them back into the original
+		mask = gocv.NewMatWithSize(size.Y, size.X, gocv.MatTypeCV8UC1)
+		mask.SetTo(gocv.Scalar{Val1: 0, Val2: 0, Val3: 0, Val4: 255})
+		out = src.Clone()
+
+		var regions []image.Rectangle
+		if tiled {
+			regions = TileRegions(size, p.TileSize, p.TileOverlap)
+			log.Debug().Int("tiles", len(regions)).Msg(base + ": tiled process")
+		} else {
+			regions = p.maskRegions(placed, size)
+			log.Debug().Int("regions", len(regions)).Msg(base + ": crop process")
+		}
+		for i, region := range regions {
+			perf := time.Now()
+			img, t, c := p.prepareRegion(src, region, m, s, inverted)
+			res.timeStage("prepare", perf)
+			if p.AutoThreshold {
+				perf := time.Now()
+				t = p.autoThreshold(img, placed, region, t, base)
+				res.timeStage("autoThreshold", perf)
+			}
+			perf = time.Now()
+			msk, passes, err := p.computeMasks(img, placed, region, t, base)
+			if err != nil {
+				img.Close()
+				return out, mask, err
+			}
+			res.timeStage("masks", perf)
+			if i == 0 {
+				thresh, color = t, c
+			}
+
+			// Tiles overlap, keep the pixels masked by any of them
+			maskRegion := mask.Region(region)
+			merged := gocv.NewMat()
+			gocv.BitwiseOr(maskRegion, msk, &merged)
+			merged.CopyTo(&maskRegion)
+			merged.Close()
+			maskRegion.Close()
+
+			if p.Mode != ModeCutout && gocv.CountNonZero(msk) > 0 {
+				// Blend tiles over the overlap with their left and top neighbors to avoid seams
+				var blend image.Point
+				if tiled {
+					if region.Min.X > 0 {
+						blend.X = p.TileOverlap
+					}
+					if region.Min.Y > 0 {
+						blend.Y = p.TileOverlap
+					}
+				}
+				perf := time.Now()
+				p.compositeRegion(&out, img, msk, passes, region, inverted, blend)
+				res.timeStage("fill", perf)
+			}
+
+			img.Close()
+			msk.Close()
+			closePasses(passes)
+		}
+
+		// Describe where the image changed
+		changed := mask.Clone()
+		if p.Mode == ModeCutout {
+			cutout := Cutout(src, mask)
+			out.Close()
+			out = cutout
+		} else {
+			changed.Close()
+			changed = DiffMask(src, out, ChangedPixelsThreshold)
+		}
+		res.ChangedPixels, res.ChangedBoxes = ChangedRegions(changed)
+		changed.Close()
+	}
+
+	res.Brightness = b
+	res.Mean = m
+	res.StdDev = s
+	res.Threshold = thresh
+	if _, ok := p.fixedThreshold(); ok {
+		res.ComputedThreshold = computeThreshold(m, s, color)
+	}
+	res.Color = color
+	res.CarbonCopy = carbonCopy
+	res.Inverted = inverted
+
+	// Measure how much the areas outside the mask were altered
+	if p.ReportQuality {
+		res.psnr, res.ssim = MaskedQuality(ref, out, mask)
+	}
+
+	return out, mask, nil
+}
+
+// Remove removes the watermarks from the BGR source image and returns the result, which the caller
+// must close. The source image is left unchanged.
+func (p *Pipeline) Remove(src gocv.Mat) (gocv.Mat, error) {
+	if src.Empty() {
+		return gocv.NewMat(), errors.New("empty source image")
+	}
+	if err := p.Validate(); err != nil {
+		return gocv.NewMat(), err
+	}
+
+	var res Result
+	img, err := p.prepareSource(src.Clone(), "image", &res)
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+	defer img.Close()
+
+	out, mask, err := p.remove(img, "image", &res)
+	mask.Close()
+	if err != nil {
+		out.Close()
+		return gocv.NewMat(), err
+	}
+	return out, nil
+}
+
+// removeDownscaled removes the watermarks from the source image downscaled to fit the max dimension.
+// The masks are placed over the source, their templates, coordinates and offsets being given in source
+// pixels, and downscaled with it. Only the masked pixels of the result are upscaled back into the source,
+// which keeps its resolution elsewhere. The changed regions are scaled accordingly.
+func (p *Pipeline) removeDownscaled(src gocv.Mat, base string, res *Result) (gocv.Mat, gocv.Mat, error) {
+	scale := float64(p.MaxDimension) / float64(max(src.Cols(), src.Rows()))
+	size := image.Point{X: max(1, int(float64(src.Cols())*scale)), Y: max(1, int(float64(src.Rows())*scale))}
+	log.Debug().Int("cols", size.X).Int("rows", size.Y).Msg(base + ": downscaled to fit max dimension")
+
+	// Place the masks at full resolution, keeping thin template lines when downscaling them
+	var placed []gocv.Mat
+	if p.Mode != ModeFFT && p.MaskFile == "" {
+		b, _, _ := ComputeImageChannelMetrics(src)
+		_, inverted := p.carbonCopy(b, base)
+		fullPlaced, err := p.placeMasks(src, inverted, base)
+		if err != nil {
+			return gocv.NewMat(), gocv.NewMat(), err
+		}
+		placed = make([]gocv.Mat, len(fullPlaced))
+		for i, pm := range fullPlaced {
+			placed[i] = gocv.NewMat()
+			if !pm.Empty() {
+				gocv.Resize(pm, &placed[i], size, 0, 0, gocv.InterpolationArea)
+				gocv.Threshold(placed[i], &placed[i], 0, 255, gocv.ThresholdBinary)
+			}
+			pm.Close()
+		}
+		defer func() {
+			for _, pm := range placed {
+				pm.Close()
+			}
+		}()
+	}
+
+	small := gocv.NewMat()
+	defer small.Close()
+	gocv.Resize(src, &small, size, 0, 0, gocv.InterpolationArea)
+
+	out, mask, err := p.removePlaced(small, placed, base, res)
+	if err != nil {
+		return out, mask, err
+	}
+	defer out.Close()
+	defer mask.Close()
+
+	full := image.Point{X: src.Cols(), Y: src.Rows()}
+	upscaledMask := gocv.NewMat()
+	gocv.Resize(mask, &upscaledMask, full, 0, 0, gocv.InterpolationNearestNeighbor)
+
+	// The source as the downscaled result outside its masked pixels, grayscale when processed as a whole image
+	// unless its colors are preserved, while crop process regions and tiles are composited into the source
+	source := src
+	if !p.PreserveColor && !p.CropProcess && !p.tiled(size) {
+		source = RemoveColors(src)
+		defer source.Close()
+	}
+
+	// Only take the masked pixels from the downscaled result
+	var result gocv.Mat
+	if p.Mode == ModeCutout {
+		result = Cutout(source, upscaledMask)
+	} else {
+		upscaled := gocv.NewMat()
+		defer upscaled.Close()
+		gocv.Resize(out, &upscaled, full, 0, 0, gocv.InterpolationCubic)
+		result = source.Clone()
+		upscaled.CopyToWithMask(&result, upscaledMask)
+	}
+
+	res.ChangedPixels = int(float64(res.ChangedPixels) / (scale * scale))
+	for i, box := range res.ChangedBoxes {
+		for j := range box {
+			res.ChangedBoxes[i][j] = int(float64(box[j]) / scale)
+		}
+	}
+
+	return result, upscaledMask, nil
+}
+
+// writeOutput encodes the result in the format of the dst extension and writes it, resolving dst
+// as the destination pattern when one is set. JPEG outputs carry the exif segment, when not nil.
+// It returns the path the output was written to.
+func (p *Pipeline) writeOutput(out gocv.Mat, srcPath, dst string, exif []byte) (string, error) {
+	ext := p.outputExt(dst)
+	params := WriteParams(ext, p.Encode)
+	withExif := exif != nil && isJPEG(ext)
+
+	// encode returns the output bytes as written, EXIF included
+	encode := func() ([]byte, error) {
+		data, err := EncodeImage(ext, out, params)
+		if err != nil || !withExif {
+			return data, err
+		}
+		return InsertExifSegment(data, exif)
+	}
+
+	// Write to stdout, encoded in the requested format
+	if dst == StdioPath {
+		data, err := encode()
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stdout.Write(data); err != nil {
+			return "", err
+		}
+		return dst, nil
+	}
+
+	// Write file
+	write := func(path string) error {
+		return writeImage(path, out, params)
+	}
+	if p.DstPattern != "" || withExif {
+		// The content hash is only known once the output is encoded
+		data, err := encode()
+		if err != nil {
+			return "", err
+		}
+		if p.DstPattern != "" {
+			dst, err = ResolveDstPattern(dst, srcPath, data)
+			if err != nil {
+				return "", err
+			}
+		}
+		write = func(path string) error {
+			return os.WriteFile(path, data, 0o644)
+		}
+	}
+	return WriteWithRetry(dst, p.Write, write)
+}
+
+// writeImage writes the image to path with the optional encoding parameters.
+func writeImage(path string, img gocv.Mat, params []int) error {
+	var ok bool
+	if len(params) > 0 {
+		ok = gocv.IMWriteWithParams(path, img, params)
+	} else {
+		ok = gocv.IMWrite(path, img)
+	}
+	if !ok {
+		return errors.New("error writing image to disk")
+	}
+	return nil
+}
+
+// outputExt returns the extension of the output format of dst, the requested format for stdout.
+func (p *Pipeline) outputExt(dst string) string {
+	if dst == StdioPath {
+		return "." + strings.TrimPrefix(strings.ToLower(p.Format), ".")
+	}
+	return filepath.Ext(dst)
+}
+
+// sourceExif returns the EXIF block of the source JPEG, nil for sources without EXIF. The orientation is
+// reset when the source pixels were turned upright when read.
+func sourceExif(srcPath string, resetOrientation bool) ([]byte, error) {
+	segment, err := ReadExifSegment(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	if segment == nil {
+		log.Debug().Msg(filepath.Base(srcPath) + ": no EXIF to preserve")
+		return nil, nil
+	}
+	if resetOrientation {
+		segment = ResetExifOrientation(segment)
+	}
+	return segment, nil
+}
+
+// isJPEG reports whether the extension is a JPEG one.
+func isJPEG(ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg":
+		return true
+	}
+	return false
+}
+
+// carbonCopy reports whether the image of brightness b is a carbon copy, and whether it is inverted.
+// Carbon copies are always detected, but only inverted when enabled.
+func (p *Pipeline) carbonCopy(b float32, base string) (bool, bool) {
+	carbonCopy := b < p.Config.CarbonCopyThreshold
+	inverted := carbonCopy && p.Config.ApplyInvert
+	log.Debug().
+		Float32("brightness", b).
+		Float32("carbonCopyThreshold", p.Config.CarbonCopyThreshold).
+		Bool("carbonCopy", carbonCopy).
+		Bool("inverted", inverted).
+		Msg(base + ": carbon copy decision")
+	return carbonCopy, inverted
+}
+
+// readSource reads the source image upright and prepares it, recording the applied auto contrast in res.
+func (p *Pipeline) readSource(srcPath string, res *Result) (gocv.Mat, error) {
+	base := filepath.Base(srcPath)
+
+	// Read stdin, turned upright by OpenCV unless disabled
+	if srcPath == StdioPath {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return gocv.NewMat(), fmt.Errorf("stdin: %w", err)
+		}
+		flags := gocv.IMReadColor | gocv.IMReadAnyDepth
+		if p.IgnoreOrientation {
+			flags |= gocv.IMReadIgnoreOrientation
+		}
+		src, err := gocv.IMDecode(data, flags)
+		if err != nil || src.Empty() {
+			src.Close()
+			return gocv.NewMat(), errors.New("stdin: unable to decode image")
+		}
+		return p.prepareSource(src, base, res)
+	}
+
+	// Read image, as stored and at its bit depth
+	src := gocv.IMRead(srcPath, gocv.IMReadColor|gocv.IMReadAnyDepth|gocv.IMReadIgnoreOrientation)
+	if src.Empty() {
+		src.Close()
+		return src, fmt.Errorf("%s: unable to read image", base)
+	}
+
+	// Turn the image upright so that mask gravities match what is seen
+	if !p.IgnoreOrientation {
+		orientation, err := ReadExifOrientation(srcPath)
+		if err != nil {
+			log.Warn().Err(err).Msg(base + ": unreadable EXIF orientation, ignored")
+		}
+		if orientation != 1 {
+			log.Debug().Int("orientation", orientation).Msg(base + ": EXIF orientation applied")
+			upright := ApplyExifOrientation(src, orientation)
+			src.Close()
+			src = upright
+		}
+	}
+
+	return p.prepareSource(src, base, res)
+}
+
+// prepareSource applies the size guard, tone corrections and preprocessing filters to the source image,
+// which it takes ownership of, recording the applied auto contrast in res.
+func (p *Pipeline) prepareSource(src gocv.Mat, base string, res *Result) (gocv.Mat, error) {
+	// Process 16-bit scans at 8-bit
+	if src.Type()&7 != gocv.MatTypeCV8U {
+		var low, high float32
+		src, low, high = ConvertTo8Bit(src, p.Stretch16Bit)
+		log.Info().
+			Float32("min", low).
+			Float32("max", high).
+			Bool("stretched", p.Stretch16Bit).
+			Msg(base + ": converted to 8-bit")
+	}
+
+	// Bound the pixel count, and so the processing buffers. The decoded source is already held whole
+	if p.MaxPixels > 0 && src.Rows()*src.Cols() > p.MaxPixels {
+		pixels := src.Rows() * src.Cols()
+		switch p.MaxPixelsAction {
+		case "downscale":
+			src = FitToMaxPixels(src, p.MaxPixels)
+			log.Info().
+				Int("pixels", pixels).
+				Int("maxPixels", p.MaxPixels).
+				Int("rows", src.Rows()).
+				Int("cols", src.Cols()).
+				Msg(base + ": downscaled to fit max pixels")
+		case "skip":
+			src.Close()
+			return src, fmt.Errorf("%s: image of %d pixels exceeds max pixels %d, skipped", base, pixels, p.MaxPixels)
+		}
+	}
+
+	// Normalize systematically dark or bright scans
+	if p.Gamma > 0 && p.Gamma != 1 {
+		corrected := ApplyLUT(src, LevelsLUT(0, 255, p.Gamma))
+		src.Close()
+		src = corrected
+	}
+
+	// Apply device calibration
+	if !IsIdentityLUT(p.LUT) {
+		calibrated := ApplyLUT(src, p.LUT)
+		src.Close()
+		src = calibrated
+	}
+
+	// Normalize poorly exposed scans, reporting the parameters for reproducibility
+	if p.Config.AutoContrast {
+		alpha, beta := ComputeAutoContrast(src, AutoContrastClipPercent)
+		adjusted := gocv.NewMat()
+		gocv.ConvertScaleAbs(src, &adjusted, alpha, beta)
+		src.Close()
+		src = adjusted
+		res.AutoContrastAlpha = alpha
+		res.AutoContrastBeta = beta
+		log.Info().Float64("alpha", alpha).Float64("beta", beta).Msg(base + ": auto contrast")
+	}
+
+	// Apply the configured preprocessing filters in order
+	if len(p.Config.PreProcess) > 0 {
+		filtered := ApplyFilters(src, p.Config.PreProcess)
+		src.Close()
+		src = filtered
+	}
+
+	return src, nil
+}
+
+// prepareRegion converts the region of the source image to the grayscale image masks are computed on
+// and inpainted, inverting carbon copies. It returns the image along with its threshold and color detection.
+func (p *Pipeline) prepareRegion(src gocv.Mat, region image.Rectangle, m, s float32, inverted bool) (gocv.Mat, float32, bool) {
+	view := src.Region(region)
+	defer view.Close()
+
+	// Invert colors if carbon copy
+	img := view
+	if inverted {
+		img = InvertColors(view)
+		defer img.Close()
+	}
+
+	// Detect if color image
+	color := IsColor(img, p.Config.ColorSaturationThreshold, p.Config.ColorMinFraction, p.Config.ColorAllHues)
+
+	// Remove colors. Inpainting works best on grayscale images
+	gray := RemoveColors(img)
+
+	// Compute binary image using mean threshold, unless fixed
+	thresh := computeThreshold(m, s, color)
+	if fixed, ok := p.fixedThreshold(); ok {
+		thresh = fixed
+	}
+
+	return gray, thresh, color
+}
+
+// fixedThreshold returns the mean threshold fixed by the pipeline, or else by the config, and whether one is.
+func (p *Pipeline) fixedThreshold() (float32, bool) {
+	if p.Threshold != nil {
+		return *p.Threshold, true
+	}
+	return p.Config.Threshold.Value, p.Config.Threshold.Value > 0
+}
+
+// computeThreshold derives the mean threshold from the image mean m and standard deviation s.
+func computeThreshold(m, s float32, color bool) float32 {
+	if !color {
+		return s
+	}
+	dt := (m - s) / 2
+	// t = 1.2 *s
+	// t += dt
+	return m - dt
+}
+
+// wholeImageMask returns the mask of the whole image img and its inpaint passes, as processing the image computes
+// them: read from the mask file when set, aggregated from the configured masks otherwise, at the threshold picked
+// by autoThreshold when enabled. It also returns the threshold the masks were computed at.
+func (p *Pipeline) wholeImageMask(img gocv.Mat, placed []gocv.Mat, thresh float32, base string, res *Result) (gocv.Mat, []inpaintPass, float32, error) {
+	size := image.Point{X: img.Cols(), Y: img.Rows()}
+	full := image.Rect(0, 0, size.X, size.Y)
+
+	// Use the precomputed mask as is
+	if p.MaskFile != "" {
+		perf := time.Now()
+		mask, err := ReadMaskFile(p.MaskFile, size, p.MaskResize)
+		res.timeStage("masks", perf)
+		return mask, nil, thresh, err
+	}
+
+	if p.AutoThreshold {
+		perf := time.Now()
+		thresh = p.autoThreshold(img, placed, full, thresh, base)
+		res.timeStage("autoThreshold", perf)
+	}
+	perf := time.Now()
+	mask, passes, err := p.computeMasks(img, placed, full, thresh, base)
+	res.timeStage("masks", perf)
+	return mask, passes, thresh, err
+}
+
+// dry returns a copy of the pipeline computing the same masks without side effects, ie. writing no debug
+// images and opening no windows, to describe the processing of an image.
+func (p *Pipeline) dry() *Pipeline {
+	q := *p
+	q.DebugDir = ""
+	q.Config.Visual = false
+	return &q
+}
+
+// computeMask aggregates the configured masks, placed over the whole image, within the region of the image,
+// img holding the region pixels.
+func (p *Pipeline) computeMask(img gocv.Mat, placed []gocv.Mat, region image.Rectangle, thresh float32, base string) (gocv.Mat, error) {
+	mask, passes, err := p.computeMasks(img, placed, region, thresh, base)
+	closePasses(passes)
+	return mask, err
+}
+
+// inpaintPass is the part of the mask inpainted in a pass of its own radius.
+type inpaintPass struct {
+	mask   gocv.Mat
+	radius float32
+}
+
+// closePasses closes the masks of the inpaint passes.
+func closePasses(passes []inpaintPass) {
+	for _, pass := range passes {
+		pass.mask.Close()
+	}
+}
+
+// computeMasks computes the mask like computeMask, along with the inpaint passes splitting it when masks
+// set their own inpaint radius: the masks at the global radius first, then each mask at its own radius.
+// No passes are returned when every mask uses the global radius.
+func (p *Pipeline) computeMasks(img gocv.Mat, placed []gocv.Mat, region image.Rectangle, thresh float32, base string) (gocv.Mat, []inpaintPass, error) {
+	img = p.maskImage(img)
+	defer img.Close()
+
+	// Create init empty mask
+	mask := gocv.NewMatWithSize(region.Dy(), region.Dx(), gocv.MatTypeCV8UC1)
+	mask.SetTo(gocv.Scalar{Val1: 0, Val2: 0, Val3: 0, Val4: 255})
+
+	// Create init empty subtract mask
+	sub := gocv.NewMatWithSize(region.Dy(), region.Dx(), gocv.MatTypeCV8UC1)
+	sub.SetTo(gocv.Scalar{Val1: 0, Val2: 0, Val3: 0, Val4: 255})
+	defer sub.Close()
+
+	// Aggregate masks, keeping those inpainted at their own radius
+	added := 0
+	var own []inpaintPass
+	for i, m := range p.Config.Masks {
+		// Release each mask at the end of its iteration rather than when returning
+		err := func() error {
+			msk, skipped, err := p.watermarkMask(img, placed[i], region, thresh, i, m, base)
+			defer msk.Close()
+			if err != nil || skipped != "" {
+				return err
+			}
+
+			// Aggregate masks
+			if m.Mode == MaskModeSubtract {
+				CombineMasks(&sub, msk, MaskCombineOr, false)
+			} else {
+				CombineMasks(&mask, msk, p.Combine, added == 0)
+				added++
+				if m.InpaintRadius > 0 {
+					own = append(own, inpaintPass{mask: msk.Clone(), radius: m.InpaintRadius})
+				}
+			}
+			return nil
+		}()
+		if err != nil {
+			mask.Close()
+			closePasses(own)
+			return gocv.NewMat(), nil, fmt.Errorf("mask[%d]: %w", i, err)
+		}
+	}
+
+	// Overshoot the watermark edges so the inpainting blends without a halo
+	if p.Config.MaskDilate > 0 {
+		DilateMask(&mask, p.Config.MaskDilate)
+	}
+
+	// Remove subtract masks from the aggregated mask
+	SubtractMask(&mask, sub)
+
+	// Protect the legibility of text anywhere in the image
+	if p.Config.TextSafeZone > 0 {
+		zone := TextSafeZone(img, thresh, p.Config.Threshold, p.Config.Foreground, p.Config.TextSafeZone)
+		defer zone.Close()
+		SubtractMask(&mask, zone)
+	}
+
+	if len(own) == 0 {
+		return mask, nil, nil
+	}
+
+	// Split the final mask into the passes, a pixel covered by several masks going to the first one
+	rest := mask.Clone()
+	for i := range own {
+		if p.Config.MaskDilate > 0 {
+			DilateMask(&own[i].mask, p.Config.MaskDilate)
+		}
+		part := gocv.NewMat()
+		gocv.BitwiseAnd(own[i].mask, rest, &part)
+		own[i].mask.Close()
+		own[i].mask = part
+		SubtractMask(&rest, part)
+	}
+	passes := append([]inpaintPass{{mask: rest, radius: p.Config.InpaintRadius}}, own...)
+
+	return mask, passes, nil
+}
+
+// maskImage returns the image masks are computed on, a blurred copy of img when mask blur is set
+// for smoother mask edges, equalized when histogram equalization or CLAHE is set. The sharp img is still the one inpainted.
+func (p *Pipeline) maskImage(img gocv.Mat) gocv.Mat {
+	if p.Config.MaskBlur > 0 {
+		img = p.blurImage(img, p.Config.MaskBlur)
+	} else {
+		img = img.Clone()
+	}
+
+	// Spread the narrow tone range of low-contrast scans
+	if p.Equalize {
+		equalized := EqualizeHistogram(img)
+		img.Close()
+		img = equalized
+	}
+
+	// Boost the local contrast of faint watermarks
+	if p.Config.CLAHE.ClipLimit > 0 {
+		equalized := ApplyCLAHE(img, p.Config.CLAHE.ClipLimit, p.Config.CLAHE.TileGrid)
+		img.Close()
+		img = equalized
+	}
+	return img
+}
+
+// writeDebug writes the intermediate Mat of the image to the debug directory as <image>-<name>.png,
+// when enabled. Failures are logged rather than failing the image.
+func (p *Pipeline) writeDebug(base, name string, img gocv.Mat) {
+	if p.DebugDir == "" || img.Empty() {
+		return
+	}
+
+	stem := strings.TrimSuffix(base, filepath.Ext(base))
+	if base == StdioPath {
+		stem = "stdin"
+	}
+	path := filepath.Join(p.DebugDir, stem+"-"+name+".png")
+	if !gocv.IMWrite(path, img) {
+		log.Warn().Str("path", path).Msg(base + ": unable to write debug image")
+	}
+}
+
+// blurImage returns a Gaussian-blurred copy of the image, computed on the GPU when enabled.
+func (p *Pipeline) blurImage(img gocv.Mat, ksize int) gocv.Mat {
+	if p.GPU {
+		return CudaBlurImage(img, ksize)
+	}
+	return BlurImage(img, ksize)
+}
+
+// watermarkMask computes the watermark mask of the i-th mask, placed over the whole image, within the region
+// of the image, img holding the region pixels. When the mask is skipped, the reason is returned.
+func (p *Pipeline) watermarkMask(img, placed gocv.Mat, region image.Rectangle, thresh float32, i int, m Mask, base string) (gocv.Mat, string, error) {
+	perf := time.Now()
+
+	// The template could not be located in the image
+	if placed.Empty() {
+		msk := gocv.NewMatWithSize(region.Dy(), region.Dx(), gocv.MatTypeCV8UC1)
+		msk.SetTo(gocv.Scalar{Val1: 0, Val2: 0, Val3: 0, Val4: 255})
+		return msk, MaskNotLocated, nil
+	}
+
+	// Keep the processed region of the placed template
+	tpl := placed.Region(region)
+	defer tpl.Close()
+
+	// Rect and polygon masks are applied as is
+	if m.drawn() {
+		return tpl.Clone(), "", nil
+	}
+
+	// Compute image specific watermark mask
+	var crop, bin, fg, msk gocv.Mat
+	var err error
+	if m.Detect == DetectGradient {
+		ksize := m.GradientKernel
+		if ksize == 0 {
+			ksize = DefaultGradientKernel
+		}
+		crop, bin, msk, err = ComputeGradientMask(img, tpl, "north-west", ksize)
+		fg = gocv.NewMat()
+	} else {
+		crop, bin, fg, msk, err = ComputeWatermarkMask(img, tpl, "north-west", thresh, p.Config.Threshold, p.Config.Foreground, m.Foreground)
+	}
+	defer crop.Close()
+	defer bin.Close()
+	defer fg.Close()
+	if err != nil {
+		return msk, "", err
+	}
+
+	// Only apply the mask when all detection signals agree
+	if p.Config.Confidence.Enabled() {
+		signals := ComputeConfidenceSignals(img, crop, msk)
+		if ok, failed := p.Config.Confidence.Check(signals); !ok {
+			log.Info().
+				Str("mask", m.File).
+				Str("failed", failed).
+				Float32("matchScore", signals.MatchScore).
+				Float64("coverage", signals.Coverage).
+				Float32("contrast", signals.Contrast).
+				Msg(base + ": mask skipped below confidence gate")
+			return msk, failed, nil
+		}
+	}
+
+	// Name the intermediate Mats after the mask, and the tile when processing part of the image
+	name := fmt.Sprintf("mask%d", i)
+	if region.Dx() != placed.Cols() || region.Dy() != placed.Rows() {
+		name += fmt.Sprintf("-x%dy%d", region.Min.X, region.Min.Y)
+	}
+	p.writeDebug(base, name+"-crop", crop)
+	p.writeDebug(base, name+"-bin", bin)
+	p.writeDebug(base, name+"-fg", fg)
+	p.writeDebug(base, name+"-mask", msk)
+
+	if p.Config.Visual {
+		// gocv.NewWindow("crop").IMShow(crop)
+		gocv.NewWindow("bin").IMShow(bin)
+		if !fg.Empty() {
+			gocv.NewWindow("fg").IMShow(fg)
+		}
+		// gocv.NewWindow("mask").IMShow(maskTpl)
+		gocv.WaitKey(0)
+	}
+
+	event := log.Debug()
+	if p.Profile {
+		event = log.Info()
+	}
+	event.
+		Int64("duration(ms)", (time.Since(perf)).Milliseconds()).
+		Str("mask", m.File).Msg(base)
+
+	return msk, "", nil
+}
+
+// placeMasks places every mask template over the whole image. Masks located by template matching
+// which could not be found and have no fallback gravity are returned empty.
+func (p *Pipeline) placeMasks(src gocv.Mat, inverted bool, base string) ([]gocv.Mat, error) {
+	size := image.Point{X: src.Cols(), Y: src.Rows()}
+
+	// Watermarks are located on the image as processed
+	img := src
+	if inverted {
+		img = InvertColors(src)
+		defer img.Close()
+	}
+
+	placed := make([]gocv.Mat, 0, len(p.Config.Masks))
+	for i, m := range p.Config.Masks {
+		// Rect and polygon masks need no template
+		if m.drawn() {
+			var pm gocv.Mat
+			var err error
+			if len(m.Rect) > 0 {
+				pm, err = RectMask(size.X, size.Y, m.Rect)
+			} else {
+				pm, err = PolygonMask(size.X, size.Y, m.Polygon)
+			}
+			if err != nil {
+				for _, pm := range placed {
+					pm.Close()
+				}
+				return nil, fmt.Errorf("mask[%d]: %w", i, err)
+			}
+			placed = append(placed, pm)
+			continue
+		}
+
+		// Read watermark mask template
+		maskTpl, err := ReadTemplate(m.File)
+		if err != nil {
+			for _, pm := range placed {
+				pm.Close()
+			}
+			return nil, fmt.Errorf("mask[%d]: %w", i, err)
+		}
+
+		// Preserve the excluded areas of the template, validated up front
+		if err := ExcludeRects(&maskTpl, m.ExcludeRect); err != nil {
+			log.Warn().Err(err).Str("mask", m.File).Msg(base + ": exclude rect ignored")
+		}
+
+		// Align the template with skewed watermarks
+		if m.Rotation != 0 {
+			rotated := RotateTemplate(maskTpl, m.Rotation)
+			maskTpl.Close()
+			maskTpl = rotated
+		}
+		pm, err := p.placeTemplate(img, maskTpl, m, size, base)
+		maskTpl.Close()
+		if err != nil {
+			for _, pm := range placed {
+				pm.Close()
+			}
+			return nil, fmt.Errorf("mask[%d]: %w", i, err)
+		}
+		placed = append(placed, pm)
+	}
+
+	return placed, nil
+}
+
+// placeTemplate returns an image sized mask holding the mask template placed as configured.
+func (p *Pipeline) placeTemplate(img, maskTpl gocv.Mat, m Mask, size image.Point, base string) (gocv.Mat, error) {
+	// Replicate tile template across the image
+	gravity := m.Gravity
+	if m.Tile {
+		tiled := TileTemplate(maskTpl, size.X, size.Y, m.TileSpacingX, m.TileSpacingY, m.TileOffsetX, m.TileOffsetY)
+		defer tiled.Close()
+		if gravity == "" {
+			gravity = "north-west"
+		}
+		return PlaceTemplate(tiled, size.X, size.Y, gravity)
+	}
+
+	// Locate the watermark precisely, degrading to the coarse fallback gravity placement
+	if gravity == GravityAuto {
+		rect, score := LocateByTemplate(img, maskTpl)
+		minScore := m.MinMatchScore
+		if minScore == 0 {
+			minScore = DefaultMinMatchScore
+		}
+		if score >= minScore {
+			log.Info().
+				Str("mask", m.File).
+				Float32("matchScore", score).
+				Int("x", rect.Min.X).
+				Int("y", rect.Min.Y).
+				Msg(base + ": mask located by template")
+			return PlaceTemplateAt(maskTpl, size.X, size.Y, rect.Min), nil
+		}
+		if m.FallbackGravity == "" {
+			log.Info().
+				Str("mask", m.File).
+				Float32("matchScore", score).
+				Msg(base + ": mask not located by template, skipped")
+			return gocv.NewMat(), nil
+		}
+		log.Info().
+			Str("mask", m.File).
+			Float32("matchScore", score).
+			Str("fallbackGravity", m.FallbackGravity).
+			Msg(base + ": mask not located by template, using fallback gravity")
+		gravity = m.FallbackGravity
+	}
+	if gravity == GravityFeatures {
+		h, inliers := LocateByFeatures(img, maskTpl)
+		defer h.Close()
+		minInliers := m.MinInliers
+		if minInliers == 0 {
+			minInliers = DefaultMinInliers
+		}
+		if !h.Empty() && inliers >= minInliers {
+			log.Info().
+				Str("mask", m.File).
+				Int("inliers", inliers).
+				Msg(base + ": mask located by features")
+			return WarpTemplate(maskTpl, h, size.X, size.Y), nil
+		}
+		if m.FallbackGravity == "" {
+			log.Info().
+				Str("mask", m.File).
+				Int("inliers", inliers).
+				Msg(base + ": mask not located by features, skipped")
+			return gocv.NewMat(), nil
+		}
+		log.Info().
+			Str("mask", m.File).
+			Int("inliers", inliers).
+			Str("fallbackGravity", m.FallbackGravity).
+			Msg(base + ": mask not located by features, using fallback gravity")
+		gravity = m.FallbackGravity
+	}
+
+	placed, err := PlaceTemplate(maskTpl, size.X, size.Y, gravity)
+	if err != nil || (m.OffsetX == 0 && m.OffsetY == 0) {
+		return placed, err
+	}
+	defer placed.Close()
+	return ShiftMask(placed, m.OffsetX, m.OffsetY), nil
+}
+
+// maskRegions returns the padded and merged bounding rectangles of the add masks over an image of the given size.
+func (p *Pipeline) maskRegions(placed []gocv.Mat, size image.Point) []image.Rectangle {
+	var rects []image.Rectangle
+	for i, m := range p.Config.Masks {
+		if m.Mode == MaskModeSubtract || placed[i].Empty() {
+			continue
+		}
+		rects = append(rects, MaskBoundingRect(placed[i]))
+	}
+
+	return MergeRects(rects, CropProcessPadding, image.Rect(0, 0, size.X, size.Y))
+}
+
+// inpaint removes the watermark from the image, then applies the configured post-processing.
+func (p *Pipeline) inpaint(img, mask gocv.Mat, passes []inpaintPass) gocv.Mat {
+	// Apply inpainting to remove the watermark
+	out := p.fill(img, mask, passes)
+
+	// Only lightly correct faintly watermarked pixels
+	if p.Config.SoftBlend {
+		blended := SoftBlend(img, out)
+		out.Close()
+		out = blended
+	}
+
+	// Restore crisp text edges around the inpainted region
+	if p.Config.Sharpen.Amount > 0 {
+		sharpened := SharpenBand(out, mask, p.Config.Sharpen)
+		out.Close()
+		out = sharpened
+	}
+
+	// Apply the configured post-processing filters in order
+	if len(p.Config.PostProcess) > 0 {
+		filtered := ApplyFilters(out, p.Config.PostProcess)
+		out.Close()
+		out = filtered
+	}
+
+	// Smooth the inpainted region only
+	if p.Config.PostBlur > 0 {
+		blurred := BlurWithinMask(out, mask, p.Config.PostBlur, p.blurImage)
+		out.Close()
+		out = blurred
+	}
+
+	// Smooth the noise left in the filled region, last
+	if p.Denoise > 0 {
+		denoised := Filters["denoise"](out, FilterParams{"h": p.Denoise})
+		out.Close()
+		out = denoised
+	}
+
+	return out
+}
+
+// fill inpaints the masked pixels, in one pass per inpaint radius when passes are given, covers them with
+// clean samples in clone mode, or restores them in unblend mode. xphoto methods have no radius and always
+// inpaint in one pass.
+func (p *Pipeline) fill(img, mask gocv.Mat, passes []inpaintPass) gocv.Mat {
+	// Reverse the blending of the watermark rather than filling it
+	if p.Mode == ModeUnblend {
+		wm := p.Config.Unblend.watermarkColor(img.Channels())
+		alpha := p.Config.Unblend.Alpha
+		if alpha == 0 {
+			// The background under the watermark is estimated by inpainting it
+			background := RemoveWatermark(img, mask, p.Method, p.Config.InpaintRadius)
+			var ok bool
+			alpha, ok = EstimateAlpha(img, background, mask, wm)
+			if !ok {
+				log.Warn().Msg("unblend alpha could not be estimated, inpainting")
+				return background
+			}
+			background.Close()
+			log.Info().Float64("alpha", alpha).Msg("estimated unblend alpha")
+		}
+		return Unblend(img, mask, alpha, wm)
+	}
+
+	// Cover the watermark with samples, inpainting the areas without one
+	if p.Mode == ModeClone {
+		out, rest := CloneFill(img, mask, p.Config.Clone)
+		defer rest.Close()
+		if gocv.CountNonZero(rest) == 0 {
+			return out
+		}
+		log.Debug().Msg("clone samples outside the image, inpainting the remaining areas")
+		filled := RemoveWatermark(out, rest, p.Method, p.Config.InpaintRadius)
+		out.Close()
+		return filled
+	}
+	if p.UseXPhoto {
+		return XPhotoInpaint(img, mask, p.XPhotoMethod)
+	}
+	if len(passes) == 0 {
+		return RemoveWatermark(img, mask, p.Method, p.Config.InpaintRadius)
+	}
+
+	out := img.Clone()
+	for _, pass := range passes {
+		if gocv.CountNonZero(pass.mask) == 0 {
+			continue
+		}
+		filled := RemoveWatermark(out, pass.mask, p.Method, pass.radius)
+		out.Close()
+		out = filled
+	}
+	return out
+}
+
+// compositeRegion inpaints the region image and copies its masked pixels back into out. The pixels are blended
+// with out over the blend.X left and blend.Y top pixels of the region, ramping up to the inpainted pixels.
+func (p *Pipeline) compositeRegion(out *gocv.Mat, img, mask gocv.Mat, passes []inpaintPass, region image.Rectangle, inverted bool, blend image.Point) {
+	patch := p.inpaint(img, mask, passes)
+	defer patch.Close()
+
+	// Undo the carbon copy inversion
+	if inverted {
+		restored := InvertColors(patch)
+		patch.Close()
+		patch = restored
+	}
+
+	// Match the original image channels
+	if patch.Channels() != out.Channels() {
+		converted := gocv.NewMat()
+		if patch.Channels() == 1 {
+			gocv.CvtColor(patch, &converted, gocv.ColorGrayToBGR)
+		} else {
+			gocv.CvtColor(patch, &converted, gocv.ColorBGRToGray)
+		}
+		patch.Close()
+		patch = converted
+	}
+
+	dst := out.Region(region)
+	defer dst.Close()
+	if blend.X > 0 || blend.Y > 0 {
+		weights := TileWeights(region.Dx(), region.Dy(), blend.X, blend.Y)
+		defer weights.Close()
+		blended := BlendWithWeights(dst, patch, weights)
+		patch.Close()
+		patch = blended
+	}
+	patch.CopyToWithMask(&dst, mask)
+}
@@ -0,0 +1,140 @@
+package watermark
+
+import (
+	"image"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+func TestPipelineValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(p *Pipeline)
+		wantErr bool
+	}{
+		{name: "default", edit: func(p *Pipeline) {}},
+		{name: "tiles", edit: func(p *Pipeline) { p.TileSize, p.TileOverlap = 512, 32 }},
+		{name: "crop process", edit: func(p *Pipeline) { p.CropProcess = true }},
+		{name: "clone offset", edit: func(p *Pipeline) { p.Mode, p.Config.Clone.OffsetY = ModeClone, -200 }},
+		{name: "unknown mode", edit: func(p *Pipeline) { p.Mode = "blur" }, wantErr: true},
+		{name: "fft with tiles", edit: func(p *Pipeline) { p.Mode, p.TileSize, p.TileOverlap = ModeFFT, 512, 32 }, wantErr: true},
+		{name: "fft with preserve color", edit: func(p *Pipeline) { p.Mode, p.PreserveColor = ModeFFT, true }, wantErr: true},
+		{name: "clone without offset", edit: func(p *Pipeline) { p.Mode = ModeClone }, wantErr: true},
+		{name: "cutout with grayscale output", edit: func(p *Pipeline) { p.Mode, p.GrayscaleOutput = ModeCutout, true }, wantErr: true},
+		{name: "negative tile size", edit: func(p *Pipeline) { p.TileSize = -1 }, wantErr: true},
+		{name: "tile overlap below the radius", edit: func(p *Pipeline) { p.TileSize, p.TileOverlap = 512, 2 }, wantErr: true},
+		{name: "tiles with crop process", edit: func(p *Pipeline) { p.TileSize, p.TileOverlap, p.CropProcess = 512, 32, true }, wantErr: true},
+		{name: "mask file with max dimension", edit: func(p *Pipeline) { p.MaskFile, p.MaxDimension = "mask.png", 2000 }, wantErr: true},
+		{name: "auto threshold with adaptive", edit: func(p *Pipeline) {
+			p.AutoThreshold, p.Config.Threshold.Method = true, ThresholdAdaptive
+		}, wantErr: true},
+		{name: "threshold pinned to zero", edit: func(p *Pipeline) { p.Threshold = new(float32) }},
+		{name: "auto threshold with threshold", edit: func(p *Pipeline) { p.AutoThreshold, p.Threshold = true, new(float32) }, wantErr: true},
+		{name: "threshold above 255", edit: func(p *Pipeline) {
+			t := float32(300)
+			p.Threshold = &t
+		}, wantErr: true},
+		{name: "negative max dimension", edit: func(p *Pipeline) { p.MaxDimension = -1 }, wantErr: true},
+		{name: "equalize with clahe", edit: func(p *Pipeline) { p.Equalize, p.Config.CLAHE.ClipLimit = true, 2 }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Masks = []Mask{{Rect: []int{10, 10, 100, 40}}}
+			p, err := NewPipeline(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.edit(p)
+			if err := p.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func BenchmarkComputeMask(b *testing.B) {
+	// A 10-mask config over a 2480x3508 page, A4 at 300 DPI
+	cfg := DefaultConfig()
+	for i := 0; i < 10; i++ {
+		cfg.Masks = append(cfg.Masks, Mask{Rect: []int{100 + i*200, 200 + i*300, 400, 150}})
+	}
+	p, err := NewPipeline(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	img := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(230, 230, 230, 0), 3508, 2480, gocv.MatTypeCV8UC3)
+	defer img.Close()
+	placed, err := p.placeMasks(img, false, "bench.png")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		for _, pm := range placed {
+			pm.Close()
+		}
+	}()
+	full := image.Rect(0, 0, img.Cols(), img.Rows())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mask, err := p.computeMask(img, placed, full, 128, "bench.png")
+		if err != nil {
+			b.Fatal(err)
+		}
+		mask.Close()
+	}
+}
+
+func TestRemoveDownscaled(t *testing.T) {
+	// A colored 800x600 page with a dark watermark stroke, processed downscaled to 400 pixels
+	src := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(40, 120, 200, 0), 600, 800, gocv.MatTypeCV8UC3)
+	defer src.Close()
+	stroke := src.Region(image.Rect(120, 130, 280, 150))
+	stroke.SetTo(gocv.NewScalar(10, 10, 10, 0))
+	stroke.Close()
+
+	tests := []struct {
+		name string
+		edit func(p *Pipeline)
+		// gray is whether the output outside the mask is grayscale rather than the source colors
+		gray bool
+	}{
+		{name: "whole image", edit: func(p *Pipeline) {}, gray: true},
+		{name: "preserve color", edit: func(p *Pipeline) { p.PreserveColor = true }},
+		{name: "crop process", edit: func(p *Pipeline) { p.CropProcess = true }},
+		{name: "tiles", edit: func(p *Pipeline) { p.TileSize, p.TileOverlap = 128, 32 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Masks = []Mask{{Rect: []int{100, 100, 200, 80}}}
+			p, err := NewPipeline(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.MaxDimension = 400
+			tt.edit(p)
+
+			out, err := p.Remove(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+			if out.Cols() != src.Cols() || out.Rows() != src.Rows() {
+				t.Fatalf("Remove() = %dx%d, want %dx%d", out.Cols(), out.Rows(), src.Cols(), src.Rows())
+			}
+
+			// Far from the mask, the pixel is the source one, or its gray level
+			got := out.GetVecbAt(500, 700)
+			if gray := got[0] == got[1] && got[1] == got[2]; gray != tt.gray {
+				t.Errorf("Remove() pixel outside the mask = %v, want grayscale %v", got, tt.gray)
+			}
+			if !tt.gray && (got[0] != 40 || got[1] != 120 || got[2] != 200) {
+				t.Errorf("Remove() pixel outside the mask = %v, want the source color [40 120 200]", got)
+			}
+		})
+	}
+}
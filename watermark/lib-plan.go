@@ -0,0 +1,256 @@
+package watermark
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gocv.io/x/gocv"
+)
+
+// Plan describes what processing an image would do, without inpainting it.
+type Plan struct {
+	Src        string  `json:"src"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	Brightness float32 `json:"brightness"`
+	Mean       float32 `json:"mean"`
+	StdDev     float32 `json:"stdDev"`
+	Threshold  float32 `json:"threshold"`
+	Color      bool    `json:"color"`
+	CarbonCopy bool    `json:"carbonCopy"`
+	Inverted   bool    `json:"inverted"`
+	// Masks holds the outcome of each configured mask
+	Masks []MaskPlan `json:"masks"`
+	// Coverage is the fraction of the image covered by the aggregated mask
+	Coverage float64     `json:"coverage"`
+	Inpaint  InpaintPlan `json:"inpaint"`
+	// PlanMs is the time taken to compute the plan
+	PlanMs int64 `json:"planMs"`
+	// Skipped holds the reason the image would be skipped, if any
+	Skipped string `json:"skipped,omitempty"`
+	// Error holds the reason the image would fail, if any
+	Error string `json:"error,omitempty"`
+}
+
+// MaskPlan describes where a single mask applies.
+type MaskPlan struct {
+	File string `json:"file"`
+	Mode string `json:"mode"`
+	// Rect is the x, y, width and height of the bounding rectangle of the mask over the image
+	Rect     [4]int  `json:"rect"`
+	Coverage float64 `json:"coverage"`
+	// InpaintRadius is the radius of the own inpaint pass of the mask, if any
+	InpaintRadius float32 `json:"inpaintRadius,omitempty"`
+	// Skipped holds the confidence signal the mask failed or notLocated, if any
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// InpaintPlan describes the resolved inpaint settings.
+type InpaintPlan struct {
+	Mode            string `json:"mode"`
+	Method          string `json:"method"`
+	XPhoto          bool   `json:"xphoto"`
+	SoftBlend       bool   `json:"softBlend"`
+	Sharpen         bool   `json:"sharpen"`
+	MatchBrightness bool   `json:"matchBrightness"`
+	MaskBlur        int    `json:"maskBlur"`
+	MaskDilate      int    `json:"maskDilate"`
+	CropProcess     bool   `json:"cropProcess"`
+	TextSafeZone    int    `json:"textSafeZone"`
+	// AutoThreshold is set when the threshold is picked by a sweep, the plan threshold being the picked one
+	AutoThreshold bool `json:"autoThreshold"`
+	// MaskFile is the precomputed mask used in place of the configured masks, if any
+	MaskFile string `json:"maskFile,omitempty"`
+}
+
+// Plan resolves the threshold, masks and inpaint settings for the source image as Process would, stopping
+// before inpainting. No debug images are written and no windows are opened.
+func (p *Pipeline) Plan(srcPath string) (Plan, error) {
+	start := time.Now()
+	p = p.forFile(srcPath).dry()
+	plan := Plan{Src: srcPath, Inpaint: p.inpaintPlan(), Masks: []MaskPlan{}}
+
+	// Skip images not matching the EXIF filter
+	if len(p.ExifFilter) > 0 {
+		if ok, reason := p.ExifFilter.Match(srcPath); !ok {
+			plan.Skipped = reason
+			return plan, nil
+		}
+	}
+
+	var res Result
+	src, err := p.readSource(srcPath, &res)
+	if err != nil {
+		return plan, err
+	}
+	defer src.Close()
+
+	b, m, s := ComputeImageChannelMetrics(src)
+	base := filepath.Base(srcPath)
+	carbonCopy, inverted := p.carbonCopy(b, base)
+
+	size := image.Point{X: src.Cols(), Y: src.Rows()}
+	full := image.Rect(0, 0, size.X, size.Y)
+	img, thresh, color := p.prepareRegion(src, full, m, s, inverted)
+	defer img.Close()
+
+	plan.Width = size.X
+	plan.Height = size.Y
+	plan.Brightness = b
+	plan.Mean = m
+	plan.StdDev = s
+	plan.Color = color
+	plan.CarbonCopy = carbonCopy
+	plan.Inverted = inverted
+
+	// Mask files need no placed masks
+	var placed []gocv.Mat
+	if p.MaskFile == "" {
+		if placed, err = p.placeMasks(src, inverted, base); err != nil {
+			return plan, err
+		}
+		for _, pm := range placed {
+			defer pm.Close()
+		}
+	}
+
+	mask, passes, thresh, err := p.wholeImageMask(img, placed, thresh, base, &res)
+	closePasses(passes)
+	defer mask.Close()
+	if err != nil {
+		return plan, err
+	}
+	area := float64(size.X * size.Y)
+	plan.Threshold = thresh
+	plan.Coverage = float64(gocv.CountNonZero(mask)) / area
+
+	// Break the mask down by configured mask, which a mask file replaces
+	if p.MaskFile == "" {
+		maskImg := p.maskImage(img)
+		defer maskImg.Close()
+		for i, mask := range p.Config.Masks {
+			msk, skipped, err := p.watermarkMask(maskImg, placed[i], full, thresh, i, mask, base)
+			if err != nil {
+				msk.Close()
+				return plan, fmt.Errorf("mask[%d]: %w", i, err)
+			}
+			r := MaskBoundingRect(msk)
+			mode := mask.Mode
+			if mode == "" {
+				mode = MaskModeAdd
+			}
+			mp := MaskPlan{
+				File:          mask.File,
+				Mode:          mode,
+				Rect:          [4]int{r.Min.X, r.Min.Y, r.Dx(), r.Dy()},
+				InpaintRadius: mask.InpaintRadius,
+				Skipped:       skipped,
+			}
+			// Skipped masks cover nothing, as they are left out of the aggregated mask
+			if skipped == "" {
+				mp.Coverage = float64(gocv.CountNonZero(msk)) / area
+			}
+			plan.Masks = append(plan.Masks, mp)
+			msk.Close()
+		}
+	}
+	plan.PlanMs = time.Since(start).Milliseconds()
+
+	return plan, nil
+}
+
+// inpaintPlan returns the inpaint settings resolved for the pipeline.
+func (p *Pipeline) inpaintPlan() InpaintPlan {
+	method := strconv.Itoa(int(p.Method))
+	for name, m := range InpaintMethodNames {
+		if m == p.Method {
+			method = name
+		}
+	}
+	if p.UseXPhoto {
+		for name, m := range XPhotoMethodNames {
+			if m == p.XPhotoMethod {
+				method = name
+			}
+		}
+	}
+
+	mode := p.Mode
+	if mode == "" {
+		mode = ModeInpaint
+	}
+
+	return InpaintPlan{
+		Mode:            mode,
+		Method:          method,
+		XPhoto:          p.UseXPhoto,
+		SoftBlend:       p.Config.SoftBlend,
+		Sharpen:         p.Config.Sharpen.Amount > 0,
+		MatchBrightness: p.Config.MatchBrightness,
+		MaskBlur:        p.Config.MaskBlur,
+		MaskDilate:      p.Config.MaskDilate,
+		CropProcess:     p.CropProcess,
+		TextSafeZone:    p.Config.TextSafeZone,
+		AutoThreshold:   p.AutoThreshold,
+		MaskFile:        p.MaskFile,
+	}
+}
+
+// DumpMask writes the aggregated mask computed for the source image to maskPath as an 8-bit single channel
+// image, stopping before inpainting. The mask is the one Process would inpaint, eg. the mask file when set.
+func (p *Pipeline) DumpMask(srcPath, maskPath string) error {
+	p = p.forFile(srcPath)
+	var res Result
+	src, err := p.readSource(srcPath, &res)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	base := filepath.Base(srcPath)
+	b, m, s := ComputeImageChannelMetrics(src)
+	_, inverted := p.carbonCopy(b, base)
+	full := image.Rect(0, 0, src.Cols(), src.Rows())
+	img, thresh, _ := p.prepareRegion(src, full, m, s, inverted)
+	defer img.Close()
+
+	// Mask files need no placed masks
+	var placed []gocv.Mat
+	if p.MaskFile == "" {
+		if placed, err = p.placeMasks(src, inverted, base); err != nil {
+			return err
+		}
+		for _, pm := range placed {
+			defer pm.Close()
+		}
+	}
+	mask, passes, _, err := p.wholeImageMask(img, placed, thresh, base, &res)
+	closePasses(passes)
+	defer mask.Close()
+	if err != nil {
+		return err
+	}
+
+	if ok := gocv.IMWrite(maskPath, mask); !ok {
+		return errors.New("error writing mask to disk")
+	}
+	log.Info().Str("mask", maskPath).Int("pixels", gocv.CountNonZero(mask)).Msg(base + ": mask dumped")
+	return nil
+}
+
+// WritePlans writes the plans as JSON to w, a single plan as an object unless batch is set.
+func WritePlans(w io.Writer, plans []Plan, batch bool) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if !batch && len(plans) == 1 {
+		return enc.Encode(plans[0])
+	}
+	return enc.Encode(plans)
+}
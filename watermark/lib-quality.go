@@ -0,0 +1,141 @@
+package watermark
+
+import (
+	"image"
+	"math"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	// ssimWindow and ssimSigma are the Gaussian window of the SSIM local statistics
+	ssimWindow = 11
+	ssimSigma  = 1.5
+
+	// ssimC1 and ssimC2 stabilize the SSIM division, (0.01*255)^2 and (0.03*255)^2
+	ssimC1 = 6.5025
+	ssimC2 = 58.5225
+)
+
+// MaskedQuality returns the PSNR in dB and the SSIM between the grayscale pixels of a and b outside the mask,
+// measuring how much the processing altered the areas it should have left untouched.
+// The PSNR is +Inf when those areas are identical.
+func MaskedQuality(a, b, mask gocv.Mat) (float64, float64) {
+	keep := gocv.NewMat()
+	defer keep.Close()
+	gocv.BitwiseNot(mask, &keep)
+
+	x := grayFloat(a)
+	defer x.Close()
+	y := grayFloat(b)
+	defer y.Close()
+
+	return maskedPSNR(x, y, keep), maskedSSIM(x, y, keep)
+}
+
+// grayFloat returns the image converted to a single channel float32 image.
+func grayFloat(img gocv.Mat) gocv.Mat {
+	gray := gocv.NewMat()
+	defer gray.Close()
+	switch img.Channels() {
+	case 1:
+		img.CopyTo(&gray)
+	case 4:
+		gocv.CvtColor(img, &gray, gocv.ColorBGRAToGray)
+	default:
+		gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
+	}
+
+	out := gocv.NewMat()
+	gray.ConvertTo(&out, gocv.MatTypeCV32F)
+	return out
+}
+
+// maskedPSNR returns the peak signal to noise ratio of the float images over the non-zero pixels of keep.
+func maskedPSNR(x, y, keep gocv.Mat) float64 {
+	diff := gocv.NewMat()
+	defer diff.Close()
+	gocv.Subtract(x, y, &diff)
+
+	sq := gocv.NewMat()
+	defer sq.Close()
+	gocv.Multiply(diff, diff, &sq)
+
+	mse := sq.MeanWithMask(keep).Val1
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
+
+// maskedSSIM returns the mean structural similarity of the float images over the non-zero pixels of keep.
+func maskedSSIM(x, y, keep gocv.Mat) float64 {
+	blur := func(src gocv.Mat) gocv.Mat {
+		dst := gocv.NewMat()
+		gocv.GaussianBlur(src, &dst, image.Point{X: ssimWindow, Y: ssimWindow}, ssimSigma, ssimSigma, gocv.BorderDefault)
+		return dst
+	}
+	mul := func(a, b gocv.Mat) gocv.Mat {
+		dst := gocv.NewMat()
+		gocv.Multiply(a, b, &dst)
+		return dst
+	}
+	// weighted returns alpha*a + beta*b + gamma
+	weighted := func(a gocv.Mat, alpha float64, b gocv.Mat, beta, gamma float64) gocv.Mat {
+		dst := gocv.NewMat()
+		gocv.AddWeighted(a, alpha, b, beta, gamma, &dst)
+		return dst
+	}
+
+	// Local means
+	muX := blur(x)
+	defer muX.Close()
+	muY := blur(y)
+	defer muY.Close()
+	muXX := mul(muX, muX)
+	defer muXX.Close()
+	muYY := mul(muY, muY)
+	defer muYY.Close()
+	muXY := mul(muX, muY)
+	defer muXY.Close()
+
+	// Local variances and covariance
+	xx := mul(x, x)
+	defer xx.Close()
+	yy := mul(y, y)
+	defer yy.Close()
+	xy := mul(x, y)
+	defer xy.Close()
+	blurXX := blur(xx)
+	defer blurXX.Close()
+	blurYY := blur(yy)
+	defer blurYY.Close()
+	blurXY := blur(xy)
+	defer blurXY.Close()
+	sigmaXX := weighted(blurXX, 1, muXX, -1, 0)
+	defer sigmaXX.Close()
+	sigmaYY := weighted(blurYY, 1, muYY, -1, 0)
+	defer sigmaYY.Close()
+	sigmaXY := weighted(blurXY, 1, muXY, -1, 0)
+	defer sigmaXY.Close()
+
+	// ssim = (2*muXY + C1)(2*sigmaXY + C2) / ((muXX + muYY + C1)(sigmaXX + sigmaYY + C2))
+	n1 := weighted(muXY, 2, muXY, 0, ssimC1)
+	defer n1.Close()
+	n2 := weighted(sigmaXY, 2, sigmaXY, 0, ssimC2)
+	defer n2.Close()
+	num := mul(n1, n2)
+	defer num.Close()
+	d1 := weighted(muXX, 1, muYY, 1, ssimC1)
+	defer d1.Close()
+	d2 := weighted(sigmaXX, 1, sigmaYY, 1, ssimC2)
+	defer d2.Close()
+	den := mul(d1, d2)
+	defer den.Close()
+
+	ssim := gocv.NewMat()
+	defer ssim.Close()
+	gocv.Divide(num, den, &ssim)
+
+	return ssim.MeanWithMask(keep).Val1
+}
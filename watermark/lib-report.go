@@ -0,0 +1,114 @@
+package watermark
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// ReportFormatJSON writes a single JSON object, or an array of objects in directory mode
+	ReportFormatJSON = "json"
+	// ReportFormatNDJSON writes one JSON object per line
+	ReportFormatNDJSON = "ndjson"
+)
+
+// Result describes the processing of a single image.
+type Result struct {
+	Src string `json:"src"`
+	// Page is the page number of the result within a multi-page Src, numbered from 1
+	Page       int     `json:"page,omitempty"`
+	Dst        string  `json:"dst,omitempty"`
+	DurationMs int64   `json:"durationMs"`
+	Brightness float32 `json:"brightness"`
+	Mean       float32 `json:"mean"`
+	StdDev     float32 `json:"stdDev"`
+	Threshold  float32 `json:"threshold"`
+	// ComputedThreshold is the threshold derived from the image metrics, reported when a fixed threshold replaced it
+	ComputedThreshold float32 `json:"computedThreshold,omitempty"`
+	Color             bool    `json:"color"`
+	// CarbonCopy is set when the image was detected as a carbon copy, Inverted when it was inverted
+	CarbonCopy bool `json:"carbonCopy"`
+	Inverted   bool `json:"inverted"`
+	// AutoContrastAlpha and AutoContrastBeta are the applied auto contrast gain and offset
+	AutoContrastAlpha float64 `json:"autoContrastAlpha,omitempty"`
+	AutoContrastBeta  float64 `json:"autoContrastBeta,omitempty"`
+	// ChangedPixels is the number of pixels changed by the processing, ChangedBoxes the
+	// [x, y, width, height] bounding rectangles of the changed regions
+	ChangedPixels int      `json:"changedPixels"`
+	ChangedBoxes  [][4]int `json:"changedBoxes,omitempty"`
+	// Thumbnails are the paths the thumbnails were written to, if any
+	Thumbnails []string `json:"thumbnails,omitempty"`
+	// Compare is the path the side by side comparison was written to, if any
+	Compare string `json:"compare,omitempty"`
+	// Pages holds the result of every page of a multi-page document, whose own metrics are left empty
+	Pages []Result `json:"pages,omitempty"`
+	// Skipped holds the reason the image was skipped, if any
+	Skipped string `json:"skipped,omitempty"`
+	// Error holds the reason the image failed, if any
+	Error string `json:"error,omitempty"`
+
+	// psnr and ssim measure how much the areas outside the mask were altered, when reported
+	psnr, ssim float64
+	// stages holds the time spent in each processing stage, in order
+	stages []stage
+}
+
+// stage is the time spent in a processing stage of an image, summed over its regions and tiles.
+type stage struct {
+	name     string
+	duration time.Duration
+}
+
+// timeStage adds the time elapsed since start to the named processing stage.
+func (res *Result) timeStage(name string, start time.Time) {
+	d := time.Since(start)
+	for i := range res.stages {
+		if res.stages[i].name == name {
+			res.stages[i].duration += d
+			return
+		}
+	}
+	res.stages = append(res.stages, stage{name: name, duration: d})
+}
+
+// ValidateReportFormat checks the report format is supported.
+func ValidateReportFormat(format string) error {
+	if format != ReportFormatJSON && format != ReportFormatNDJSON {
+		return fmt.Errorf("invalid report format %q: expected %s or %s", format, ReportFormatJSON, ReportFormatNDJSON)
+	}
+	return nil
+}
+
+// WriteReport writes the results to path. In json format a single result is written as an object
+// unless batch is set, in which case the results are written as an array.
+func WriteReport(path, format string, results []Result, batch bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	switch {
+	case format == ReportFormatNDJSON:
+		for _, r := range results {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+	case !batch && len(results) == 1:
+		err = enc.Encode(results[0])
+	default:
+		if results == nil {
+			results = []Result{}
+		}
+		err = enc.Encode(results)
+	}
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
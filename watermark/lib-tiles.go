@@ -0,0 +1,91 @@
+package watermark
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"gocv.io/x/gocv"
+)
+
+// DefaultTileOverlap is the overlap in pixels between neighboring tiles used when none is configured
+const DefaultTileOverlap = 32
+
+// ValidateTiling checks the tile size and overlap. The overlap must be smaller than the tiles and at least
+// twice the largest inpaint radius of the config, so that the inpainting near tile edges has enough context.
+func ValidateTiling(size, overlap int, cfg Config) error {
+	if size < 0 {
+		return fmt.Errorf("invalid tile size %d, must be a positive size", size)
+	}
+	if size == 0 {
+		return nil
+	}
+	if overlap >= size {
+		return fmt.Errorf("invalid tile overlap %d, must be smaller than the tile size %d", overlap, size)
+	}
+
+	radius := cfg.InpaintRadius
+	for _, m := range cfg.Masks {
+		radius = max(radius, m.InpaintRadius)
+	}
+	for _, r := range cfg.Rules {
+		for _, m := range r.Masks {
+			radius = max(radius, m.InpaintRadius)
+		}
+	}
+	if least := int(math.Ceil(float64(2 * radius))); overlap < least {
+		return fmt.Errorf("invalid tile overlap %d, must be at least twice the inpaint radius: %d", overlap, least)
+	}
+	return nil
+}
+
+// TileRegions splits an image of the given size into tiles of tile x tile pixels overlapping their
+// left and top neighbors by overlap pixels. Tiles at the right and bottom edges are clipped.
+func TileRegions(size image.Point, tile, overlap int) []image.Rectangle {
+	bounds := image.Rect(0, 0, size.X, size.Y)
+	step := tile - overlap
+
+	var tiles []image.Rectangle
+	for y := 0; y == 0 || y+overlap < size.Y; y += step {
+		for x := 0; x == 0 || x+overlap < size.X; x += step {
+			tiles = append(tiles, image.Rect(x, y, x+tile, y+tile).Intersect(bounds))
+		}
+	}
+	return tiles
+}
+
+// TileWeights returns the CV32FC1 weights of a width x height tile blended over its left and top neighbors,
+// ramping from 0 to 1 across the left and top overlaps, and 1 elsewhere.
+func TileWeights(width, height, left, top int) gocv.Mat {
+	ramp := func(rows, cols, overlap int) gocv.Mat {
+		m := gocv.NewMatWithSize(rows, cols, gocv.MatTypeCV32F)
+		for i := 0; i < max(rows, cols); i++ {
+			v := float32(1)
+			if i < overlap {
+				v = float32(i+1) / float32(overlap+1)
+			}
+			if rows == 1 {
+				m.SetFloatAt(0, i, v)
+			} else {
+				m.SetFloatAt(i, 0, v)
+			}
+		}
+		return m
+	}
+
+	row := ramp(1, width, left)
+	defer row.Close()
+	col := ramp(height, 1, top)
+	defer col.Close()
+
+	rows := gocv.NewMat()
+	defer rows.Close()
+	gocv.Repeat(row, height, 1, &rows)
+	cols := gocv.NewMat()
+	defer cols.Close()
+	gocv.Repeat(col, 1, width, &cols)
+
+	weights := gocv.NewMat()
+	gocv.Multiply(rows, cols, &weights)
+	return weights
+}
@@ -0,0 +1,71 @@
+package watermark
+
+import (
+	"image"
+	"slices"
+	"testing"
+)
+
+func TestTileRegions(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    image.Point
+		tile    int
+		overlap int
+		want    []image.Rectangle
+	}{
+		{name: "smaller than a tile", size: image.Pt(300, 200), tile: 512, overlap: 32, want: []image.Rectangle{image.Rect(0, 0, 300, 200)}},
+		{
+			name: "exact fit",
+			size: image.Pt(992, 512), tile: 512, overlap: 32,
+			want: []image.Rectangle{image.Rect(0, 0, 512, 512), image.Rect(480, 0, 992, 512)},
+		},
+		{
+			name: "clipped edges",
+			size: image.Pt(1000, 600), tile: 512, overlap: 32,
+			want: []image.Rectangle{
+				image.Rect(0, 0, 512, 512), image.Rect(480, 0, 992, 512), image.Rect(960, 0, 1000, 512),
+				image.Rect(0, 480, 512, 600), image.Rect(480, 480, 992, 600), image.Rect(960, 480, 1000, 600),
+			},
+		},
+		{
+			name: "no overlap",
+			size: image.Pt(200, 100), tile: 100, overlap: 0,
+			want: []image.Rectangle{image.Rect(0, 0, 100, 100), image.Rect(100, 0, 200, 100)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TileRegions(tt.size, tt.tile, tt.overlap); !slices.Equal(got, tt.want) {
+				t.Errorf("TileRegions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTiling(t *testing.T) {
+	cfg := Config{InpaintRadius: 5, Masks: []Mask{{InpaintRadius: 3}}}
+	wide := Config{InpaintRadius: 5, Rules: []Rule{{Masks: []Mask{{InpaintRadius: 20}}}}}
+	tests := []struct {
+		name    string
+		size    int
+		overlap int
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "disabled", cfg: cfg},
+		{name: "disabled ignores the overlap", overlap: 1, cfg: cfg},
+		{name: "valid", size: 512, overlap: 10, cfg: cfg},
+		{name: "negative size", size: -1, cfg: cfg, wantErr: true},
+		{name: "overlap not smaller than the tile", size: 64, overlap: 64, cfg: cfg, wantErr: true},
+		{name: "overlap below twice the radius", size: 512, overlap: 9, cfg: cfg, wantErr: true},
+		{name: "overlap below twice a rule mask radius", size: 512, overlap: 32, cfg: wide, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateTiling(tt.size, tt.overlap, tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateTiling() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
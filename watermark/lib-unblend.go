@@ -0,0 +1,126 @@
+package watermark
+
+import (
+	"fmt"
+	"math"
+
+	"gocv.io/x/gocv"
+)
+
+// Validate checks the unblend alpha and watermark color.
+func (o UnblendOptions) Validate() error {
+	if o.Alpha < 0 || o.Alpha >= 1 {
+		return fmt.Errorf("invalid unblend alpha %g, expected 0 to 1 (excluded)", o.Alpha)
+	}
+	if len(o.Color) != 0 {
+		if len(o.Color) != 3 {
+			return fmt.Errorf("invalid unblend color %v: expected [r, g, b]", o.Color)
+		}
+		for _, v := range o.Color {
+			if v < 0 || v > 255 {
+				return fmt.Errorf("invalid unblend color %v: values must be in the 0-255 range", o.Color)
+			}
+		}
+	}
+	return nil
+}
+
+// watermarkColor returns the watermark color as a scalar matching the image channels, black by default.
+func (o UnblendOptions) watermarkColor(channels int) gocv.Scalar {
+	if len(o.Color) != 3 {
+		return gocv.Scalar{}
+	}
+	r, g, b := float64(o.Color[0]), float64(o.Color[1]), float64(o.Color[2])
+	if channels == 1 {
+		// ITU-R BT.601 luma, as used by OpenCV gray conversions
+		return gocv.Scalar{Val1: 0.299*r + 0.587*g + 0.114*b}
+	}
+	return gocv.Scalar{Val1: b, Val2: g, Val3: r}
+}
+
+// Unblend recovers the masked pixels of an image a watermark of uniform color was alpha blended over,
+// watermarked = alpha*wm + (1-alpha)*original, by reversing the blend:
+// original = (watermarked - alpha*wm) / (1-alpha). Unlike inpainting, the content under the watermark is
+// kept. Pixels outside the mask are left as is, and results outside the 0-255 range are clamped.
+func Unblend(img, mask gocv.Mat, alpha float64, wm gocv.Scalar) gocv.Mat {
+	color := gocv.NewMatWithSize(img.Rows(), img.Cols(), img.Type())
+	defer color.Close()
+	color.SetTo(wm)
+
+	restored := gocv.NewMat()
+	defer restored.Close()
+	gocv.AddWeighted(img, 1/(1-alpha), color, -alpha/(1-alpha), 0, &restored)
+
+	out := img.Clone()
+	restored.CopyToWithMask(&out, mask)
+	return out
+}
+
+const (
+	// UnblendMinAlpha and UnblendMaxAlpha bound the estimated alpha, excluding the degenerate 0 and 1
+	UnblendMinAlpha = 0.01
+	UnblendMaxAlpha = 0.95
+	// UnblendMinContrast is the difference between the watermark color and the background below which
+	// pixels carry no information on the alpha and are left out of its estimation
+	UnblendMinContrast = 8
+)
+
+// EstimateAlpha estimates the opacity of the watermark of color wm blended over the masked pixels of the image,
+// given the background of the image without the watermark, eg. inpainted. It solves
+// watermarked - background = alpha * (wm - background) by least squares over the masked pixels, leaving out
+// the saturated pixels, whose value was clipped, and those whose background is too close to the watermark
+// color for the equation to tell the alpha. The estimate is clamped to [UnblendMinAlpha, UnblendMaxAlpha].
+// It returns false when no pixel is usable.
+func EstimateAlpha(img, background, mask gocv.Mat, wm gocv.Scalar) (float64, bool) {
+	f := gocv.NewMat()
+	defer f.Close()
+	img.ConvertTo(&f, gocv.MatTypeCV32F)
+	bg := gocv.NewMat()
+	defer bg.Close()
+	background.ConvertTo(&bg, gocv.MatTypeCV32F)
+	color := gocv.NewMatWithSize(f.Rows(), f.Cols(), f.Type())
+	defer color.Close()
+	color.SetTo(wm)
+
+	// Masked pixels not saturated in any channel
+	unsaturated := gocv.NewMat()
+	defer unsaturated.Close()
+	gocv.InRangeWithScalar(img, gocv.Scalar{Val1: 1, Val2: 1, Val3: 1}, gocv.Scalar{Val1: 254, Val2: 254, Val3: 254}, &unsaturated)
+	pixels := gocv.NewMat()
+	defer pixels.Close()
+	gocv.BitwiseAnd(unsaturated, mask, &pixels)
+	if gocv.CountNonZero(pixels) == 0 {
+		return 0, false
+	}
+	if img.Channels() == 3 {
+		gocv.CvtColor(pixels, &pixels, gocv.ColorGrayToBGR)
+	}
+	valid := gocv.NewMat()
+	defer valid.Close()
+	pixels.ConvertToWithParams(&valid, gocv.MatTypeCV32F, 1.0/255, 0)
+
+	// Values where the watermark color stands out from the background
+	d := gocv.NewMat()
+	defer d.Close()
+	gocv.Subtract(color, bg, &d)
+	contrast := gocv.NewMat()
+	defer contrast.Close()
+	gocv.AbsDiff(color, bg, &contrast)
+	gocv.Threshold(contrast, &contrast, UnblendMinContrast, 1, gocv.ThresholdBinary)
+	gocv.Multiply(valid, contrast, &valid)
+	gocv.Multiply(d, valid, &d)
+
+	// alpha = sum((watermarked - background) * (wm - background)) / sum((wm - background)^2)
+	observed := gocv.NewMat()
+	defer observed.Close()
+	gocv.Subtract(f, bg, &observed)
+	gocv.Multiply(observed, d, &observed)
+	gocv.Multiply(d, d, &d)
+	num, den := observed.Sum(), d.Sum()
+	sum := func(s gocv.Scalar) float64 { return s.Val1 + s.Val2 + s.Val3 + s.Val4 }
+	if sum(den) == 0 {
+		return 0, false
+	}
+
+	return math.Min(UnblendMaxAlpha, math.Max(UnblendMinAlpha, sum(num)/sum(den))), true
+}
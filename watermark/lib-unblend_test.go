@@ -0,0 +1,27 @@
+package watermark
+
+import "testing"
+
+func TestUnblendOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    UnblendOptions
+		wantErr bool
+	}{
+		{name: "estimated alpha, black", opts: UnblendOptions{}},
+		{name: "alpha and color", opts: UnblendOptions{Alpha: 0.3, Color: []int{200, 0, 0}}},
+		{name: "color bounds", opts: UnblendOptions{Color: []int{0, 255, 0}}},
+		{name: "negative alpha", opts: UnblendOptions{Alpha: -0.1}, wantErr: true},
+		{name: "opaque alpha", opts: UnblendOptions{Alpha: 1}, wantErr: true},
+		{name: "color channels", opts: UnblendOptions{Color: []int{128, 128}}, wantErr: true},
+		{name: "color above 255", opts: UnblendOptions{Color: []int{0, 0, 256}}, wantErr: true},
+		{name: "negative color", opts: UnblendOptions{Color: []int{-1, 0, 0}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
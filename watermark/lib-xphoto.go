@@ -0,0 +1,41 @@
+//go:build xphoto
+
+package watermark
+
+import (
+	"gocv.io/x/gocv"
+	"gocv.io/x/gocv/contrib"
+)
+
+// XPhotoAvailable reports whether the OpenCV contrib xphoto module is compiled in.
+const XPhotoAvailable = true
+
+// XPhotoInpaint removes a watermark from an image using the xphoto inpainting algorithms.
+func XPhotoInpaint(src, mask gocv.Mat, algorithm XPhotoMethod) gocv.Mat {
+	// xphoto expects non-zero mask pixels to mark the valid image area
+	valid := gocv.NewMat()
+	defer valid.Close()
+	gocv.BitwiseNot(mask, &valid)
+
+	// xphoto expects 3-channel images in CIELab or a similar colorspace
+	lab := gocv.NewMat()
+	defer lab.Close()
+	if src.Channels() == 3 {
+		gocv.CvtColor(src, &lab, gocv.ColorBGRToLab)
+	} else {
+		src.CopyTo(&lab)
+	}
+
+	inpainted := gocv.NewMat()
+	defer inpainted.Close()
+	contrib.Inpaint(&lab, &valid, &inpainted, contrib.InpaintTypes(algorithm))
+
+	out := gocv.NewMat()
+	if src.Channels() == 3 {
+		gocv.CvtColor(inpainted, &out, gocv.ColorLabToBGR)
+	} else {
+		inpainted.CopyTo(&out)
+	}
+
+	return out
+}
@@ -0,0 +1,16 @@
+//go:build !xphoto
+
+package watermark
+
+import (
+	"gocv.io/x/gocv"
+)
+
+// XPhotoAvailable reports whether the OpenCV contrib xphoto module is compiled in.
+// Build with -tags xphoto against an OpenCV build including the contrib modules to enable it.
+const XPhotoAvailable = false
+
+// XPhotoInpaint falls back to Telea inpainting when the xphoto module is not compiled in.
+func XPhotoInpaint(src, mask gocv.Mat, algorithm XPhotoMethod) gocv.Mat {
+	return RemoveWatermark(src, mask, gocv.Telea, DefaultInpaintRadius)
+}
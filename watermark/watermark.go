@@ -0,0 +1,697 @@
+// Package watermark removes watermarks from scanned document images by locating mask templates
+// and inpainting the pixels they cover. Remove processes a single image; Pipeline processes
+// image files as the rm-watermarks-cli command does.
+package watermark
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gocv.io/x/gocv"
+	"gopkg.in/yaml.v3"
+)
+
+// Version is the tool version, set at build time with -ldflags "-X github.com/cyber-nic/rm-watermarks-cli/watermark.Version=..."
+var Version = "dev"
+
+const (
+	// DefaultCarbonCopyThreshold is the brightness below which images are carbon copies, see Config.CarbonCopyThreshold
+	DefaultCarbonCopyThreshold float32 = 96
+
+	MaskCombineOr  = "or"
+	MaskCombineAnd = "and"
+
+	MaskModeAdd      = "add"
+	MaskModeSubtract = "subtract"
+
+	// DetectThreshold builds the mask from the mean thresholded image
+	DetectThreshold = "threshold"
+	// DetectGradient builds the mask from the outlines highlighted by a morphological gradient
+	DetectGradient = "gradient"
+
+	// ThresholdMean binarizes images at a single threshold derived from the image mean
+	ThresholdMean = "mean"
+	// ThresholdAdaptive binarizes images at the mean of each pixel neighborhood, for uneven lighting
+	ThresholdAdaptive = "adaptive"
+
+	// ForegroundThresholdOtsu lets the Otsu algorithm pick the foreground text threshold
+	ForegroundThresholdOtsu = "otsu"
+	// ForegroundThresholdManual uses the configured foreground text threshold value
+	ForegroundThresholdManual = "manual"
+
+	// ModeInpaint removes the watermark by inpainting
+	ModeInpaint = "inpaint"
+	// ModeCutout makes the watermark transparent, requires an output format supporting alpha
+	ModeCutout = "cutout"
+	// ModeFFT removes a watermark tiled across the whole image by notch filtering its spectrum, without masks
+	ModeFFT = "fft"
+	// ModeClone covers the watermark with a clean sample of the image at the configured offset, seamlessly blended
+	ModeClone = "clone"
+	// ModeUnblend reverses the alpha blending of a semi-transparent watermark, keeping the content underneath
+	ModeUnblend = "unblend"
+)
+
+type Mask struct {
+	File string `yaml:"file"`
+	// Rect is the [x, y, width, height] area of the image inpainted as is, in place of a template File.
+	// No thresholding applies, making it the fastest mask for watermarks at a known position
+	Rect []int `yaml:"rect"`
+	// Polygon lists the [x, y] image pixel vertices of the area inpainted as is, in place of a template File,
+	// eg. to tightly outline a slanted watermark
+	Polygon [][]int `yaml:"polygon"`
+	// Gravity anchors the template in the image, or is "auto" to locate the watermark by template matching,
+	// or "features" to locate it by feature matching, following its rotation and scale
+	Gravity    string `yaml:"gravity"`
+	Foreground bool   `yaml:"foreground"`
+	// OffsetX and OffsetY shift the template placed by gravity right and down, negative values
+	// shift it left and up, eg. -40 and -120 with south-east keep it 40px from the right and 120px from the bottom
+	OffsetX int `yaml:"offsetX"`
+	OffsetY int `yaml:"offsetY"`
+	// MinMatchScore is the match score an "auto" gravity mask must reach to be located, defaults to 0.5
+	MinMatchScore float32 `yaml:"minMatchScore"`
+	// MinInliers is the number of matched features a "features" gravity mask must reach to be located, defaults to 12
+	MinInliers int `yaml:"minInliers"`
+	// FallbackGravity is used when an "auto" or "features" gravity mask is not located. Empty (default) skips the mask
+	FallbackGravity string `yaml:"fallbackGravity"`
+	// ExcludeRect lists [x, y, width, height] rectangles of the template that are never inpainted
+	ExcludeRect [][]int `yaml:"excludeRect"`
+	// Rotation rotates the template counterclockwise by this many degrees before placement
+	Rotation float64 `yaml:"rotation"`
+	// Detect is the detection strategy: "threshold" (default) or "gradient" for outline watermarks
+	Detect string `yaml:"detect"`
+	// GradientKernel is the morphological gradient kernel size, defaults to 3
+	GradientKernel int `yaml:"gradientKernel"`
+	// Mode is either "add" (default) or "subtract". Subtract masks are removed
+	// from the aggregated mask after all add masks have been combined.
+	Mode string `yaml:"mode"`
+	// Tile repeats the template across the whole image, spaced by TileSpacingX/Y pixels
+	// and shifted by TileOffsetX/Y pixels. Useful for small logos tiled over the page.
+	Tile         bool `yaml:"tile"`
+	TileSpacingX int  `yaml:"tileSpacingX"`
+	TileSpacingY int  `yaml:"tileSpacingY"`
+	TileOffsetX  int  `yaml:"tileOffsetX"`
+	TileOffsetY  int  `yaml:"tileOffsetY"`
+	// InpaintRadius inpaints this mask in its own pass with this radius, eg. a small radius for a thin
+	// signature line next to a large stamp. 0 (default) inpaints it with the other masks at the global radius
+	InpaintRadius float32 `yaml:"inpaintRadius"`
+}
+
+// Calibration is a per-device tone correction applied to the source image before any processing.
+// A LUT file takes precedence over the levels parameters. The zero value is a no-op.
+type Calibration struct {
+	// File holds 256 whitespace-separated output values (0-255), one per input value
+	File string `yaml:"file"`
+	// Black and White are the input levels mapped to 0 and 255 (White defaults to 255)
+	Black int `yaml:"black"`
+	White int `yaml:"white"`
+	// Gamma is applied between the black and white levels, values < 1 brightening midtones (defaults to 1)
+	Gamma float64 `yaml:"gamma"`
+}
+
+// Annotation controls how the -annotate provenance text is drawn on the output.
+type Annotation struct {
+	// Scale is the font scale (defaults to 1)
+	Scale float64 `yaml:"scale"`
+	// Color is the text RGB color (defaults to black)
+	Color []int `yaml:"color"`
+	// Position is the corner the text is drawn at: north-west, north-east, south-west or south-east (default)
+	Position string `yaml:"position"`
+	// Thickness is the text line thickness (defaults to 1)
+	Thickness int `yaml:"thickness"`
+}
+
+// Confidence gates each mask on detection signals agreeing a watermark is present.
+// Every enabled (non-zero) threshold must pass for the mask to be applied.
+type Confidence struct {
+	// MinMatchScore is the minimum normalized correlation between template and image, in [-1, 1]
+	MinMatchScore float32 `yaml:"minMatchScore"`
+	// MinCoverage and MaxCoverage bound the fraction of the image covered by the mask, in [0, 1]
+	MinCoverage float64 `yaml:"minCoverage"`
+	MaxCoverage float64 `yaml:"maxCoverage"`
+	// MinContrast is the minimum mean intensity difference between the mask and the rest of the image
+	MinContrast float32 `yaml:"minContrast"`
+}
+
+// Sharpen restores text crispness in a band around the inpainted region using an unsharp mask
+// whose added high-frequency component is clamped to avoid ringing. A zero Amount disables it.
+type Sharpen struct {
+	// Amount scales the high-frequency component added back to the image
+	Amount float64 `yaml:"amount"`
+	// Radius is the Gaussian blur radius in pixels (defaults to 1)
+	Radius int `yaml:"radius"`
+	// Clamp is the maximum change in pixel value (defaults to 16)
+	Clamp float64 `yaml:"clamp"`
+	// Band is the width in pixels of the band around the mask that gets sharpened (defaults to 8)
+	Band int `yaml:"band"`
+}
+
+// FFTOptions tunes the detection of the periodic peaks notched out of the spectrum in fft mode.
+type FFTOptions struct {
+	// MinRadius is the radius in frequency units around the spectrum center never notched (defaults to 8)
+	MinRadius int `yaml:"minRadius"`
+	// NotchRadius is the radius in frequency units of the notch around every peak (defaults to 3)
+	NotchRadius int `yaml:"notchRadius"`
+	// PeakThreshold is how far the log magnitude of a peak exceeds its neighborhood mean (defaults to 2).
+	// Lower values remove fainter patterns but risk notching frequencies of the content
+	PeakThreshold float64 `yaml:"peakThreshold"`
+}
+
+// CloneOptions locates the clean sample copied over every masked area in clone mode.
+type CloneOptions struct {
+	// OffsetX and OffsetY are the offset in pixels from a masked area to its sample, eg. 0 and -200 to sample
+	// the background 200 pixels above a logo
+	OffsetX int `yaml:"offsetX"`
+	OffsetY int `yaml:"offsetY"`
+}
+
+// UnblendOptions describes the semi-transparent watermark whose alpha blending is reversed in unblend mode.
+type UnblendOptions struct {
+	// Alpha is the watermark opacity, below 1. 0 (default) estimates it per image, see EstimateAlpha
+	Alpha float64 `yaml:"alpha"`
+	// Color is the watermark RGB color (defaults to black)
+	Color []int `yaml:"color"`
+}
+
+// Rule overrides the masks and threshold of the config for the images whose file name matches its pattern,
+// eg. for scans from different sources with watermarks at different positions.
+type Rule struct {
+	// Pattern is the glob the image file name is matched against (eg. invoice-*.jpg). A rule without pattern
+	// is the default rule, applying to the images matching no other rule
+	Pattern string `yaml:"pattern"`
+	// Masks replace the config masks when set
+	Masks []Mask `yaml:"masks"`
+	// Threshold overrides the config threshold settings it sets
+	Threshold *ThresholdOptions `yaml:"threshold"`
+}
+
+// CLAHEOptions configures the contrast limited adaptive histogram equalization (CLAHE) of the image masks
+// are computed on, making faint watermarks stand out from faded documents. A zero ClipLimit disables it.
+type CLAHEOptions struct {
+	// ClipLimit caps the contrast amplification of every tile, eg. 2. Higher values boost faint marks more,
+	// and the paper noise with them
+	ClipLimit float64 `yaml:"clipLimit"`
+	// TileGrid is the number of tiles per side the image is equalized in (defaults to 8)
+	TileGrid int `yaml:"tileGrid"`
+}
+
+// ThresholdOptions selects how images are binarized to separate the watermark from the text and background.
+type ThresholdOptions struct {
+	// Method is "mean" (default) or "adaptive"
+	Method string `yaml:"method"`
+	// BlockSize is the odd size in pixels of the neighborhood of adaptive thresholding (defaults to 31)
+	BlockSize int `yaml:"blockSize"`
+	// C is subtracted from the neighborhood mean by adaptive thresholding (defaults to 10)
+	C float32 `yaml:"c"`
+	// Value fixes the mean method threshold (0-255), eg. as picked by -auto-threshold. 0 (default) derives it from the image
+	Value float32 `yaml:"value"`
+}
+
+// ForegroundConfig controls the extraction of the foreground text kept out of the masks with foreground set,
+// and protected by the text safe zone.
+type ForegroundConfig struct {
+	// Threshold is "otsu" (default) or "manual" to force Value when Otsu picks a bad split
+	Threshold string `yaml:"threshold"`
+	// Value is the manual threshold (0-255), darker pixels being foreground text (defaults to 128)
+	Value float32 `yaml:"value"`
+	// KernelWidth and KernelHeight size the kernel the thresholded image is dilated with (defaults to 3x3),
+	// eg. 15x1 for horizontal line watermarks
+	KernelWidth  int `yaml:"kernelWidth"`
+	KernelHeight int `yaml:"kernelHeight"`
+	// KernelShape is the kernel shape: rect (default), ellipse or cross
+	KernelShape string `yaml:"kernelShape"`
+	// Iterations is the number of dilation passes, up to 5 (defaults to 1). Faint watermarks may need 2 or 3,
+	// but every pass also grows the text kept out of masks with foreground set
+	Iterations int `yaml:"iterations"`
+}
+
+// Config is the watermark removal configuration, read from YAML.
+type Config struct {
+	Debug  bool
+	Info   bool
+	Visual bool
+	Human  bool
+	Masks  []Mask
+	// MaskCombine is the bitwise operator used to aggregate add masks: "or" (default) or "and"
+	MaskCombine string `yaml:"maskCombine"`
+	// InpaintMethod is either a known method name (telea, ns) or a raw OpenCV inpaint flag value
+	InpaintMethod string `yaml:"inpaintMethod"`
+	// Foreground controls the extraction of the foreground text
+	Foreground ForegroundConfig `yaml:"foreground"`
+	// Threshold selects the binarization of the images masks are computed from
+	Threshold ThresholdOptions `yaml:"threshold"`
+	// CarbonCopyThreshold is the brightness (0-255) below which images are detected as dark carbon copies
+	// and inverted, defaults to 96
+	CarbonCopyThreshold float32 `yaml:"carbonCopyThreshold"`
+	// InpaintRadius is the neighborhood radius in pixels considered by the inpainting, defaults to 3
+	InpaintRadius float32 `yaml:"inpaintRadius"`
+	// SoftBlend blends the inpainted result with the original proportionally to the watermark intensity
+	SoftBlend bool `yaml:"softBlend"`
+	// Calibration neutralizes scanner specific color casts before thresholding
+	Calibration Calibration `yaml:"calibration"`
+	// MatchBrightness shifts the output mean brightness back to the source brightness
+	MatchBrightness bool `yaml:"matchBrightness"`
+	// Annotation styles the -annotate provenance text
+	Annotation Annotation `yaml:"annotation"`
+	// Confidence skips masks whose detection signals do not agree a watermark is present
+	Confidence Confidence `yaml:"confidence"`
+	// Sharpen restores text crispness around the inpainted region
+	Sharpen Sharpen `yaml:"sharpen"`
+	// AutoContrast stretches the histogram of poorly exposed scans before detection
+	AutoContrast bool `yaml:"autoContrast"`
+	// TextSafeZone is the buffer in pixels kept clear of every mask around text detected across the image
+	TextSafeZone int `yaml:"textSafeZone"`
+	// MaskBlur is the odd Gaussian kernel size of the blurred copy masks are computed on, 0 disables it.
+	// The sharp original is still inpainted
+	MaskBlur int `yaml:"maskBlur"`
+	// CLAHE locally boosts the contrast of the image masks are computed on, after the mask blur.
+	// The original is still inpainted
+	CLAHE CLAHEOptions `yaml:"clahe"`
+	// MaskDilate is the kernel size in pixels the aggregated mask is dilated with before inpainting, 0 disables it.
+	// Subtract masks and the text safe zone are removed after the dilation
+	MaskDilate int `yaml:"maskDilate"`
+	// ColorSaturationThreshold is the HSV saturation (0-255) from which pixels count as colored, defaults to 32
+	ColorSaturationThreshold int `yaml:"colorSaturationThreshold"`
+	// ColorMinFraction is the fraction (0-1) of colored pixels an image must exceed to be processed as color,
+	// eg. 0.005 ignores colored specks. 0 (default) makes a single colored pixel enough
+	ColorMinFraction float64 `yaml:"colorMinFraction"`
+	// ColorAllHues counts the saturated pixels of every hue as colored, reds and oranges included. By default
+	// only the hues from 32 (of 0-179) up count
+	ColorAllHues bool `yaml:"colorAllHues"`
+	// ApplyInvert inverts carbon copies before processing (default true). Carbon copies are detected
+	// and reported either way
+	ApplyInvert bool `yaml:"applyInvert"`
+	// ChromaSubsampling of JPEG outputs: 444, 422, 420 or 411. Empty keeps the OpenCV default of 420
+	ChromaSubsampling string `yaml:"chromaSubsampling"`
+	// PreProcess lists the filters applied in order before detection
+	PreProcess []Filter `yaml:"preProcess"`
+	// PostProcess lists the filters applied in order after inpainting
+	PostProcess []Filter `yaml:"postProcess"`
+	// PostBlur is the odd Gaussian kernel size smoothing the inpainted region, grown by the kernel size,
+	// after the post-processing filters. The rest of the image stays crisp. 0 disables it
+	PostBlur int `yaml:"postBlur"`
+	// FFT tunes the removal of tiled watermarks in fft mode
+	FFT FFTOptions `yaml:"fft"`
+	// Clone locates the samples covering the watermark in clone mode
+	Clone CloneOptions `yaml:"clone"`
+	// Unblend describes the watermark blended over the image in unblend mode
+	Unblend UnblendOptions `yaml:"unblend"`
+	// Rules override the masks and threshold per image file name, the first matching rule winning
+	Rules []Rule `yaml:"rules"`
+}
+
+// drawn reports whether the mask area is drawn from its rect or polygon rather than computed from a template.
+func (m Mask) drawn() bool {
+	return len(m.Rect) > 0 || len(m.Polygon) > 0
+}
+
+// ValidateMask checks the options of a mask entry of the config.
+func ValidateMask(m Mask) error {
+	if m.Mode != "" && m.Mode != MaskModeAdd && m.Mode != MaskModeSubtract {
+		return errors.New("invalid mask mode: " + m.Mode)
+	}
+	if len(m.Polygon) > 0 {
+		if m.File != "" || len(m.Rect) > 0 {
+			return errors.New("polygon cannot be combined with file or rect")
+		}
+		if len(m.Polygon) < 3 {
+			return fmt.Errorf("invalid polygon %v: expected at least 3 [x, y] points", m.Polygon)
+		}
+		for _, pt := range m.Polygon {
+			if len(pt) != 2 || pt[0] < 0 || pt[1] < 0 {
+				return fmt.Errorf("invalid polygon point %v: expected non-negative [x, y]", pt)
+			}
+		}
+		return nil
+	}
+	if len(m.Rect) > 0 {
+		if m.File != "" {
+			return errors.New("rect cannot be combined with file: " + m.File)
+		}
+		if len(m.Rect) != 4 || m.Rect[0] < 0 || m.Rect[1] < 0 || m.Rect[2] <= 0 || m.Rect[3] <= 0 {
+			return fmt.Errorf("invalid rect %v: expected [x, y, width, height] with a positive size", m.Rect)
+		}
+		return nil
+	}
+	if m.File == "" {
+		return errors.New("mask requires a file, a rect or a polygon")
+	}
+	f, err := os.Open(m.File)
+	if err != nil {
+		return fmt.Errorf("unreadable file: %w", err)
+	}
+	f.Close()
+	tpl, err := ReadTemplate(m.File)
+	if err != nil {
+		return err
+	}
+	defer tpl.Close()
+	located := m.Gravity == GravityAuto || m.Gravity == GravityFeatures
+	if located && m.Tile {
+		return errors.New(m.Gravity + " gravity cannot be combined with tile: " + m.File)
+	}
+	if m.MinInliers < 0 {
+		return fmt.Errorf("invalid minInliers %d: %s", m.MinInliers, m.File)
+	}
+	if !located && !(m.Tile && m.Gravity == "") {
+		if err := ValidateGravity(m.Gravity); err != nil {
+			return err
+		}
+	}
+	if m.FallbackGravity != "" {
+		if err := ValidateGravity(m.FallbackGravity); err != nil {
+			return fmt.Errorf("invalid fallbackGravity: %w", err)
+		}
+	}
+	if m.Detect != "" && m.Detect != DetectThreshold && m.Detect != DetectGradient {
+		return errors.New("invalid mask detect: " + m.Detect)
+	}
+	if m.GradientKernel < 0 {
+		return fmt.Errorf("invalid gradientKernel: %d", m.GradientKernel)
+	}
+	if m.InpaintRadius < 0 {
+		return fmt.Errorf("invalid inpaintRadius %g, must be a positive radius", m.InpaintRadius)
+	}
+	if err := ExcludeRects(&tpl, m.ExcludeRect); err != nil {
+		return fmt.Errorf("%s: invalid excludeRect: %w", m.File, err)
+	}
+	return nil
+}
+
+// Validate checks the threshold settings.
+func (o ThresholdOptions) Validate() error {
+	if o.Method != "" && o.Method != ThresholdMean && o.Method != ThresholdAdaptive {
+		return errors.New("invalid threshold method: " + o.Method)
+	}
+	if o.Value < 0 || o.Value > 255 {
+		return fmt.Errorf("invalid threshold value %g, expected 0 to 255", o.Value)
+	}
+	if o.Method == ThresholdAdaptive && o.BlockSize != 0 && (o.BlockSize < 3 || o.BlockSize%2 == 0) {
+		return fmt.Errorf("invalid threshold blockSize %d, must be an odd size of at least 3", o.BlockSize)
+	}
+	return nil
+}
+
+// merge returns the threshold settings overridden by the non-zero settings of over.
+func (o ThresholdOptions) merge(over ThresholdOptions) ThresholdOptions {
+	if over.Method != "" {
+		o.Method = over.Method
+	}
+	if over.BlockSize != 0 {
+		o.BlockSize = over.BlockSize
+	}
+	if over.C != 0 {
+		o.C = over.C
+	}
+	if over.Value != 0 {
+		o.Value = over.Value
+	}
+	return o
+}
+
+// ForFile returns the config applying to the image file: the masks and threshold of the first rule whose
+// pattern matches the file name, or of the default rule, override those of the config. It also returns
+// the index of the applied rule, -1 when none applies.
+func (cfg Config) ForFile(path string) (Config, int) {
+	name := filepath.Base(path)
+	for i, r := range cfg.Rules {
+		if r.Pattern != "" {
+			if ok, _ := filepath.Match(r.Pattern, name); !ok {
+				continue
+			}
+		}
+		if len(r.Masks) > 0 {
+			cfg.Masks = r.Masks
+		}
+		if r.Threshold != nil {
+			cfg.Threshold = cfg.Threshold.merge(*r.Threshold)
+		}
+		return cfg, i
+	}
+	return cfg, -1
+}
+
+// Validate checks the config settings, masks included, and reports every invalid setting at once,
+// one per line.
+func (cfg Config) Validate() error {
+	var errs []error
+	for i, m := range cfg.Masks {
+		if err := ValidateMask(m); err != nil {
+			errs = append(errs, fmt.Errorf("mask[%d]: %w", i, err))
+		}
+	}
+	if _, ok := XPhotoMethodNames[strings.ToLower(cfg.InpaintMethod)]; !ok {
+		if _, err := ParseInpaintMethod(cfg.InpaintMethod); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c := cfg.MaskCombine; c != "" && c != MaskCombineOr && c != MaskCombineAnd {
+		errs = append(errs, errors.New("invalid maskCombine: "+c))
+	}
+	if cfg.MaskBlur < 0 || (cfg.MaskBlur > 0 && cfg.MaskBlur%2 == 0) {
+		errs = append(errs, fmt.Errorf("invalid maskBlur %d, must be a positive odd kernel size", cfg.MaskBlur))
+	}
+	if cfg.FFT.MinRadius < 0 || cfg.FFT.NotchRadius < 0 || cfg.FFT.PeakThreshold < 0 {
+		errs = append(errs, errors.New("invalid fft options, must not be negative"))
+	}
+	if err := cfg.Threshold.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.CLAHE.ClipLimit < 0 || cfg.CLAHE.TileGrid < 0 {
+		errs = append(errs, fmt.Errorf("invalid clahe clipLimit %g or tileGrid %d, must not be negative", cfg.CLAHE.ClipLimit, cfg.CLAHE.TileGrid))
+	}
+	if t := cfg.Foreground.Threshold; t != "" && t != ForegroundThresholdOtsu && t != ForegroundThresholdManual {
+		errs = append(errs, errors.New("invalid foreground threshold: "+t))
+	}
+	if cfg.Foreground.Value < 0 || cfg.Foreground.Value > 255 {
+		errs = append(errs, fmt.Errorf("invalid foreground value %g, expected 0 to 255", cfg.Foreground.Value))
+	}
+	if cfg.Foreground.KernelWidth < 0 || cfg.Foreground.KernelHeight < 0 {
+		errs = append(errs, fmt.Errorf("invalid foreground kernel %dx%d, expected a size of at least 1x1", cfg.Foreground.KernelWidth, cfg.Foreground.KernelHeight))
+	}
+	if cfg.Foreground.Iterations < 0 || cfg.Foreground.Iterations > MaxForegroundIterations {
+		errs = append(errs, fmt.Errorf("invalid foreground iterations %d, expected 1 to %d", cfg.Foreground.Iterations, MaxForegroundIterations))
+	}
+	if _, ok := MorphShapeNames[cfg.Foreground.KernelShape]; !ok && cfg.Foreground.KernelShape != "" {
+		errs = append(errs, errors.New("invalid foreground kernelShape: "+cfg.Foreground.KernelShape))
+	}
+	if cfg.CarbonCopyThreshold < 0 || cfg.CarbonCopyThreshold > 255 {
+		errs = append(errs, fmt.Errorf("invalid carbonCopyThreshold %g, expected 0 to 255", cfg.CarbonCopyThreshold))
+	}
+	if cfg.ColorSaturationThreshold < 0 || cfg.ColorSaturationThreshold > 255 {
+		errs = append(errs, fmt.Errorf("invalid colorSaturationThreshold %d, expected 0 to 255", cfg.ColorSaturationThreshold))
+	}
+	if cfg.ColorMinFraction < 0 || cfg.ColorMinFraction > 1 {
+		errs = append(errs, fmt.Errorf("invalid colorMinFraction %g, expected 0 to 1", cfg.ColorMinFraction))
+	}
+	if cfg.PostBlur < 0 || (cfg.PostBlur > 0 && cfg.PostBlur%2 == 0) {
+		errs = append(errs, fmt.Errorf("invalid postBlur %d, must be a positive odd kernel size", cfg.PostBlur))
+	}
+	if cfg.MaskDilate < 0 {
+		errs = append(errs, fmt.Errorf("invalid maskDilate %d, must be a positive kernel size", cfg.MaskDilate))
+	}
+	if err := ValidateChromaSubsampling(cfg.ChromaSubsampling); err != nil {
+		errs = append(errs, err)
+	}
+	if err := ValidateFilters(cfg.PreProcess); err != nil {
+		errs = append(errs, fmt.Errorf("invalid preProcess: %w", err))
+	}
+	if err := ValidateFilters(cfg.PostProcess); err != nil {
+		errs = append(errs, fmt.Errorf("invalid postProcess: %w", err))
+	}
+	if err := cfg.Unblend.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Annotation.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Sharpen.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Confidence.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Calibration.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	for i, r := range cfg.Rules {
+		if _, err := filepath.Match(r.Pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("rules[%d]: invalid pattern %q: %w", i, r.Pattern, err))
+		}
+		if r.Pattern == "" && i != len(cfg.Rules)-1 {
+			errs = append(errs, fmt.Errorf("rules[%d]: the default rule without pattern must be the last rule", i))
+		}
+		for j, m := range r.Masks {
+			if err := ValidateMask(m); err != nil {
+				errs = append(errs, fmt.Errorf("rules[%d].masks[%d]: %w", i, j, err))
+			}
+		}
+		if r.Threshold != nil {
+			if err := cfg.Threshold.merge(*r.Threshold).Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("rules[%d]: %w", i, err))
+			}
+		}
+	}
+	if cfg.TextSafeZone < 0 {
+		errs = append(errs, fmt.Errorf("invalid textSafeZone: %d", cfg.TextSafeZone))
+	}
+	return errors.Join(errs...)
+}
+
+// withDefaults returns the config with the zero settings having no meaning of their own set to their
+// defaults, ie. the foreground kernel, its shape and iterations, and the adaptive threshold block size.
+func (cfg Config) withDefaults() Config {
+	fg := &cfg.Foreground
+	if fg.KernelWidth == 0 {
+		fg.KernelWidth = DefaultForegroundKernelSize
+	}
+	if fg.KernelHeight == 0 {
+		fg.KernelHeight = DefaultForegroundKernelSize
+	}
+	if fg.KernelShape == "" {
+		fg.KernelShape = MorphShapeRect
+	}
+	if fg.Iterations == 0 {
+		fg.Iterations = 1
+	}
+	if cfg.Threshold.BlockSize == 0 {
+		cfg.Threshold.BlockSize = DefaultAdaptiveBlockSize
+	}
+	return cfg
+}
+
+// NewPipeline validates the config and resolves the settings shared by every processed image. The zero
+// settings having no meaning of their own take their defaults, while those that do, eg. CarbonCopyThreshold,
+// ColorSaturationThreshold or ApplyInvert, are used as is: configs not read with ReadConfig should start
+// from DefaultConfig. The returned pipeline writes outputs with the default encoding, callers override the
+// fields as needed and check them with Pipeline.Validate.
+func NewPipeline(cfg Config) (*Pipeline, error) {
+	cfg = cfg.withDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	xphotoMethod, useXPhoto := XPhotoMethodNames[strings.ToLower(cfg.InpaintMethod)]
+	method := gocv.Telea
+	if !useXPhoto {
+		var err error
+		method, err = ParseInpaintMethod(cfg.InpaintMethod)
+		if err != nil {
+			return nil, err
+		}
+	}
+	lut, err := BuildCalibrationLUT(cfg.Calibration)
+	if err != nil {
+		return nil, err
+	}
+	combine := MaskCombineOr
+	if cfg.MaskCombine != "" {
+		combine = cfg.MaskCombine
+	}
+
+	if useXPhoto && !XPhotoAvailable {
+		log.Warn().Str("method", cfg.InpaintMethod).Msg("xphoto module not compiled in, falling back to telea inpainting")
+		useXPhoto = false
+	}
+	if cfg.InpaintRadius <= 0 {
+		log.Warn().Float32("radius", cfg.InpaintRadius).Float32("default", DefaultInpaintRadius).Msg("invalid inpaint radius, using default")
+		cfg.InpaintRadius = DefaultInpaintRadius
+	}
+	if !IsKnownInpaintMethod(method) {
+		log.Warn().Int("method", int(method)).Msg("inpaint method unknown to GoCV, passing it through to OpenCV as is")
+	}
+
+	return &Pipeline{
+		Config:          cfg,
+		Method:          method,
+		XPhotoMethod:    xphotoMethod,
+		UseXPhoto:       useXPhoto,
+		LUT:             lut,
+		Combine:         combine,
+		MaxPixelsAction: "downscale",
+		Mode:            ModeInpaint,
+		Encode: EncodeOptions{
+			JpegQuality:       -1,
+			PngCompression:    -1,
+			ChromaSubsampling: cfg.ChromaSubsampling,
+		},
+	}, nil
+}
+
+// Remove removes the watermarks of the config masks from the BGR source image and returns the result,
+// which the caller must close. The source image is left unchanged. The config should start from
+// DefaultConfig, see NewPipeline.
+func Remove(src gocv.Mat, cfg Config) (gocv.Mat, error) {
+	p, err := NewPipeline(cfg)
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+	return p.Remove(src)
+}
+
+// RemoveFromBytes removes the watermarks of the config masks from the encoded image and returns the
+// result encoded in the same format, or as PNG when the input format is not recognized. The config
+// should start from DefaultConfig, see NewPipeline.
+func RemoveFromBytes(data []byte, cfg Config) ([]byte, error) {
+	p, err := NewPipeline(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := gocv.IMDecode(data, gocv.IMReadColor|gocv.IMReadAnyDepth)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	if src.Empty() {
+		return nil, errors.New("unable to decode image")
+	}
+
+	out, err := p.Remove(src)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	ext := DetectImageFormat(data)
+	if ext == "" {
+		ext = ".png"
+	}
+	return EncodeImage(ext, out, WriteParams(ext, p.Encode))
+}
+
+// DefaultConfig returns the config with the defaults of the settings enabled unless disabled.
+func DefaultConfig() Config {
+	return Config{
+		ApplyInvert:              true,
+		InpaintRadius:            DefaultInpaintRadius,
+		CarbonCopyThreshold:      DefaultCarbonCopyThreshold,
+		Threshold:                ThresholdOptions{BlockSize: DefaultAdaptiveBlockSize, C: DefaultAdaptiveC},
+		ColorSaturationThreshold: DefaultColorSaturationThreshold,
+		Foreground: ForegroundConfig{
+			Value:        DefaultForegroundThreshold,
+			KernelWidth:  DefaultForegroundKernelSize,
+			KernelHeight: DefaultForegroundKernelSize,
+			KernelShape:  MorphShapeRect,
+			Iterations:   1,
+		},
+	}
+}
+
+// ReadConfig reads the YAML config file over the default config.
+func ReadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	configFile, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := yaml.Unmarshal(configFile, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,102 @@
+package watermark
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewPipeline(t *testing.T) {
+	rect := []Mask{{Rect: []int{10, 10, 100, 40}}}
+	def := DefaultConfig()
+	def.Masks = rect
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "default config", cfg: def},
+		{name: "zero config", cfg: Config{Masks: rect}},
+		{name: "invalid inpaint method", cfg: Config{Masks: rect, InpaintMethod: "smudge"}, wantErr: true},
+		{name: "invalid mask rect", cfg: Config{Masks: []Mask{{Rect: []int{10, 10, -100, 40}}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPipeline(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewPipeline() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			// The zero settings having no meaning of their own take their defaults
+			if p.Config.Foreground.KernelWidth != def.Foreground.KernelWidth || p.Config.Foreground.KernelHeight != def.Foreground.KernelHeight ||
+				p.Config.Foreground.KernelShape != def.Foreground.KernelShape || p.Config.Foreground.Iterations != def.Foreground.Iterations {
+				t.Errorf("NewPipeline() foreground = %+v, want the defaults of %+v", p.Config.Foreground, def.Foreground)
+			}
+			if p.Config.Threshold.BlockSize != def.Threshold.BlockSize {
+				t.Errorf("NewPipeline() threshold block size = %d, want %d", p.Config.Threshold.BlockSize, def.Threshold.BlockSize)
+			}
+			if p.Config.InpaintRadius != DefaultInpaintRadius {
+				t.Errorf("NewPipeline() inpaint radius = %g, want %g", p.Config.InpaintRadius, DefaultInpaintRadius)
+			}
+			if p.Mode != ModeInpaint || p.Combine != MaskCombineOr {
+				t.Errorf("NewPipeline() mode = %q, combine = %q, want %q and %q", p.Mode, p.Combine, ModeInpaint, MaskCombineOr)
+			}
+			if err := p.Validate(); err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(cfg *Config)
+		// want lists a fragment of every expected error, none for a valid config
+		want []string
+	}{
+		{name: "default", edit: func(cfg *Config) {}},
+		{name: "sections", edit: func(cfg *Config) {
+			cfg.Annotation = Annotation{Color: []int{255, 0, 0}, Position: "north-west"}
+			cfg.Sharpen = Sharpen{Amount: 0.5, Radius: 2}
+			cfg.Confidence = Confidence{MinMatchScore: 0.6, MinCoverage: 0.01, MaxCoverage: 0.2}
+			cfg.Calibration = Calibration{Black: 10, White: 240, Gamma: 0.8}
+		}},
+		{name: "calibration file skips the levels", edit: func(cfg *Config) { cfg.Calibration = Calibration{File: "lut.csv", Black: 300} }},
+		{name: "mask", edit: func(cfg *Config) { cfg.Masks[0].Rect = []int{0, 0, 10} }, want: []string{"mask[0]: invalid rect"}},
+		{name: "annotation color", edit: func(cfg *Config) { cfg.Annotation.Color = []int{255, 0} }, want: []string{"invalid annotation color"}},
+		{name: "annotation position", edit: func(cfg *Config) { cfg.Annotation.Position = "center" }, want: []string{"invalid annotation position"}},
+		{name: "sharpen", edit: func(cfg *Config) { cfg.Sharpen.Radius = -1 }, want: []string{"invalid sharpen"}},
+		{name: "confidence coverage", edit: func(cfg *Config) { cfg.Confidence.MinCoverage, cfg.Confidence.MaxCoverage = 0.5, 0.2 }, want: []string{"above maxCoverage"}},
+		{name: "confidence contrast", edit: func(cfg *Config) { cfg.Confidence.MinContrast = 300 }, want: []string{"invalid confidence minContrast"}},
+		{name: "calibration levels", edit: func(cfg *Config) { cfg.Calibration.Black = 255 }, want: []string{"invalid calibration levels"}},
+		{name: "rule pattern", edit: func(cfg *Config) { cfg.Rules = []Rule{{Pattern: "[scan"}} }, want: []string{"rules[0]: invalid pattern"}},
+		{name: "every error", edit: func(cfg *Config) {
+			cfg.Masks[0].Rect = nil
+			cfg.Masks[0].Polygon = [][]int{{0, 0}, {10, 0}}
+			cfg.MaskBlur = 4
+			cfg.Annotation.Position = "center"
+			cfg.Sharpen.Amount = -1
+			cfg.Confidence.MinMatchScore = 2
+			cfg.Calibration.Gamma = -1
+		}, want: []string{"mask[0]", "invalid maskBlur", "invalid annotation position", "invalid sharpen", "invalid confidence minMatchScore", "invalid calibration gamma"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Masks = []Mask{{Rect: []int{10, 10, 100, 40}}}
+			tt.edit(&cfg)
+			err := cfg.Validate()
+			if (err != nil) != (len(tt.want) > 0) {
+				t.Fatalf("Validate() error = %v, want %v", err, tt.want)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() error = %v, want it to report %q", err, want)
+				}
+			}
+		})
+	}
+}